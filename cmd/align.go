@@ -1,14 +1,18 @@
 package cmd
 
 import (
+	"bufio"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/pkg/profile"
 	"github.com/spf13/cobra"
+	"github.com/will-rowe/groot/src/graph"
 	"github.com/will-rowe/groot/src/lshe"
 	"github.com/will-rowe/groot/src/misc"
 	"github.com/will-rowe/groot/src/pipeline"
@@ -18,11 +22,33 @@ import (
 // the command line arguments
 var (
 	fastq                *[]string                                                         // list of FASTQ files to align
+	bamInput             *bool                                                             // flag to treat STDIN as unaligned BAM/SAM
 	fasta                *bool                                                             // flag to treat input as fasta sequences
 	noAlign              *bool                                                             // flag to prevent exact alignments
+	maxMismatches        *int                                                              // the number of mismatches allowed when aligning reads to the graphs
+	extendedCigar        *bool                                                             // flag to use =/X CIGAR operations instead of M
+	gapped               *bool                                                             // flag to use gapped alignment for reads that the DFS can't align
+	bandwidth            *int                                                              // the band used for gapped alignment
+	minScore             *float64                                                          // the minimum gapped alignment score, as a proportion of the read length
+	minAligned           *int                                                              // the minimum number of aligned bases for a soft clipped alignment
 	containmentThreshold *float64                                                          // the containment threshold for the LSH ensemble
 	minKmerCoverage      *float64                                                          // the minimum k-mer coverage per base of a segment
 	graphDir             *string                                                           // directory to save gfa graphs to
+	haplotype            *bool                                                             // flag to call alleles from the weighted graphs in the same run
+	paired               *bool                                                             // flag to treat the input FASTQ files as R1/R2 pairs
+	interleaved          *bool                                                             // flag to treat the input FASTQ as interleaved read pairs
+	concordance          *string                                                           // how pair concordance is used to adjust graph hits
+	sampleSheet          *string                                                           // TSV of sample IDs and FASTQ files to align in a single run
+	qualTrim             *int                                                              // the minimum base quality used for quality trimming
+	minLength            *float64                                                          // the minimum read length after trimming, as a proportion of the window size
+	maxNfrac             *float64                                                          // the maximum proportion of N bases allowed in a read
+	adapterFile          *string                                                           // FASTA file of adapter sequences to trim
+	longReads            *bool                                                             // flag to tile long reads into window sized segments for mapping
+	bloomFilter          *bool                                                             // flag to exclude k-mers seen only once in the sample from read sketches
+	readReport           *string                                                           // file to write the classification of each read to
+	gafFile              *string                                                           // file to write the graph alignments to in GAF format
+	readReportFormat     *string                                                           // the format of the per-read report (tsv or jsonl)
+	samples              []sample                                                          // the samples collected from the sample sheet
 	defaultGraphDir      = "./groot-graphs-" + string(time.Now().Format("20060102150405")) // a default graphDir
 )
 
@@ -41,15 +67,43 @@ var alignCmd = &cobra.Command{
 
 // init the command line arguments
 func init() {
-	fastq = alignCmd.Flags().StringSliceP("fastq", "f", []string{}, "FASTQ file(s) to align")
+	fastq = alignCmd.Flags().StringSliceP("fastq", "f", []string{}, "FASTQ file(s) to align (unaligned BAM/SAM files can also be used)")
+	bamInput = alignCmd.Flags().Bool("bam", false, "if set, STDIN will be treated as unaligned BAM/SAM (BAM/SAM files are recognised by their extension)")
 	fasta = alignCmd.Flags().Bool("fasta", false, "if set, the input will be treated as fasta sequence(s) (experimental feature)")
 	noAlign = alignCmd.Flags().Bool("noAlign", false, "if set, no exact alignment will be performed - graphs will be weighted using approximate read mappings")
+	maxMismatches = alignCmd.Flags().Int("mismatches", 0, "number of mismatches allowed when aligning reads to the graphs (exact alignment is always tried first)")
+	extendedCigar = alignCmd.Flags().Bool("extendedCigar", false, "if set, alignments will use =/X CIGAR operations for matches/mismatches instead of M")
+	gapped = alignCmd.Flags().Bool("gapped", false, "if set, reads that can't be aligned by the graph DFS will be aligned with a banded Smith-Waterman that allows indels")
+	bandwidth = alignCmd.Flags().Int("bandwidth", graph.DefaultBandwidth, "band used for gapped alignment (limits the number of indel bases in an alignment)")
+	minScore = alignCmd.Flags().Float64("minScore", 0.8, "minimum score for a gapped alignment, as a proportion of the score for an exact match of the whole read")
+	minAligned = alignCmd.Flags().Int("minAligned", 0, "minimum number of aligned read bases for a soft clipped alignment, set this to soft clip reads overhanging a gene or only partially matching a path (e.g. 50, 0 turns off soft clipping)")
 	containmentThreshold = alignCmd.Flags().Float64P("contThresh", "t", 0.99, "containment threshold for the LSH ensemble")
 	minKmerCoverage = alignCmd.Flags().Float64P("minKmerCov", "c", 1.0, "minimum number of k-mers covering each base of a graph segment")
 	graphDir = alignCmd.PersistentFlags().StringP("graphDir", "g", defaultGraphDir, "directory to save variation graphs to")
+	haplotype = alignCmd.Flags().Bool("haplotype", false, "if set, alleles will be called from the weighted graphs using EM and written to the graphDir")
+	paired = alignCmd.Flags().Bool("paired", false, "if set, the FASTQ files will be treated as R1/R2 pairs (e.g. -f sample_R1.fq,sample_R2.fq)")
+	interleaved = alignCmd.Flags().Bool("interleaved", false, "if set, the FASTQ input will be treated as interleaved read pairs")
+	concordance = alignCmd.Flags().String("concordance", "none", "how to use pair concordance (both reads hitting the same graph) - none, boost (double the weighting of concordant hits) or filter (drop hits from only one read of a pair)")
+	qualTrim = alignCmd.Flags().IntP("qualTrim", "q", 0, "minimum base quality used to trim the ends of reads (e.g. 20, 0 turns off quality trimming)")
+	minLength = alignCmd.Flags().Float64("minLength", 0.0, "minimum read length after trimming, as a proportion of the window size used in indexing (reads shorter than the k-mer size are always removed)")
+	maxNfrac = alignCmd.Flags().Float64("maxN", 0, "maximum proportion of N bases allowed in a read (e.g. 0.1, 0 turns off the check)")
+	adapterFile = alignCmd.Flags().String("adapters", "", "FASTA file of adapter sequences to trim from the 3' end of reads")
+	longReads = alignCmd.Flags().Bool("longReads", false, "if set, reads longer than the window size used in indexing are split into overlapping window sized segments for mapping (for Nanopore/PacBio reads)")
+	bloomFilter = alignCmd.Flags().Bool("bloomFilter", false, "if set, k-mers seen only once in the sample (likely sequencing errors) are excluded from the read sketches - the input is read twice, so it can't be used with STDIN")
+	gafFile = alignCmd.Flags().String("gaf", "", "file to write the alignments to in GAF format (read to graph traversal, with node IDs matching the GFA files) - in batch mode, this file name is prefixed with the sample ID and written to each sample's sub-directory")
+	readReport = alignCmd.Flags().String("readReport", "", "file to write the classification of each read to (LSH Ensemble hits, best containment, exact alignment and assigned references) - in batch mode, this file name is prefixed with the sample ID and written to each sample's sub-directory")
+	readReportFormat = alignCmd.Flags().String("readReportFormat", "tsv", "format of the per-read report (tsv or jsonl)")
+	sampleSheet = alignCmd.Flags().String("samples", "", "TSV of sample IDs and their FASTQ file(s) - each sample is aligned to the same loaded index and written to its own sub-directory of the graphDir")
+	addEMflags(alignCmd.Flags())
 	RootCmd.AddCommand(alignCmd)
 }
 
+// sample is a sample ID and its FASTQ file(s), as read from the sample sheet
+type sample struct {
+	id    string
+	fastq []string
+}
+
 // runAlign is the main function for the sketch sub-command
 func runSketch() {
 
@@ -90,21 +144,51 @@ func runSketch() {
 	if *fasta {
 		log.Print("\tinput file format: fasta")
 	}
+	if *bamInput {
+		log.Print("\tinput file format: unaligned BAM/SAM")
+	}
+	if *paired {
+		log.Printf("\tinput reads: paired-end R1/R2 files (concordance: %v)", *concordance)
+	}
+	if *interleaved {
+		log.Printf("\tinput reads: interleaved paired-end (concordance: %v)", *concordance)
+	}
+	if *longReads {
+		log.Print("\tinput reads: long reads (tiled into window sized segments)")
+	}
+	if *qualTrim != 0 {
+		log.Printf("\tquality trimming threshold: %d", *qualTrim)
+	}
+	if *maxNfrac != 0 {
+		log.Printf("\tmaximum N fraction: %.2f", *maxNfrac)
+	}
+	var adapters [][]byte
+	if *adapterFile != "" {
+		var err error
+		adapters, err = pipeline.LoadAdapters(*adapterFile)
+		misc.ErrorCheck(err)
+		log.Printf("\tadapter file: %v (%d adapters)", *adapterFile, len(adapters))
+	}
 	log.Print("loading the index information...")
 	info := new(pipeline.Info)
 	misc.ErrorCheck(info.Load(*indexDir + "/groot.gg"))
-	if info.Version != version.GetVersion() {
-		misc.ErrorCheck(fmt.Errorf("the groot index was created with a different version of groot (you are currently using version %v)", version.GetVersion()))
-	}
+	log.Printf("\tindex created with groot version %v (index format v%d)\n", info.Version, info.FormatVersion())
 	log.Printf("\tk-mer size: %d\n", info.KmerSize)
 	log.Printf("\tsketch size: %d\n", info.SketchSize)
+	log.Printf("\tsketch algorithm: %v\n", info.SketchAlgorithm)
 	log.Printf("\twindow size used in indexing: %d\n", info.WindowSize)
+	if *minLength != 0 {
+		log.Printf("\tminimum read length after trimming: %d\n", int(*minLength*float64(info.WindowSize)))
+	}
 	log.Print("loading the graphs...")
 	log.Printf("\tnumber of variation graphs: %d\n", len(info.Store))
-	log.Print("rebuilding the LSH Ensemble...")
+	log.Print("loading the LSH Ensemble...")
 	index := &lshe.ContainmentIndex{}
 	misc.ErrorCheck(index.Load(*indexDir + "/groot.lshe"))
-	info.AttachDB(index)
+	if info.FormatVersion() < misc.IndexFormatVersion || index.FormatVersion() < misc.IndexFormatVersion {
+		log.Printf("\tthe index is in an older format, run \"groot index migrate -i %v\" to upgrade it to format v%d", *indexDir, misc.IndexFormatVersion)
+	}
+	misc.ErrorCheck(info.AttachDB(index))
 	if *profiling {
 		log.Printf("\tloaded lshe file -> current memory usage %v", misc.PrintMemUsage())
 		runtime.GC()
@@ -115,64 +199,326 @@ func runSketch() {
 	info.Profiling = *profiling
 	info.ContainmentThreshold = *containmentThreshold
 	info.Sketch = pipeline.AlignCmd{
-		Fasta:           *fasta,
-		MinKmerCoverage: *minKmerCoverage,
-		NoExactAlign:    *noAlign,
+		Fasta:            *fasta,
+		BloomFilter:      *bloomFilter,
+		MinKmerCoverage:  *minKmerCoverage,
+		GraphDir:         *graphDir,
+		NoExactAlign:     *noAlign,
+		Paired:           *paired || *interleaved,
+		Interleaved:      *interleaved,
+		Concordance:      *concordance,
+		QualTrim:         *qualTrim,
+		MinLength:        *minLength,
+		MaxNfrac:         *maxNfrac,
+		Adapters:         adapters,
+		LongReads:        *longReads,
+		ReadReport:       *readReport,
+		ReadReportFormat: *readReportFormat,
+		GAFout:           *gafFile,
+		Alignment: graph.AlignmentParams{
+			MaxMismatches: *maxMismatches,
+			ExtendedCigar: *extendedCigar,
+			Gapped:        *gapped,
+			Bandwidth:     *bandwidth,
+			MinScore:      *minScore,
+			MinAligned:    *minAligned,
+		},
+	}
+	info.Haplotype = pipeline.HaploCmd{
+		Cutoff:        emCutoff,
+		MinIterations: emMinIterations,
+		MaxIterations: emMaxIterations,
+		HaploDir:      *graphDir,
 	}
 	log.Printf("\tcontainment threshold: %.2f\n", info.ContainmentThreshold)
 	if *noAlign {
 		log.Printf("\tprevent exact alignments and using approximated mapping only\n")
+	} else if *maxMismatches != 0 {
+		log.Printf("\tmismatches allowed in alignments: %d\n", *maxMismatches)
+	}
+	if *minAligned != 0 && !*noAlign {
+		log.Printf("\tminimum aligned bases for soft clipped alignments: %d\n", *minAligned)
+	}
+	if *gapped && !*noAlign {
+		log.Printf("\tusing gapped alignment (bandwidth: %d, minimum score: %.2f)\n", *bandwidth, *minScore)
+	}
+	if *bloomFilter {
+		log.Printf("\texcluding k-mers seen only once in the sample from read sketches\n")
+	}
+	if *readReport != "" {
+		log.Printf("\twriting the per-read report (%v)\n", *readReportFormat)
+	}
+	if *gafFile != "" {
+		log.Printf("\twriting the alignments in GAF format\n")
+	}
+	if *haplotype {
+		log.Printf("\tcalling alleles after graph weighting (abundance cutoff: %.2f)\n", info.Haplotype.Cutoff)
+	}
+
+	// if there is no sample sheet, run the alignment pipeline once on the supplied input
+	if *sampleSheet == "" {
+		runAlignment(info, *fastq)
+		log.Printf("finished in %s", time.Since(start))
+		return
+	}
+
+	// otherwise, run the alignment pipeline for each sample using a copy of the runtime info (so that graph weights are isolated between samples)
+	log.Printf("running batch mode for %d samples...", len(samples))
+	for i, s := range samples {
+		log.Printf("sample %d of %d: %v", i+1, len(samples), s.id)
+		sampleDir := fmt.Sprintf("%v/%v", *graphDir, s.id)
+		misc.ErrorCheck(os.MkdirAll(sampleDir, 0700))
+		sampleInfo := info.Copy()
+		sampleInfo.Sketch.SampleID = s.id
+		sampleInfo.Sketch.GraphDir = sampleDir
+		sampleInfo.Haplotype.HaploDir = sampleDir
+		if !*noAlign {
+			sampleInfo.Sketch.BAMout = fmt.Sprintf("%v/%v.bam", sampleDir, s.id)
+		}
+		if *readReport != "" {
+			sampleInfo.Sketch.ReadReport = fmt.Sprintf("%v/%v.%v", sampleDir, s.id, filepath.Base(*readReport))
+		}
+		if *gafFile != "" {
+			sampleInfo.Sketch.GAFout = fmt.Sprintf("%v/%v.%v", sampleDir, s.id, filepath.Base(*gafFile))
+		}
+		readStats := runAlignment(sampleInfo, s.fastq)
+		misc.ErrorCheck(writeSampleStats(sampleInfo, readStats))
+	}
+	log.Printf("finished in %s", time.Since(start))
+}
+
+// runAlignment is a function to build and run the alignment pipeline for one set of input files, returning the read stats from the read mapper
+func runAlignment(info *pipeline.Info, inputFiles []string) [4]int {
+
+	info.Sketch.BAM = *bamInput || (len(inputFiles) != 0 && isBAMfile(inputFiles[0]))
+
+	// if requested, stream the reads through a k-mer counting pipeline first, so that k-mers seen only once can be excluded from the read sketches
+	if *bloomFilter {
+		log.Printf("counting the k-mers in the sample...")
+		countingPipeline := pipeline.NewPipeline()
+		kmerCounter, err := pipeline.NewKmerCounter(info, inputFiles)
+		misc.ErrorCheck(err)
+		kmerCounter.Connect(connectInput(countingPipeline, info, inputFiles))
+		countingPipeline.AddProcesses(kmerCounter)
+		countingPipeline.Run()
 	}
 
 	// create the pipeline
 	log.Printf("initialising alignment pipeline...")
 	alignmentPipeline := pipeline.NewPipeline()
 
-	// initialise processes
-	log.Printf("\tinitialising the processes")
-	dataStream := pipeline.NewDataStreamer(info)
-	fastqHandler := pipeline.NewFastqHandler(info)
-	fastqChecker := pipeline.NewFastqChecker(info)
+	// initialise and connect the processes
+	log.Printf("\tinitialising the processes and connecting data streams")
 	readMapper := pipeline.NewReadMapper(info)
-	graphPruner := pipeline.NewGraphPruner(info, false)
-
-	// connect the pipeline processes
-	log.Printf("\tconnecting data streams")
-	dataStream.Connect(*fastq)
-	fastqHandler.Connect(dataStream)
-	fastqChecker.Connect(fastqHandler)
-	readMapper.Connect(fastqChecker)
+	graphPruner := pipeline.NewGraphPruner(info, *haplotype)
+	readMapper.Connect(connectInput(alignmentPipeline, info, inputFiles))
 	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(readMapper, graphPruner)
+
+	// if requested, pass the weighted graphs straight on to the EM path finder
+	var haploParser *pipeline.HaplotypeParser
+	if *haplotype {
+		emPathFinder := pipeline.NewEMpathFinder(info)
+		haploParser = pipeline.NewHaplotypeParser(info)
+		emPathFinder.ConnectPruner(graphPruner)
+		haploParser.Connect(emPathFinder)
+		alignmentPipeline.AddProcesses(emPathFinder, haploParser)
+	}
 
-	// submit each process to the pipeline and run it
-	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner)
+	// run the pipeline (the weighted graphs are written to the graphDir by the graph pruner)
 	log.Printf("\tnumber of processes added to the alignment pipeline: %d\n", alignmentPipeline.GetNumProcesses())
 	alignmentPipeline.Run()
 
-	// once the sketching pipeline is finished, process the graph store and write the graphs to disk
-	if len(info.Store) != 0 {
-		log.Printf("saving graphs...\n")
-		stats := readMapper.CollectReadStats()
-		for graphID, g := range info.Store {
-			fileName := fmt.Sprintf("%v/groot-graph-%d.gfa", *graphDir, graphID)
-			_, err := g.SaveGraphAsGFA(fileName, stats[3])
-			misc.ErrorCheck(err)
+	// write the called alleles and the reduced graphs
+	if *haplotype {
+		log.Printf("writing haplotypes to \"%v\"...", info.Haplotype.HaploDir)
+		misc.ErrorCheck(writeHaplotypes(info, haploParser.CollectHaplotypes()))
+	}
+	return readMapper.CollectReadStats()
+}
+
+// connectInput is a function to add the processes that read and check the input to a pipeline, returning the FastqChecker for the next process to connect to
+// the BAM reader is used in place of the data streamer and FASTQ handler for BAM/SAM input
+func connectInput(p *pipeline.Pipeline, info *pipeline.Info, inputFiles []string) *pipeline.FastqChecker {
+	fastqChecker := pipeline.NewFastqChecker(info)
+	if info.Sketch.BAM {
+		bamReader := pipeline.NewBAMreader(info)
+		bamReader.Connect(inputFiles)
+		fastqChecker.ConnectBAM(bamReader)
+		p.AddProcesses(bamReader, fastqChecker)
+		return fastqChecker
+	}
+	dataStream := pipeline.NewDataStreamer(info)
+	fastqHandler := pipeline.NewFastqHandler(info)
+	dataStream.Connect(inputFiles)
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	p.AddProcesses(dataStream, fastqHandler, fastqChecker)
+	return fastqChecker
+}
+
+// writeSampleStats is a function to write the read stats for a sample to the sample's graph directory
+func writeSampleStats(info *pipeline.Info, readStats [4]int) error {
+	fh, err := os.Create(fmt.Sprintf("%v/%v.stats.tsv", info.Sketch.GraphDir, info.Sketch.SampleID))
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(fh, "sample\treads\tmapped\tmultimapped\tkmers\n"); err != nil {
+		fh.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(fh, "%v\t%d\t%d\t%d\t%d\n", info.Sketch.SampleID, readStats[0], readStats[1], readStats[2], readStats[3]); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// readSampleSheet is a function to collect the sample IDs and FASTQ files from a sample sheet
+// - each line is a sample ID followed by one or more FASTQ files, either as extra columns or as a comma separated list
+// - blank lines and lines starting with # are ignored
+func readSampleSheet(fileName string) ([]sample, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	sheet := []sample{}
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(fh)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d of sample sheet needs a sample ID and at least one FASTQ file", lineNum)
+		}
+		s := sample{id: strings.TrimSpace(fields[0])}
+		if s.id == "" || strings.ContainsAny(s.id, "/\\") {
+			return nil, fmt.Errorf("line %d of sample sheet has an invalid sample ID: %q", lineNum, s.id)
 		}
+		if _, ok := seen[s.id]; ok {
+			return nil, fmt.Errorf("duplicate sample ID in sample sheet: %v", s.id)
+		}
+		seen[s.id] = struct{}{}
+		for _, field := range fields[1:] {
+			for _, file := range strings.Split(field, ",") {
+				if file = strings.TrimSpace(file); file != "" {
+					s.fastq = append(s.fastq, file)
+				}
+			}
+		}
+		if len(s.fastq) == 0 {
+			return nil, fmt.Errorf("no FASTQ files listed for sample %v", s.id)
+		}
+		sheet = append(sheet, s)
 	}
-	log.Printf("finished in %s", time.Since(start))
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(sheet) == 0 {
+		return nil, fmt.Errorf("no samples found in sample sheet: %v", fileName)
+	}
+	return sheet, nil
 }
 
 // alignParamCheck is a function to check user supplied parameters
 func alignParamCheck() error {
 
-	// check the supplied FASTQ file(s)
-	if len(*fastq) == 0 {
+	// check the paired-end options
+	if *paired && *interleaved {
+		return fmt.Errorf("--paired and --interleaved can't be used together")
+	}
+	if (*paired || *interleaved) && *fasta {
+		return fmt.Errorf("paired-end input must be FASTQ")
+	}
+	if *bamInput && (len(*fastq) != 0 || *sampleSheet != "") {
+		return fmt.Errorf("--bam is only needed for STDIN, BAM/SAM files are recognised by their extension")
+	}
+	if *bloomFilter && len(*fastq) == 0 && *sampleSheet == "" {
+		return fmt.Errorf("--bloomFilter can't be used with STDIN, as the input is read twice")
+	}
+	if *longReads && (*paired || *interleaved) {
+		return fmt.Errorf("--longReads can't be used with paired-end input")
+	}
+	if *gafFile != "" && *noAlign {
+		return fmt.Errorf("--gaf can't be used with --noAlign")
+	}
+	if *gafFile != "" && *longReads {
+		return fmt.Errorf("--gaf can't be used with --longReads, long read alignments are only reported in the BAM")
+	}
+	switch *concordance {
+	case "none":
+	case "boost", "filter":
+		if !*paired && !*interleaved {
+			return fmt.Errorf("--concordance requires paired-end input (--paired or --interleaved)")
+		}
+	default:
+		return fmt.Errorf("unknown concordance option: %v (must be none, boost or filter)", *concordance)
+	}
+	if *readReportFormat != "tsv" && *readReportFormat != "jsonl" {
+		return fmt.Errorf("unknown per-read report format: %v (must be tsv or jsonl)", *readReportFormat)
+	}
+	if *paired && *sampleSheet == "" && (len(*fastq) == 0 || len(*fastq)%2 != 0) {
+		return fmt.Errorf("--paired requires the FASTQ files to be given as R1/R2 pairs (use --interleaved for STDIN or interleaved files)")
+	}
+
+	if *maxMismatches < 0 {
+		return fmt.Errorf("--mismatches must not be negative")
+	}
+	if *minAligned < 0 {
+		return fmt.Errorf("--minAligned must not be negative")
+	}
+	if *bandwidth < 1 {
+		return fmt.Errorf("--bandwidth must be at least 1")
+	}
+	if *minScore <= 0 || *minScore > 1 {
+		return fmt.Errorf("--minScore must be > 0 and <= 1 (it is a proportion of the exact match score)")
+	}
+
+	// check the QC options
+	if *qualTrim < 0 {
+		return fmt.Errorf("--qualTrim must not be negative")
+	}
+	if *minLength < 0 || *minLength > 1 {
+		return fmt.Errorf("--minLength must be between 0 and 1 (it is a proportion of the window size)")
+	}
+	if *maxNfrac < 0 || *maxNfrac > 1 {
+		return fmt.Errorf("--maxN must be between 0 and 1")
+	}
+	if *adapterFile != "" {
+		misc.ErrorCheck(misc.CheckFile(*adapterFile))
+	}
+
+	// check the supplied FASTQ file(s), either from the sample sheet or the command line
+	if *sampleSheet != "" {
+		if len(*fastq) != 0 {
+			return fmt.Errorf("--samples and --fastq can't be used together")
+		}
+		misc.ErrorCheck(misc.CheckFile(*sampleSheet))
+		var err error
+		if samples, err = readSampleSheet(*sampleSheet); err != nil {
+			return err
+		}
+		for _, s := range samples {
+			if *paired && len(s.fastq)%2 != 0 {
+				return fmt.Errorf("--paired requires the FASTQ files for sample %v to be given as R1/R2 pairs", s.id)
+			}
+			if err := checkInputFiles(s.fastq); err != nil {
+				return err
+			}
+		}
+		log.Printf("\tsample sheet: %v (%d samples)", *sampleSheet, len(samples))
+	} else if len(*fastq) == 0 {
 		misc.ErrorCheck(misc.CheckSTDIN())
 		log.Printf("\tinput file: using STDIN")
 	} else {
-		for _, fastqFile := range *fastq {
-			misc.ErrorCheck(misc.CheckFile(fastqFile))
-			misc.ErrorCheck(misc.CheckExt(fastqFile, []string{"fastq", "fq", "fasta", "fna", "fa"}))
+		if err := checkInputFiles(*fastq); err != nil {
+			return err
 		}
 	}
 
@@ -181,6 +527,11 @@ func alignParamCheck() error {
 	misc.ErrorCheck(misc.CheckFile(*indexDir + "/groot.gg"))
 	misc.ErrorCheck(misc.CheckFile(*indexDir + "/groot.lshe"))
 
+	// check the EM parameters
+	if *haplotype && emMinIterations > emMaxIterations {
+		return fmt.Errorf("minimum EM iterations (%d) must not exceed maximum EM iterations (%d)", emMinIterations, emMaxIterations)
+	}
+
 	// setup the graphDir
 	if _, err := os.Stat(*graphDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(*graphDir, 0700); err != nil {
@@ -195,3 +546,34 @@ func alignParamCheck() error {
 	runtime.GOMAXPROCS(*proc)
 	return nil
 }
+
+// checkInputFiles is a function to check that the input files exist and are all FASTQ/FASTA or all BAM/SAM
+func checkInputFiles(inputFiles []string) error {
+	bamCount := 0
+	for _, inputFile := range inputFiles {
+		misc.ErrorCheck(misc.CheckFile(inputFile))
+		misc.ErrorCheck(misc.CheckExt(inputFile, []string{"fastq", "fq", "fasta", "fna", "fa", "bam", "sam"}))
+		if isBAMfile(inputFile) {
+			bamCount++
+		}
+	}
+	if bamCount == 0 {
+		return nil
+	}
+	if bamCount != len(inputFiles) {
+		return fmt.Errorf("BAM/SAM and FASTQ/FASTA input files can't be mixed")
+	}
+	if *fasta {
+		return fmt.Errorf("--fasta can't be used with BAM/SAM input")
+	}
+	if *paired {
+		return fmt.Errorf("--paired can't be used with BAM/SAM input, use --interleaved for paired reads (the reads of a pair must be next to each other)")
+	}
+	return nil
+}
+
+// isBAMfile returns true if the file extension is for BAM or SAM (ignoring any compression extension)
+func isBAMfile(fileName string) bool {
+	fileName = misc.TrimCompressionExt(fileName)
+	return strings.HasSuffix(fileName, ".bam") || strings.HasSuffix(fileName, ".sam")
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"time"
+
+	"github.com/pkg/profile"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/will-rowe/groot/src/graph"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/pipeline"
+	"github.com/will-rowe/groot/src/version"
+)
+
+// the command line arguments
+var (
+	gfaDir          *string                                                              // directory containing the weighted graphs from groot align
+	haploDir        *string                                                              // directory to write the haplotypes to
+	emCutoff        float64                                                              // the abundance cutoff for keeping EM paths (shared with align --haplotype)
+	emMinIterations int                                                                  // the minimum number of EM iterations (shared with align --haplotype)
+	emMaxIterations int                                                                  // the maximum number of EM iterations (shared with align --haplotype)
+	gfaList         []string                                                             // the collected GFA files
+	defaultHaploDir = "./groot-haplotype-" + string(time.Now().Format("20060102150405")) // a default haploDir
+)
+
+// gfaFileRegex matches the weighted graphs written by groot align (and not the reduced graphs written by groot haplotype)
+var gfaFileRegex = regexp.MustCompile(`^groot-graph-\d+\.gfa$`)
+
+// haplotypeCmd is used by cobra
+var haplotypeCmd = &cobra.Command{
+	Use:   "haplotype",
+	Short: "Call alleles from the weighted variation graphs using Expectation Maximization",
+	Long: `Call alleles from the weighted variation graphs using Expectation Maximization.
+
+	This will read the weighted graphs written by groot align, find the most likely paths through them
+	and write the called alleles (graph ID, allele, abundance) as tab separated values, along with the reduced graphs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runHaplotype()
+	},
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		return misc.CheckRequiredFlags(cmd.Flags())
+	},
+}
+
+// init the command line arguments
+func init() {
+	gfaDir = haplotypeCmd.Flags().StringP("graphDir", "g", "", "directory containing the weighted variation graphs from groot align - required")
+	haploDir = haplotypeCmd.Flags().StringP("haploDir", "o", defaultHaploDir, "directory to write the haplotypes and reduced graphs to")
+	addEMflags(haplotypeCmd.Flags())
+	haplotypeCmd.MarkFlagRequired("graphDir")
+	RootCmd.AddCommand(haplotypeCmd)
+}
+
+// addEMflags adds the EM path finding options to a command
+func addEMflags(flags *pflag.FlagSet) {
+	flags.Float64Var(&emCutoff, "cutoff", 1.0, "abundance cutoff for keeping alleles after EM")
+	flags.IntVar(&emMinIterations, "minIterations", 50, "minimum number of EM iterations")
+	flags.IntVar(&emMaxIterations, "maxIterations", 10000, "maximum number of EM iterations")
+}
+
+// runHaplotype is the main function for the haplotype sub-command
+func runHaplotype() {
+
+	// set up profiling
+	if *profiling {
+		defer profile.Start(profile.MemProfile, profile.ProfilePath("./")).Stop()
+	}
+
+	// start logging
+	if *logFile != "" {
+		logFH := misc.StartLogging(*logFile)
+		defer logFH.Close()
+		log.SetOutput(logFH)
+	} else {
+		log.SetOutput(os.Stdout)
+	}
+
+	// start the haplotype sub command
+	start := time.Now()
+	log.Printf("i am groot (version %s)", version.GetVersion())
+	log.Printf("starting the haplotype subcommand")
+
+	// check the supplied files and then log some stuff
+	log.Printf("checking parameters...")
+	misc.ErrorCheck(haplotypeParamCheck())
+	log.Printf("\tprocessors: %d", *proc)
+	log.Printf("\tabundance cutoff: %.2f", emCutoff)
+	log.Printf("\tmin. EM iterations: %d", emMinIterations)
+	log.Printf("\tmax. EM iterations: %d", emMaxIterations)
+
+	// record the runtime information for the haplotype sub command
+	info := &pipeline.Info{
+		Version:   version.GetVersion(),
+		NumProc:   *proc,
+		Profiling: *profiling,
+		Store:     make(graph.Store),
+		Haplotype: pipeline.HaploCmd{
+			Cutoff:        emCutoff,
+			MinIterations: emMinIterations,
+			MaxIterations: emMaxIterations,
+			HaploDir:      *haploDir,
+		},
+	}
+
+	// create the pipeline
+	log.Printf("initialising haplotyping pipeline...")
+	haplotypingPipeline := pipeline.NewPipeline()
+
+	// initialise processes
+	log.Printf("\tinitialising the processes")
+	gfaReader := pipeline.NewGFAreader(info)
+	emPathFinder := pipeline.NewEMpathFinder(info)
+	haploParser := pipeline.NewHaplotypeParser(info)
+
+	// connect the pipeline processes
+	log.Printf("\tconnecting data streams")
+	gfaReader.Connect(gfaList)
+	emPathFinder.Connect(gfaReader)
+	haploParser.Connect(emPathFinder)
+
+	// submit each process to the pipeline and run it
+	haplotypingPipeline.AddProcesses(gfaReader, emPathFinder, haploParser)
+	log.Printf("\tnumber of processes added to the haplotyping pipeline: %d\n", haplotypingPipeline.GetNumProcesses())
+	log.Print("finding paths through the weighted graphs...")
+	haplotypingPipeline.Run()
+
+	// write the haplotypes and the reduced graphs
+	log.Printf("writing haplotypes to \"%v\"...", info.Haplotype.HaploDir)
+	misc.ErrorCheck(writeHaplotypes(info, haploParser.CollectHaplotypes()))
+	log.Printf("finished in %s", time.Since(start))
+}
+
+// haplotypeParamCheck is a function to check user supplied parameters
+func haplotypeParamCheck() error {
+
+	// check the graph directory and collect the weighted graphs
+	log.Printf("\tdirectory containing weighted graphs: %v", *gfaDir)
+	misc.ErrorCheck(misc.CheckDir(*gfaDir))
+	gfas, err := filepath.Glob(*gfaDir + "/groot-graph-*.gfa")
+	if err != nil {
+		return err
+	}
+	for _, gfa := range gfas {
+		if !gfaFileRegex.MatchString(filepath.Base(gfa)) {
+			continue
+		}
+		misc.ErrorCheck(misc.CheckFile(gfa))
+		gfaList = append(gfaList, gfa)
+	}
+	if len(gfaList) == 0 {
+		return fmt.Errorf("no weighted graphs found in the supplied directory (must be named groot-graph-DD.gfa)")
+	}
+	log.Printf("\tnumber of weighted graphs: %d", len(gfaList))
+
+	// check the EM parameters
+	if emMinIterations > emMaxIterations {
+		return fmt.Errorf("minimum EM iterations (%d) must not exceed maximum EM iterations (%d)", emMinIterations, emMaxIterations)
+	}
+
+	// setup the haploDir
+	if _, err := os.Stat(*haploDir); os.IsNotExist(err) {
+		if err := os.MkdirAll(*haploDir, 0700); err != nil {
+			return fmt.Errorf("can't create specified output directory")
+		}
+	}
+
+	// set number of processors to use
+	if *proc <= 0 || *proc > runtime.NumCPU() {
+		*proc = runtime.NumCPU()
+	}
+	runtime.GOMAXPROCS(*proc)
+	return nil
+}
+
+// writeHaplotypes is a function to write the called alleles as a TSV, plus the reduced graphs and their sequences, to the HaploDir
+func writeHaplotypes(info *pipeline.Info, haplotypes []pipeline.Haplotype) error {
+
+	// write the called alleles
+	fh, err := os.Create(fmt.Sprintf("%v/groot-haplotypes.tsv", info.Haplotype.HaploDir))
+	if err != nil {
+		return err
+	}
+	for _, haplotype := range haplotypes {
+		database := haplotype.Database
+		if database == "" {
+			database = "-"
+		}
+		if _, err := fmt.Fprintf(fh, "%d\t%v\t%.3f\t%v\n", haplotype.GraphID, haplotype.Allele, haplotype.Abundance, database); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+
+	// write the reduced graphs and the sequences of the called alleles
+	for graphID, g := range info.Store {
+		fileName := fmt.Sprintf("%v/groot-graph-%d-haplotype", info.Haplotype.HaploDir, graphID)
+		if _, err := g.SaveGraphAsGFA(fileName+".gfa", info.Haplotype.TotalKmers); err != nil {
+			return err
+		}
+		seqs, err := g.Graph2Seqs()
+		if err != nil {
+			return err
+		}
+		seqFH, err := os.Create(fileName + ".fna")
+		if err != nil {
+			return err
+		}
+		for pathID, seq := range seqs {
+			if _, err := fmt.Fprintf(seqFH, ">%v\n%v\n", string(g.Paths[pathID]), string(seq)); err != nil {
+				seqFH.Close()
+				return err
+			}
+		}
+		if err := seqFH.Close(); err != nil {
+			return err
+		}
+	}
+	log.Printf("\tnumber of alleles written: %d", len(haplotypes))
+	return nil
+}
@@ -10,6 +10,9 @@ import (
 
 	"github.com/pkg/profile"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/misc"
 	"github.com/will-rowe/groot/src/pipeline"
 	"github.com/will-rowe/groot/src/version"
@@ -23,7 +26,9 @@ var (
 	numPart       *int     // number of partitions in the LSH Ensemble
 	maxK          *int     // maxK in the LSH Ensemble
 	maxSketchSpan *int     // max distance between merged sketches
+	algorithm     *string  // the MinHash algorithm to sketch with
 	msaDir        *string  // directory containing the input MSA files
+	update        *bool    // update an existing index with new or changed MSA files
 	msaList       []string // the collected MSA files
 )
 
@@ -33,7 +38,7 @@ var indexCmd = &cobra.Command{
 	Short: "Convert a set of clustered reference sequences to variation graphs and then index them",
 	Long:  `Convert a set of clustered reference sequences to variation graphs and then index them`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runIndex()
+		runIndex(cmd.Flags())
 	},
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		return misc.CheckRequiredFlags(cmd.Flags())
@@ -48,13 +53,15 @@ func init() {
 	numPart = indexCmd.Flags().IntP("numPart", "x", 8, "number of partitions in the LSH Ensemble")
 	maxK = indexCmd.Flags().IntP("maxK", "y", 4, "maxK in the LSH Ensemble")
 	maxSketchSpan = indexCmd.Flags().Int("maxSketchSpan", 30, "max number of identical neighbouring sketches permitted in any graph traversal")
+	algorithm = indexCmd.Flags().StringP("algorithm", "a", "khf", "MinHash algorithm to sketch with (khf, kmv or oph) - the same algorithm is used to sketch reads during alignment")
 	msaDir = indexCmd.Flags().StringP("msaDir", "m", "", "directory containing the clustered references (MSA files) - required")
+	update = indexCmd.Flags().Bool("update", false, "add new clusters to an existing index, replace any that have changed and remove any whose MSA file has gone (the index parameters are taken from the existing index)")
 	indexCmd.MarkFlagRequired("msaDir")
 	RootCmd.AddCommand(indexCmd)
 }
 
 // runIndex is the main function for the index sub-command
-func runIndex() {
+func runIndex(flags *pflag.FlagSet) {
 
 	// check index flag is set (global flag but don't require it for all sub commands)
 	if *indexDir == "" {
@@ -86,23 +93,64 @@ func runIndex() {
 	log.Printf("checking parameters...")
 	misc.ErrorCheck(indexParamCheck())
 	log.Printf("\tprocessors: %d", *proc)
-	log.Printf("\tk-mer size: %d", *kmerSize)
-	log.Printf("\tsketch size: %d", *sketchSize)
-	log.Printf("\tgraph window size: %d", *windowSize)
-	log.Printf("\tnum. partitions: %d", *numPart)
-	log.Printf("\tmax. K: %d", *maxK)
-	log.Printf("\tmax. sketch span: %d", *maxSketchSpan)
-
-	// record the runtime information for the index sub command
-	info := &pipeline.Info{
-		Version:       version.GetVersion(),
-		KmerSize:      *kmerSize,
-		SketchSize:    *sketchSize,
-		WindowSize:    *windowSize,
-		NumPart:       *numPart,
-		MaxK:          *maxK,
-		MaxSketchSpan: *maxSketchSpan,
-		IndexDir:      *indexDir,
+
+	// record the runtime information for the index sub command, if updating then load the existing index and use its parameters
+	info := &pipeline.Info{}
+	if *update {
+		log.Printf("loading the existing index...")
+		misc.ErrorCheck(info.Load(*indexDir + "/groot.gg"))
+		index := &lshe.ContainmentIndex{}
+		misc.ErrorCheck(index.Load(*indexDir + "/groot.lshe"))
+		misc.ErrorCheck(info.AttachDB(index))
+		misc.ErrorCheck(updateParamCheck(flags, info))
+		log.Printf("\tindex created with groot version %v (index format v%d)", info.Version, info.FormatVersion())
+		log.Printf("\tnumber of graphs in the index: %d", len(info.Store))
+		info.Version = version.GetVersion()
+		info.IndexDir = *indexDir
+	} else {
+		sketchAlgorithm, err := minhash.ParseAlgorithm(*algorithm)
+		misc.ErrorCheck(err)
+		info = &pipeline.Info{
+			Version:         version.GetVersion(),
+			KmerSize:        *kmerSize,
+			SketchSize:      *sketchSize,
+			WindowSize:      *windowSize,
+			NumPart:         *numPart,
+			MaxK:            *maxK,
+			MaxSketchSpan:   *maxSketchSpan,
+			SketchAlgorithm: sketchAlgorithm,
+			IndexDir:        *indexDir,
+		}
+	}
+	log.Printf("\tk-mer size: %d", info.KmerSize)
+	log.Printf("\tsketch size: %d", info.SketchSize)
+	log.Printf("\tsketch algorithm: %v", info.SketchAlgorithm)
+	log.Printf("\tgraph window size: %d", info.WindowSize)
+	log.Printf("\tnum. partitions: %d", info.NumPart)
+	log.Printf("\tmax. K: %d", info.MaxK)
+	log.Printf("\tmax. sketch span: %d", info.MaxSketchSpan)
+
+	// work out which MSA files need converting to graphs (all of them, unless an existing index is being updated)
+	msaToBuild, err := info.AssignGraphIDs(msaList)
+	misc.ErrorCheck(err)
+	if *update {
+		log.Printf("\tnew or changed MSA files: %d", len(msaToBuild))
+		removed := info.RemoveMissingClusters(msaList)
+		for _, name := range removed {
+			log.Printf("\tremoving cluster with no MSA file: %v", name)
+		}
+		if len(msaToBuild) == 0 && len(removed) == 0 {
+			log.Printf("the index is already up to date")
+			log.Printf("finished in %s", time.Since(start))
+			return
+		}
+		if len(msaToBuild) == 0 {
+			log.Printf("writing index files in \"%v\"...", *indexDir)
+			misc.ErrorCheck(info.SaveDB(*indexDir + "/groot.lshe"))
+			misc.ErrorCheck(info.Dump(*indexDir + "/groot.gg"))
+			log.Printf("finished in %s", time.Since(start))
+			return
+		}
 	}
 
 	// create the pipeline
@@ -117,7 +165,7 @@ func runIndex() {
 
 	// connect the pipeline processes
 	log.Printf("\tconnecting data streams")
-	msaConverter.Connect(msaList)
+	msaConverter.Connect(msaToBuild)
 	graphSketcher.Connect(msaConverter)
 	sketchIndexer.Connect(graphSketcher)
 
@@ -132,6 +180,31 @@ func runIndex() {
 	log.Printf("finished in %s", time.Since(start))
 }
 
+// updateParamCheck is a function to check that any index parameters set on the command line match the existing index, as they can't be changed by an update
+func updateParamCheck(flags *pflag.FlagSet, info *pipeline.Info) error {
+	existing := []struct {
+		flag  string
+		value interface{}
+	}{
+		{"kmerSize", info.KmerSize},
+		{"sketchSize", info.SketchSize},
+		{"windowSize", info.WindowSize},
+		{"numPart", info.NumPart},
+		{"maxK", info.MaxK},
+		{"maxSketchSpan", info.MaxSketchSpan},
+		{"algorithm", info.SketchAlgorithm},
+	}
+	for _, param := range existing {
+		if !flags.Changed(param.flag) {
+			continue
+		}
+		if supplied := flags.Lookup(param.flag).Value.String(); supplied != fmt.Sprint(param.value) {
+			return fmt.Errorf("--%v is %v but the existing index was built with %v, the index parameters can't be changed by --update (re-index instead)", param.flag, supplied, param.value)
+		}
+	}
+	return nil
+}
+
 // indexParamCheck is a function to check user supplied parameters
 func indexParamCheck() error {
 
@@ -158,9 +231,17 @@ func indexParamCheck() error {
 	log.Printf("\tnumber of MSA files: %d", len(msas))
 
 	// TODO: check the supplied arguments to make sure they don't conflict with each other eg:
-	if *kmerSize > *windowSize {
+	if *update {
+		log.Printf("\tupdating the existing index in: %v", *indexDir)
+		if err := misc.CheckDir(*indexDir); err != nil {
+			return err
+		}
+	} else if *kmerSize > *windowSize {
 		return fmt.Errorf("supplied k-mer size greater than read length")
 	}
+	if _, err := minhash.ParseAlgorithm(*algorithm); err != nil {
+		return err
+	}
 	// setup the indexDir
 	if _, err := os.Stat(*indexDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(*indexDir, 0700); err != nil {
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/pipeline"
+	"github.com/will-rowe/groot/src/version"
+)
+
+// the command line arguments
+var (
+	inspectGraphs  *[]uint   // graph IDs to report
+	inspectRefs    *[]string // reference names to report
+	inspectWindows *bool     // report the windows as well as the graphs
+	inspectFormat  *string   // the output format (tsv or json)
+)
+
+// the inspect command (used by cobra)
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Describe the graphs and windows held in an index",
+	Long: `Describe the graphs and windows held in an index
+
+The index parameters, graph stats (nodes, reference sequences, windows, distinct sketches and max merge span) and, optionally, the windows are written to STDOUT as TSV or JSON.
+The report can be limited to certain graphs (--graph) or to the graphs and windows for certain reference sequences (--ref, matching any part of the reference name).`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runInspect()
+	},
+}
+
+// a function to initialise the command line arguments
+func init() {
+	inspectGraphs = inspectCmd.Flags().UintSlice("graph", []uint{}, "only report these graph IDs")
+	inspectRefs = inspectCmd.Flags().StringSlice("ref", []string{}, "only report the graphs and windows for reference sequences with names containing these")
+	inspectWindows = inspectCmd.Flags().Bool("windows", false, "also report the windows (start node, offset, merge span, references and contained nodes)")
+	inspectFormat = inspectCmd.Flags().String("format", "tsv", "output format (tsv or json)")
+	RootCmd.AddCommand(inspectCmd)
+}
+
+// runInspect is the main function for the inspect sub-command
+func runInspect() {
+
+	// check index flag is set (global flag but don't require it for all sub commands)
+	if *indexDir == "" {
+		fmt.Println("please specify the directory containing the index files (--indexDir)")
+		os.Exit(1)
+	}
+	if *inspectFormat != "tsv" && *inspectFormat != "json" {
+		fmt.Println("output format must be tsv or json (--format)")
+		os.Exit(1)
+	}
+
+	// start logging
+	if *logFile != "" {
+		logFH := misc.StartLogging(*logFile)
+		defer logFH.Close()
+		log.SetOutput(logFH)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	log.Printf("i am groot (version %s)", version.GetVersion())
+	log.Printf("starting the inspect subcommand")
+
+	// load the index
+	log.Printf("loading the index from \"%v\"...", *indexDir)
+	misc.ErrorCheck(misc.CheckDir(*indexDir))
+	info := new(pipeline.Info)
+	misc.ErrorCheck(info.Load(*indexDir + "/groot.gg"))
+	index := &lshe.ContainmentIndex{}
+	misc.ErrorCheck(index.Load(*indexDir + "/groot.lshe"))
+	misc.ErrorCheck(info.AttachDB(index))
+
+	// describe it
+	graphIDs := make([]uint32, len(*inspectGraphs))
+	for i, graphID := range *inspectGraphs {
+		graphIDs[i] = uint32(graphID)
+	}
+	report, err := info.Inspect(graphIDs, *inspectRefs, *inspectWindows)
+	misc.ErrorCheck(err)
+	log.Printf("\tgraphs reported: %d", len(report.Graphs))
+	log.Printf("\twindows reported: %d", len(report.Windows))
+	if *inspectFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		misc.ErrorCheck(encoder.Encode(report))
+	} else {
+		misc.ErrorCheck(writeInspectTSV(os.Stdout, report))
+	}
+	log.Printf("finished")
+}
+
+// writeInspectTSV is a function to write an index report as TSV, with a table each for the parameters, graphs, reference sequences and windows
+func writeInspectTSV(w io.Writer, report *pipeline.IndexReport) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#parameter\tvalue\n")
+	fmt.Fprintf(b, "version\t%v\nformatVersion\t%d\n", report.Version, report.FormatVersion)
+	fmt.Fprintf(b, "kmerSize\t%d\nsketchSize\t%d\nsketchAlgorithm\t%v\nwindowSize\t%d\n", report.Params.KmerSize, report.Params.SketchSize, report.Params.SketchAlgorithm, report.Params.WindowSize)
+	fmt.Fprintf(b, "numPart\t%d\nmaxK\t%d\nmaxSketchSpan\t%d\n", report.Params.NumPart, report.Params.MaxK, report.Params.MaxSketchSpan)
+	fmt.Fprintf(b, "numGraphs\t%d\nnumWindows\t%d\n", report.NumGraphs, report.NumWindows)
+
+	fmt.Fprintf(b, "\n#graphID\tdatabase\tnodes\tmasked\twindows\tdistinctSketches\tmaxSpan\treferences\n")
+	for _, g := range report.Graphs {
+		database := g.Database
+		if database == "" {
+			database = "-"
+		}
+		fmt.Fprintf(b, "%d\t%v\t%d\t%v\t%d\t%d\t%d\t%d\n", g.GraphID, database, g.NumNodes, g.Masked, g.NumWindows, g.DistinctSketches, g.MaxSpan, len(g.Paths))
+	}
+
+	fmt.Fprintf(b, "\n#graphID\tpathID\treference\tlength\n")
+	for _, g := range report.Graphs {
+		for _, path := range g.Paths {
+			fmt.Fprintf(b, "%d\t%d\t%v\t%d\n", g.GraphID, path.PathID, path.Name, path.Length)
+		}
+	}
+
+	if len(report.Windows) != 0 {
+		fmt.Fprintf(b, "\n#window\tgraphID\tnode\toffset\tmergeSpan\treferences\tcontainedNodes\n")
+		for _, window := range report.Windows {
+			nodes := make([]uint64, 0, len(window.ContainedNodes))
+			for node := range window.ContainedNodes {
+				nodes = append(nodes, node)
+			}
+			sort.Slice(nodes, func(a, b int) bool { return nodes[a] < nodes[b] })
+			containedNodes := make([]string, len(nodes))
+			for i, node := range nodes {
+				containedNodes[i] = fmt.Sprintf("%d:%v", node, window.ContainedNodes[node])
+			}
+			fmt.Fprintf(b, "%v\t%d\t%d\t%d\t%d\t%v\t%v\n", window.Lookup, window.GraphID, window.Node, window.OffSet, window.MergeSpan, strings.Join(window.Refs, ","), strings.Join(containedNodes, ","))
+		}
+	}
+	return b.Flush()
+}
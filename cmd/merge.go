@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/pipeline"
+	"github.com/will-rowe/groot/src/version"
+)
+
+// the command line arguments
+var (
+	databases *[]string // names for the databases held in the indexes being merged
+)
+
+// the merge command (used by cobra)
+var mergeCmd = &cobra.Command{
+	Use:   "merge [flags] index1 index2 ...",
+	Short: "Merge several indexes into one",
+	Long: `Merge several indexes into one
+
+The indexes must have been built with the same k-mer size, sketch size, window size and sketch algorithm.
+Each graph is tagged with the database it came from, which is reported with the called alleles.
+The merged index is written to the directory given by --indexDir.`,
+	Args: cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runMerge(args)
+	},
+}
+
+// a function to initialise the command line arguments
+func init() {
+	databases = mergeCmd.Flags().StringSlice("databases", []string{}, "names for the databases held in the indexes, in the same order as the indexes (default: the index directory names)")
+	indexCmd.AddCommand(mergeCmd)
+}
+
+// runMerge is the main function for the index merge sub-command
+func runMerge(indexDirs []string) {
+
+	// check index flag is set (global flag but don't require it for all sub commands)
+	if *indexDir == "" {
+		fmt.Println("please specify a directory for the merged index files (--indexDir)")
+		os.Exit(1)
+	}
+
+	// start logging
+	if *logFile != "" {
+		logFH := misc.StartLogging(*logFile)
+		defer logFH.Close()
+		log.SetOutput(logFH)
+	} else {
+		log.SetOutput(os.Stdout)
+	}
+
+	// start the merge sub command
+	start := time.Now()
+	log.Printf("i am groot (version %s)", version.GetVersion())
+	log.Printf("starting the index merge subcommand")
+
+	// check the supplied indexes and name the databases
+	log.Printf("checking parameters...")
+	if len(*databases) == 0 {
+		for _, dir := range indexDirs {
+			*databases = append(*databases, filepath.Base(filepath.Clean(dir)))
+		}
+	}
+	if len(*databases) != len(indexDirs) {
+		misc.ErrorCheck(fmt.Errorf("%d database names supplied for %d indexes", len(*databases), len(indexDirs)))
+	}
+	if _, err := os.Stat(*indexDir); os.IsNotExist(err) {
+		misc.ErrorCheck(os.MkdirAll(*indexDir, 0700))
+	}
+
+	// load each index
+	log.Printf("loading the indexes...")
+	indexes := make([]*pipeline.Info, len(indexDirs))
+	for i, dir := range indexDirs {
+		misc.ErrorCheck(misc.CheckDir(dir))
+		info := new(pipeline.Info)
+		misc.ErrorCheck(info.Load(dir + "/groot.gg"))
+		index := &lshe.ContainmentIndex{}
+		misc.ErrorCheck(index.Load(dir + "/groot.lshe"))
+		misc.ErrorCheck(info.AttachDB(index))
+		log.Printf("\t%v (database: %v): %d graphs, %d windows (k-mer size: %d, sketch size: %d, window size: %d, sketch algorithm: %v)", dir, (*databases)[i], len(info.Store), len(index.WindowLookup), info.KmerSize, info.SketchSize, info.WindowSize, info.SketchAlgorithm)
+		indexes[i] = info
+	}
+
+	// merge them
+	log.Printf("merging the indexes...")
+	merged, err := pipeline.MergeIndexes(indexes, *databases)
+	misc.ErrorCheck(err)
+	merged.IndexDir = *indexDir
+	log.Printf("\tnumber of graphs in the merged index: %d", len(merged.Store))
+	log.Printf("writing index files in \"%v\"...", *indexDir)
+	misc.ErrorCheck(merged.SaveDB(*indexDir + "/groot.lshe"))
+	misc.ErrorCheck(merged.Dump(*indexDir + "/groot.gg"))
+	log.Printf("finished in %s", time.Since(start))
+}
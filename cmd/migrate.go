@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/pipeline"
+	"github.com/will-rowe/groot/src/version"
+)
+
+// the migrate command (used by cobra)
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade an existing index to the current index file format",
+	Long: `Upgrade an existing index to the current index file format
+
+The index files are rewritten in place, so the index doesn't need rebuilding from the MSA files.
+Indexes are compatible with any version of GROOT that reads the same index file format.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigrate()
+	},
+}
+
+// a function to initialise the command
+func init() {
+	indexCmd.AddCommand(migrateCmd)
+}
+
+// runMigrate is the main function for the index migrate sub-command
+func runMigrate() {
+
+	// check index flag is set (global flag but don't require it for all sub commands)
+	if *indexDir == "" {
+		fmt.Println("please specify the directory containing the index files (--indexDir)")
+		os.Exit(1)
+	}
+
+	// start logging
+	if *logFile != "" {
+		logFH := misc.StartLogging(*logFile)
+		defer logFH.Close()
+		log.SetOutput(logFH)
+	} else {
+		log.SetOutput(os.Stdout)
+	}
+
+	// start the migrate sub command
+	start := time.Now()
+	log.Printf("i am groot (version %s)", version.GetVersion())
+	log.Printf("starting the index migrate subcommand")
+
+	// load the index files, older formats are converted as they are read
+	log.Printf("loading the index from \"%v\"...", *indexDir)
+	misc.ErrorCheck(misc.CheckDir(*indexDir))
+	info := new(pipeline.Info)
+	misc.ErrorCheck(info.Load(*indexDir + "/groot.gg"))
+	log.Printf("\tgraph store: index format v%d (created with groot version %v)", info.FormatVersion(), info.Version)
+	index := &lshe.ContainmentIndex{}
+	misc.ErrorCheck(index.Load(*indexDir + "/groot.lshe"))
+	log.Printf("\tLSH Ensemble: index format v%d", index.FormatVersion())
+	misc.ErrorCheck(info.AttachDB(index))
+	if info.FormatVersion() == misc.IndexFormatVersion && index.FormatVersion() == misc.IndexFormatVersion {
+		log.Printf("the index is already in the current format (v%d), nothing to do", misc.IndexFormatVersion)
+		return
+	}
+
+	// write the index files back in the current format
+	log.Printf("rewriting the index files in format v%d...", misc.IndexFormatVersion)
+	misc.ErrorCheck(info.SaveDB(*indexDir + "/groot.lshe"))
+	misc.ErrorCheck(info.Dump(*indexDir + "/groot.gg"))
+	log.Printf("finished in %s", time.Since(start))
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/pipeline"
+	"github.com/will-rowe/groot/src/seqio"
+	"github.com/will-rowe/groot/src/version"
+)
+
+// the command line arguments
+var (
+	querySeq       *string  // a sequence to query the index with
+	queryFasta     *string  // FASTA file of sequences to query the index with
+	queryThreshold *float64 // the containment threshold for the LSH ensemble
+	queryAlign     *bool    // flag to align the sequence to the graphs it hits
+	queryMismatch  *int     // the number of mismatches allowed when aligning the sequence
+)
+
+// the query command (used by cobra)
+var queryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Look up a sequence in an index and rank the graph windows it hits",
+	Long: `Look up a sequence in an index and rank the graph windows it hits
+
+The sequence is sketched using the index parameters and queried against the LSH Ensemble, sequences longer than the window size are split into window sized segments.
+Each hit (graph, database, window position, strand, estimated containment and the reference sequences that contain the window) is written to STDOUT as TSV, sorted by containment.
+If --align is set, each hit is also aligned to its graph and the alignments are reported as reference:position:CIGAR.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runQuery()
+	},
+}
+
+// a function to initialise the command line arguments
+func init() {
+	querySeq = queryCmd.Flags().String("seq", "", "sequence to query the index with")
+	queryFasta = queryCmd.Flags().String("fasta", "", "FASTA file of sequences to query the index with")
+	queryThreshold = queryCmd.Flags().Float64P("contThresh", "t", 0.99, "containment threshold for the LSH ensemble")
+	queryAlign = queryCmd.Flags().Bool("align", false, "if set, each hit will be aligned to its graph and the CIGAR and position reported")
+	queryMismatch = queryCmd.Flags().Int("mismatches", 0, "number of mismatches allowed when aligning (exact alignment is always tried first)")
+	RootCmd.AddCommand(queryCmd)
+}
+
+// runQuery is the main function for the query sub-command
+func runQuery() {
+
+	// check the flags (index is a global flag but don't require it for all sub commands)
+	if *indexDir == "" {
+		fmt.Println("please specify the directory containing the index files (--indexDir)")
+		os.Exit(1)
+	}
+	if (*querySeq == "") == (*queryFasta == "") {
+		fmt.Println("please specify either a sequence (--seq) or a FASTA file (--fasta) to query the index with")
+		os.Exit(1)
+	}
+	if *queryMismatch < 0 {
+		fmt.Println("number of mismatches must not be negative (--mismatches)")
+		os.Exit(1)
+	}
+	if *queryThreshold <= 0.0 || *queryThreshold > 1.0 {
+		fmt.Println("containment threshold must be > 0.0 and <= 1.0 (--contThresh)")
+		os.Exit(1)
+	}
+
+	// start logging
+	if *logFile != "" {
+		logFH := misc.StartLogging(*logFile)
+		defer logFH.Close()
+		log.SetOutput(logFH)
+	} else {
+		log.SetOutput(os.Stderr)
+	}
+	log.Printf("i am groot (version %s)", version.GetVersion())
+	log.Printf("starting the query subcommand")
+
+	// get the query sequences
+	var queries []*seqio.FASTQread
+	if *queryFasta != "" {
+		misc.ErrorCheck(misc.CheckFile(*queryFasta))
+		var err error
+		queries, err = pipeline.LoadQueries(*queryFasta)
+		misc.ErrorCheck(err)
+	} else {
+		query, err := seqio.NewFASTQread([]byte("@query"), []byte(*querySeq), nil, nil)
+		misc.ErrorCheck(err)
+		queries = append(queries, query)
+	}
+	for _, query := range queries {
+		misc.ErrorCheck(query.BaseCheck())
+	}
+	log.Printf("\tquery sequences: %d", len(queries))
+
+	// load the index
+	log.Printf("loading the index from \"%v\"...", *indexDir)
+	misc.ErrorCheck(misc.CheckDir(*indexDir))
+	info := new(pipeline.Info)
+	misc.ErrorCheck(info.Load(*indexDir + "/groot.gg"))
+	index := &lshe.ContainmentIndex{}
+	misc.ErrorCheck(index.Load(*indexDir + "/groot.lshe"))
+	misc.ErrorCheck(info.AttachDB(index))
+	info.ContainmentThreshold = *queryThreshold
+	info.Sketch.Alignment.MaxMismatches = *queryMismatch
+	log.Printf("\tk-mer size: %d, sketch size: %d, window size: %d", info.KmerSize, info.SketchSize, info.WindowSize)
+	log.Printf("\tcontainment threshold: %.2f", info.ContainmentThreshold)
+
+	// run the queries
+	hits := []pipeline.QueryHit{}
+	for _, query := range queries {
+		queryHits, err := info.QuerySequence(query, *queryAlign)
+		misc.ErrorCheck(err)
+		log.Printf("\t%v: %d hits", query.Name(), len(queryHits))
+		hits = append(hits, queryHits...)
+	}
+	misc.ErrorCheck(writeQueryTSV(os.Stdout, hits, *queryAlign))
+	log.Printf("finished")
+}
+
+// writeQueryTSV is a function to write the query hits as TSV, with the alignments in the final column if they were requested
+func writeQueryTSV(w io.Writer, hits []pipeline.QueryHit, align bool) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#query\tqueryStart\tqueryEnd\tgraphID\tdatabase\tnode\toffset\tstrand\tcontainment\treferences")
+	if align {
+		fmt.Fprintf(b, "\talignments")
+	}
+	fmt.Fprintf(b, "\n")
+	for _, hit := range hits {
+		database, strand := hit.Database, "+"
+		if database == "" {
+			database = "-"
+		}
+		if hit.RC {
+			strand = "-"
+		}
+		fmt.Fprintf(b, "%v\t%d\t%d\t%d\t%v\t%d\t%d\t%v\t%.4f\t%v", hit.Query, hit.QueryStart, hit.QueryEnd, hit.GraphID, database, hit.Node, hit.OffSet, strand, hit.Containment, strings.Join(hit.Refs, ","))
+		if align {
+			alignments := make([]string, len(hit.Alignments))
+			for i, record := range hit.Alignments {
+				alignments[i] = fmt.Sprintf("%v:%d:%v", record.Ref.Name(), record.Pos+1, record.Cigar)
+			}
+			if len(alignments) == 0 {
+				alignments = append(alignments, "*")
+			}
+			fmt.Fprintf(b, "\t%v", strings.Join(alignments, ";"))
+		}
+		fmt.Fprintf(b, "\n")
+	}
+	return b.Flush()
+}
@@ -8,10 +8,12 @@ require (
 	github.com/biogo/hts v1.1.0
 	github.com/dgryski/go-minhash v0.0.0-20190315135803-ad340ca03076 // indirect
 	github.com/ekzhu/lshensemble v1.1.0
+	github.com/klauspost/compress v1.11.0
 	github.com/orcaman/concurrent-map v0.0.0-20190826125027-8c72a8bb44f6 // indirect
 	github.com/pkg/profile v1.4.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/pflag v1.0.5
+	github.com/ulikunitz/xz v0.5.12
 	github.com/will-rowe/gfa v0.0.0-20190502084819-05c93955478b
 	github.com/will-rowe/nthash v0.2.0
 )
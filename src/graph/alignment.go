@@ -2,6 +2,9 @@ package graph
 
 import (
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/biogo/hts/sam"
@@ -9,11 +12,50 @@ import (
 	"github.com/will-rowe/groot/src/seqio"
 )
 
-// AlignRead is a method to run a read to graph hierarchical alignment
-func (GrootGraph *GrootGraph) AlignRead(read *seqio.FASTQread, mapping *lshe.Key, references []*sam.Reference) ([]*sam.Record, error) {
+// AlignmentParams holds the options used when aligning reads to a graph
+type AlignmentParams struct {
+	MaxMismatches int     // the number of mismatches allowed in an alignment (0 only allows exact alignments)
+	ExtendedCigar bool    // use =/X CIGAR operations for matches/mismatches instead of M
+	Gapped        bool    // if the DFS can't align a read, use gapped (indel-aware) local alignment instead of hard clipping
+	Bandwidth     int     // the band used for gapped alignment (DefaultBandwidth is used if not set)
+	MinScore      float64 // the minimum score for a gapped alignment, as a proportion of the score for an exact alignment of the whole read
+	MinAligned    int     // the minimum number of aligned bases needed to report a soft clipped alignment (0 prevents soft clipping)
+}
 
-	// TODO: move this hardcoded value to CLI options
-	MaxClip := 1
+// MaxMapQ is the MAPQ given to an alignment with no competing placements
+const MaxMapQ = 60
+
+// alignmentResult is the CIGAR, edit distance, MD tag and score for an alignment, along with the graph traversal it was aligned to
+type alignmentResult struct {
+	cigar     sam.Cigar
+	nm        int
+	md        string
+	score     int
+	matches   int      // the number of matching bases
+	path      []uint64 // the nodes in the traversal
+	pathStart int      // the offset of the alignment in the first node of the traversal
+}
+
+// mismatch records a read base that didn't match the graph traversal it was aligned to
+type mismatch struct {
+	pos int  // the position in the aligned part of the read
+	ref byte // the reference base
+}
+
+// alignmentTraversal is a path through the graph found by the DFS, along with any mismatches between the read and the path
+type alignmentTraversal struct {
+	path       []uint64
+	mismatches []mismatch
+	length     int // the number of read bases aligned (less than the read length if the traversal ran off the end of the graph or stopped at a mismatch)
+	offset     int // the offset of the alignment in the first node of the path
+}
+
+// AlignRead is a method to run a read to graph hierarchical alignment
+// exact alignment is always tried first, if this fails and a mismatch budget is set, the seeding is repeated allowing mismatches
+// if the DFS can't align the read and gapped alignment is requested, a banded Smith-Waterman is run from the seed
+// if params.MinAligned is set, reads that still can't be aligned are soft clipped, so that reads overhanging the ends of a gene (or only partially matching a path) can be aligned
+// a BAM record is returned for each reference sequence the read aligned to, and a GAF record for each graph traversal the read aligned to
+func (GrootGraph *GrootGraph) AlignRead(read *seqio.FASTQread, mapping *lshe.Key, references []*sam.Reference, params AlignmentParams) ([]*sam.Record, []*GAFRecord, error) {
 
 	// store the ID of the first node in the seed
 	seedNodeID := mapping.Node
@@ -21,104 +63,121 @@ func (GrootGraph *GrootGraph) AlignRead(read *seqio.FASTQread, mapping *lshe.Key
 	// get the node location in the sorted graph using the lookup map
 	nodeLookup, ok := GrootGraph.NodeLookup[seedNodeID]
 	if !ok {
-		return nil, fmt.Errorf("could not perform node lookup during alignment - possible incorrect seed")
+		return nil, nil, fmt.Errorf("could not perform node lookup during alignment - possible incorrect seed")
 	}
 
 	// run the hierarchical alignment
 	IDs := []int{}
 	startPos := make(map[int]int)
+	traversals := make(map[int]*alignmentTraversal)
 	startClippedBases := 0
-	endClippedBases := 0
 	origOffSet := mapping.OffSet
+	budgets := []int{0}
+	if params.MaxMismatches > 0 {
+		budgets = append(budgets, params.MaxMismatches)
+	}
+	for _, budget := range budgets {
 
-	// 1. exact alignment and seed offset shuffling
-	var shuffles int
-	for shuffles = 0; shuffles <= int(mapping.MergeSpan+mapping.WindowSize); shuffles++ {
-		IDs, startPos = GrootGraph.performAlignment(nodeLookup, &read.Seq, int(mapping.OffSet))
-		if len(IDs) > 0 {
-			break
+		// 1. alignment and seed offset shuffling
+		var shuffles int
+		for shuffles = 0; shuffles <= int(mapping.MergeSpan+mapping.WindowSize); shuffles++ {
+			IDs, startPos, traversals = GrootGraph.performAlignment(nodeLookup, &read.Seq, int(mapping.OffSet), budget, 0)
+			if len(IDs) > 0 {
+				break
+			}
+			mapping.OffSet++
 		}
-		mapping.OffSet++
-	}
 
-	// reset the offset
-	mapping.OffSet = origOffSet
+		// reset the offset
+		mapping.OffSet = origOffSet
 
-	// 2. exact alignment and seed node shuffling
-	if len(IDs) == 0 {
-		for shuffledNode := range mapping.ContainedNodes {
-			var shuffles int
-			mapping.OffSet = 0
-			for shuffles = 0; shuffles <= 10; shuffles++ {
-				nodeLookup, ok := GrootGraph.NodeLookup[shuffledNode]
-				if !ok {
-					return nil, fmt.Errorf("could not perform node lookup during alignment - possible incorrect seed")
+		// 2. alignment and seed node shuffling
+		if len(IDs) == 0 {
+			for shuffledNode := range mapping.ContainedNodes {
+				var shuffles int
+				mapping.OffSet = 0
+				for shuffles = 0; shuffles <= 10; shuffles++ {
+					nodeLookup, ok := GrootGraph.NodeLookup[shuffledNode]
+					if !ok {
+						return nil, nil, fmt.Errorf("could not perform node lookup during alignment - possible incorrect seed")
+					}
+					IDs, startPos, traversals = GrootGraph.performAlignment(nodeLookup, &read.Seq, int(mapping.OffSet), budget, 0)
+					if len(IDs) > 0 {
+						break
+					}
+					mapping.OffSet++
 				}
-				IDs, startPos = GrootGraph.performAlignment(nodeLookup, &read.Seq, int(mapping.OffSet))
 				if len(IDs) > 0 {
 					break
 				}
-				mapping.OffSet++
-			}
-			if len(IDs) > 0 {
-				break
 			}
-		}
 
-		// reset the offset
-		mapping.OffSet = origOffSet
+			// reset the offset
+			mapping.OffSet = origOffSet
+		}
+		if len(IDs) > 0 {
+			break
+		}
 	}
 
-	// 3. hard clipping the start of the read
-	if len(IDs) == 0 {
+	// 3. gapped alignment
+	var gapped *alignmentResult
+	if len(IDs) == 0 && params.Gapped {
+		IDs, startPos, gapped = GrootGraph.performGappedAlignment(nodeLookup, read.Seq, int(origOffSet), int(mapping.MergeSpan+mapping.WindowSize), params)
+	}
 
-		// make a copy of the sequence for clipping
-		clippedSeq := read.Seq
-		for i := 1; i <= MaxClip; i++ {
-			clippedSeq = clippedSeq[i:]
-			IDs, startPos = GrootGraph.performAlignment(nodeLookup, &clippedSeq, int(mapping.OffSet))
-			startClippedBases++
-			if len(IDs) != 0 {
+	// 4. soft clipping the end of the read, the DFS reports traversals that run off the end of the graph or stop at a mismatch
+	if len(IDs) == 0 && params.MinAligned > 0 && len(read.Seq) > params.MinAligned {
+		for shuffles := 0; shuffles <= int(mapping.MergeSpan+mapping.WindowSize); shuffles++ {
+			IDs, startPos, traversals = GrootGraph.performAlignment(nodeLookup, &read.Seq, int(mapping.OffSet), params.MaxMismatches, params.MinAligned)
+			if len(IDs) > 0 {
 				break
 			}
+			mapping.OffSet++
 		}
+		mapping.OffSet = origOffSet
 	}
 
-	// 4. hard clipping the end of the read
-	if len(IDs) == 0 {
-
-		// reset the start clip
-		startClippedBases = 0
-
-		// make a copy of the sequence for clipping
-		clippedSeq := read.Seq
-		for i := MaxClip; i > 0; i-- {
-			clippedSeq = clippedSeq[:len(clippedSeq)-1]
-			IDs, startPos = GrootGraph.performAlignment(nodeLookup, &clippedSeq, int(mapping.OffSet))
-			endClippedBases++
-			if len(IDs) != 0 {
+	// 5. soft clipping the start of the read (and the end if needed), for reads that start before the seed
+	// as with steps 1 and 2, this is tried from the seed and then from the start of each node in the window
+	if len(IDs) == 0 && params.MinAligned > 0 {
+		IDs, startPos, traversals, startClippedBases = GrootGraph.alignStartClipped(read.Seq, nodeLookup, int(origOffSet), params)
+		for shuffledNode := range mapping.ContainedNodes {
+			if len(IDs) > 0 {
 				break
 			}
+			nodeLookup, ok := GrootGraph.NodeLookup[shuffledNode]
+			if !ok {
+				return nil, nil, fmt.Errorf("could not perform node lookup during alignment - possible incorrect seed")
+			}
+			IDs, startPos, traversals, startClippedBases = GrootGraph.alignStartClipped(read.Seq, nodeLookup, 0, params)
 		}
 	}
 
-	// TODO: add alignment step to handle terminal alignments
-
 	// return if no alignments found for this read against this graph
 	if len(IDs) == 0 {
-		return nil, nil
+		return nil, nil, nil
 	}
 
-	// report any alignments
+	// report any alignments, the reference sequences that share a traversal share a GAF record
 	alignments := []*sam.Record{}
-	for alignmentCounter, ID := range IDs {
+	gafRecords := []*GAFRecord{}
+	traversalResults := make(map[*alignmentTraversal]*alignmentResult)
+	gafLookup := make(map[*alignmentResult]*GAFRecord)
+	for _, ID := range IDs {
 
-		// set up the alignment record
-		seqLength := len(read.Seq) - endClippedBases - startClippedBases
+		// set up the alignment record, any clipped bases are kept in the sequence
 		record := &sam.Record{
-			Name: string(read.ID[1:]),
-			Seq:  sam.NewSeq(read.Seq[0:seqLength]),
-			Qual: read.Qual[0:seqLength],
+			Name: read.Name(),
+			Seq:  sam.NewSeq(read.Seq),
+		}
+
+		// SAM records hold the raw quality scores, not the ASCII encoded FASTQ ones
+		if len(read.Qual) == len(read.Seq) {
+			record.Qual = make([]byte, len(read.Qual))
+			for i, qual := range read.Qual {
+				record.Qual[i] = qual - 33
+			}
 		}
 
 		// add the reference
@@ -127,78 +186,167 @@ func (GrootGraph *GrootGraph) AlignRead(read *seqio.FASTQread, mapping *lshe.Key
 		// add in the start position for the alignment
 		record.Pos = startPos[ID]
 
-		// add a perfect alignment CIGAR for length of exact alignment, plus any hard clipping
-		cigar := sam.Cigar{}
-		if startClippedBases != 0 {
-			cigar = append(cigar, sam.NewCigarOp(sam.CigarHardClipped, startClippedBases))
+		// add the CIGAR for the alignment, plus any soft clipping
+		result := gapped
+		if result == nil {
+			traversal := traversals[ID]
+			if result = traversalResults[traversal]; result == nil {
+				result = ungappedResult(traversal.length, traversal.mismatches, params.ExtendedCigar)
+				result.path, result.pathStart = traversal.path, traversal.offset
+				if startClippedBases != 0 {
+					result.cigar = append(sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, startClippedBases)}, result.cigar...)
+				}
+				if endClippedBases := len(read.Seq) - startClippedBases - traversal.length; endClippedBases != 0 {
+					result.cigar = append(result.cigar, sam.NewCigarOp(sam.CigarSoftClipped, endClippedBases))
+				}
+				traversalResults[traversal] = result
+			}
 		}
-		cigar = append(cigar, sam.NewCigarOp(sam.CigarMatch, seqLength))
-		if endClippedBases != 0 {
-			cigar = append(cigar, sam.NewCigarOp(sam.CigarHardClipped, endClippedBases))
+		record.Cigar = result.cigar
+
+		// add the edit distance, the mismatching/deleted reference bases and the alignment score
+		for _, tag := range []struct {
+			name  string
+			value interface{}
+		}{{"NM", result.nm}, {"MD", result.md}, {"AS", result.score}} {
+			aux, err := sam.NewAux(sam.NewTag(tag.name), tag.value)
+			if err != nil {
+				return nil, nil, err
+			}
+			record.AuxFields = append(record.AuxFields, aux)
 		}
-		record.Cigar = cigar
 
-		// set the MAPQ
-		// TODO: this is just left in to have a valid SAM file, I need to set these values correctly
-		record.MapQ = 30
-
-		// specify the read orientation and if secondary alignment
-		// note: secondary alignments here are just classed as any additional alignment after the first reported
-		if len(IDs) > 1 && alignmentCounter != 0 {
-			record.Flags |= sam.Secondary
-		}
+		// specify the read orientation (the primary alignment and MAPQ are set once all the alignments are found)
 		if read.RC == true {
 			record.Flags |= sam.Reverse
 		}
 
+		// keep the read group if the read came from BAM/SAM input
+		if read.RG != "" {
+			aux, err := sam.NewAux(sam.NewTag("RG"), read.RG)
+			if err != nil {
+				return nil, nil, err
+			}
+			record.AuxFields = append(record.AuxFields, aux)
+		}
+
+		// flag paired reads (the mate information is added once both reads have been aligned)
+		switch read.Pair {
+		case 1:
+			record.Flags |= sam.Paired | sam.Read1
+		case 2:
+			record.Flags |= sam.Paired | sam.Read2
+		}
+
 		// store the alignment
 		alignments = append(alignments, record)
+		gafRecord, ok := gafLookup[result]
+		if !ok {
+			gafRecord = GrootGraph.newGAFRecord(read, result)
+			gafLookup[result] = gafRecord
+			gafRecords = append(gafRecords, gafRecord)
+		}
+		gafRecord.Records = append(gafRecord.Records, record)
+	}
+
+	// pick the primary alignment and set the MAPQs
+	if err := RankAlignments(alignments); err != nil {
+		return nil, nil, err
 	}
+	RankGAFRecords(gafRecords)
+	return alignments, gafRecords, nil
+}
+
+// alignStartClipped is a method to align a read from a seed after soft clipping bases from the start of the read, returning the alignments and the number of clipped bases
+// the fewest clipped bases that give an alignment of at least params.MinAligned bases are used
+func (GrootGraph *GrootGraph) alignStartClipped(read []byte, nodeLookup, offset int, params AlignmentParams) ([]int, map[int]int, map[int]*alignmentTraversal, int) {
+	seedNode := GrootGraph.SortedNodes[nodeLookup]
+	if offset >= len(seedNode.Sequence) {
+		return nil, nil, nil, 0
+	}
+	for clippedBases := 1; len(read)-clippedBases >= params.MinAligned; clippedBases++ {
 
-	return alignments, nil
+		// don't bother running the DFS if the first base doesn't match the seed
+		if seed := seedNode.Sequence[offset]; seed != read[clippedBases] && seed != 'N' {
+			continue
+		}
+		clippedSeq := read[clippedBases:]
+		IDs, startPos, traversals := GrootGraph.performAlignment(nodeLookup, &clippedSeq, offset, params.MaxMismatches, params.MinAligned)
+		if len(IDs) > 0 {
+			return IDs, startPos, traversals, clippedBases
+		}
+	}
+	return nil, nil, nil, 0
 }
 
 // performAlignment does the actual work
-func (GrootGraph *GrootGraph) performAlignment(NodeLookup int, read *[]byte, offset int) ([]int, map[int]int) {
+// the longest traversals with the fewest mismatches are kept, and the traversal is returned for each reference ID
+// if minAligned is set, traversals covering at least this many read bases are reported, otherwise they must cover the whole read
+func (GrootGraph *GrootGraph) performAlignment(NodeLookup int, read *[]byte, offset, maxMismatches, minAligned int) ([]int, map[int]int, map[int]*alignmentTraversal) {
 
-	// create some empty variables to store the ID and start Pos of any alignment
+	// create some empty variables to store the ID, start Pos and traversal of any alignment
 	IDs := []int{}
 	startPos := make(map[int]int)
+	assignedTraversals := make(map[int]*alignmentTraversal)
 
 	// variables to send and hold paths
 	var wg sync.WaitGroup
-	sendPath := make(chan []uint64)
-	paths := [][]uint64{}
+	sendPath := make(chan *alignmentTraversal)
+	traversals := []*alignmentTraversal{}
 	readLength := len(*read)
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		_ = GrootGraph.dfsRecursive(GrootGraph.SortedNodes[NodeLookup], read, 0, []uint64{}, sendPath, readLength, offset)
+		_ = GrootGraph.dfsRecursive(GrootGraph.SortedNodes[NodeLookup], read, 0, []uint64{}, nil, maxMismatches, minAligned, sendPath, readLength, offset)
 	}()
 	go func() {
 		wg.Wait()
 		close(sendPath)
 	}()
 
-	// collect any succecssful paths from the local alignment
-	for path := range sendPath {
-		paths = append(paths, path)
+	// collect any succecssful paths from the local alignment, only keeping the best scoring ones
+	for traversal := range sendPath {
+		if len(traversals) != 0 {
+			best := traversals[0]
+			if traversal.length < best.length || (traversal.length == best.length && len(traversal.mismatches) > len(best.mismatches)) {
+				continue
+			}
+			if traversal.length > best.length || len(traversal.mismatches) < len(best.mismatches) {
+				traversals = traversals[:0]
+			}
+		}
+		traversals = append(traversals, traversal)
 	}
 
 	// process the traversals
-	if len(paths) != 0 {
-		IDs, startPos = GrootGraph.processTraversal(paths, offset)
+	for _, traversal := range traversals {
+		traversal.offset = offset
+		pathIDs, pathStarts := GrootGraph.processTraversal([][]uint64{traversal.path}, offset)
+		IDs = append(IDs, pathIDs...)
+		for _, ID := range pathIDs {
+			if _, ok := assignedTraversals[ID]; !ok {
+				assignedTraversals[ID] = traversal
+			}
+		}
+		for key, value := range pathStarts {
+			if _, ok := startPos[key]; !ok {
+				startPos[key] = value
+			}
+		}
 	}
-	return IDs, startPos
+	return IDs, startPos, assignedTraversals
 }
 
 // dfsRecursive is a function to perform an alignment using recursive depth first search of a variation graph
-func (GrootGraph *GrootGraph) dfsRecursive(node *GrootGraphNode, read *[]byte, distance int, path []uint64, sendPath chan []uint64, readLength, offset int) bool {
+// a traversal is ended once it has more than maxMismatches mismatches, or when it runs off the end of the graph
+// if minAligned is set, ended traversals that have aligned at least this many read bases are reported as partial alignments
+func (GrootGraph *GrootGraph) dfsRecursive(node *GrootGraphNode, read *[]byte, distance int, path []uint64, mismatches []mismatch, maxMismatches, minAligned int, sendPath chan *alignmentTraversal, readLength, offset int) bool {
 
 	// check that the offset does not exceed the node sequence length
 	if offset >= len(node.Sequence) {
 		return false
 	}
+	nodeStart := distance
 
 	// iterate over the segment sequence held by this node and check matches
 	for _, base := range node.Sequence[offset:] {
@@ -214,24 +362,40 @@ func (GrootGraph *GrootGraph) dfsRecursive(node *GrootGraphNode, read *[]byte, d
 			continue
 		}
 
-		// increment the distance counter for each match
-		if base == (*read)[distance] {
-			distance++
-		} else {
-			return false // terminate this DFS
+		// increment the distance counter for each match, mismatches are recorded until the budget is used up
+		// the mismatches are copied when they are added to, as the other branches of the DFS share them
+		if base != (*read)[distance] {
+			if len(mismatches) >= maxMismatches {
+
+				// terminate this DFS, reporting a partial alignment if enough of the read has been aligned
+				if minAligned == 0 || distance < minAligned {
+					return false
+				}
+				if distance > nodeStart {
+					path = append(path, node.SegmentID)
+				}
+				sendPath <- &alignmentTraversal{path: append([]uint64(nil), path...), mismatches: mismatches, length: distance}
+				return true
+			}
+			mismatches = append(mismatches[:len(mismatches):len(mismatches)], mismatch{pos: distance, ref: base})
 		}
+		distance++
 	}
 
 	// increment the path to include the segment that has just been matched
 	path = append(path, node.SegmentID)
 
 	// if we have a consensus length that equals read length (==exact match), or there are no more nodes in the graph - end the DFS and report the alignment path
+	// running off the end of the graph is only reported as a partial alignment
 	if distance == readLength || len(node.OutEdges) == 0 {
+		if distance != readLength && (minAligned == 0 || distance < minAligned) {
+			return false
+		}
 		pathCopy := make([]uint64, len(path))
 		for i, j := range path {
 			pathCopy[i] = j
 		}
-		sendPath <- pathCopy
+		sendPath <- &alignmentTraversal{path: pathCopy, mismatches: mismatches, length: distance}
 		return true
 	}
 
@@ -246,7 +410,7 @@ func (GrootGraph *GrootGraph) dfsRecursive(node *GrootGraphNode, read *[]byte, d
 			panic("could not perform node lookup during alignment - possible incorrect seed")
 		}
 		// call the DFS func again
-		if result := GrootGraph.dfsRecursive(GrootGraph.SortedNodes[NodeLookup], read, distance, path, sendPath, readLength, 0); result == true {
+		if result := GrootGraph.dfsRecursive(GrootGraph.SortedNodes[NodeLookup], read, distance, path, mismatches, maxMismatches, minAligned, sendPath, readLength, 0); result == true {
 			aligned = true
 		}
 	}
@@ -315,3 +479,163 @@ func (GrootGraph *GrootGraph) processTraversal(paths [][]uint64, offset int) ([]
 	}
 	return IDassignments, startPositions
 }
+
+// ungappedResult is a function to get the CIGAR, edit distance, MD tag and score for an ungapped alignment
+func ungappedResult(length int, mismatches []mismatch, extended bool) *alignmentResult {
+	return &alignmentResult{
+		cigar:   alignmentCigar(length, mismatches, extended),
+		nm:      len(mismatches),
+		md:      mdTag(length, mismatches),
+		score:   (length-len(mismatches))*matchScore - len(mismatches)*mismatchPenalty,
+		matches: length - len(mismatches),
+	}
+}
+
+// alignmentCigar is a function to get the CIGAR operations for an ungapped alignment, using =/X operations for matches/mismatches if requested (otherwise M)
+func alignmentCigar(length int, mismatches []mismatch, extended bool) sam.Cigar {
+	if !extended {
+		return sam.Cigar{sam.NewCigarOp(sam.CigarMatch, length)}
+	}
+	cigar := sam.Cigar{}
+	pos := 0
+	for _, mm := range mismatches {
+		if mm.pos > pos {
+			cigar = append(cigar, sam.NewCigarOp(sam.CigarEqual, mm.pos-pos))
+		}
+		if last := len(cigar) - 1; last >= 0 && cigar[last].Type() == sam.CigarMismatch && mm.pos == pos {
+			cigar[last] = sam.NewCigarOp(sam.CigarMismatch, cigar[last].Len()+1)
+		} else {
+			cigar = append(cigar, sam.NewCigarOp(sam.CigarMismatch, 1))
+		}
+		pos = mm.pos + 1
+	}
+	if pos < length {
+		cigar = append(cigar, sam.NewCigarOp(sam.CigarEqual, length-pos))
+	}
+	return cigar
+}
+
+// mdTag is a function to get the MD tag for an ungapped alignment, which gives the reference base at each mismatch
+func mdTag(length int, mismatches []mismatch) string {
+	var md strings.Builder
+	pos := 0
+	for _, mm := range mismatches {
+		fmt.Fprintf(&md, "%d%c", mm.pos-pos, mm.ref)
+		pos = mm.pos + 1
+	}
+	fmt.Fprintf(&md, "%d", length-pos)
+	return md.String()
+}
+
+// RankAlignments is a function to pick the primary alignment for a read from all of its alignments and to set the MAPQ of each alignment
+// the alignments are sorted by their alignment score (AS tag), with ties broken by reference name and position so that the primary alignment is deterministic
+// every alignment after the first is marked as secondary and gets a MAPQ of 0, alignments with a competing placement get an XS tag (the best score of the other alignments)
+// it can be run again on a larger set of alignments for the same read (e.g. from several graphs), replacing the previous flags, MAPQs and XS tags
+func RankAlignments(alignments []*sam.Record) error {
+	if len(alignments) == 0 {
+		return nil
+	}
+	scores := make(map[*sam.Record]int, len(alignments))
+	for _, record := range alignments {
+		scores[record] = alignmentScore(record)
+	}
+	sort.SliceStable(alignments, func(a, b int) bool {
+		x, y := alignments[a], alignments[b]
+		if scores[x] != scores[y] {
+			return scores[x] > scores[y]
+		}
+		if x.Ref.Name() != y.Ref.Name() {
+			return x.Ref.Name() < y.Ref.Name()
+		}
+		return x.Pos < y.Pos
+	})
+
+	// get the best score of the competing placements and the number of placements with that score
+	best, second, numSecond := scores[alignments[0]], 0, 0
+	if len(alignments) > 1 {
+		second = scores[alignments[1]]
+		for _, record := range alignments[1:] {
+			if scores[record] == second {
+				numSecond++
+			}
+		}
+	}
+	for i, record := range alignments {
+		record.Flags &^= sam.Secondary
+		record.MapQ = 0
+		if i == 0 {
+			record.MapQ = mapQ(best, second, numSecond)
+		} else {
+			record.Flags |= sam.Secondary
+		}
+		if len(alignments) == 1 {
+			continue
+		}
+		competitor := best
+		if i == 0 {
+			competitor = second
+		}
+		if err := setAux(record, "XS", competitor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapQ is a function to get the MAPQ for a primary alignment from its score and the score of the best competing placement (as for BWA-SW)
+// each point of score between the primary and the competing placement adds ~6 to the MAPQ, which is reduced if there are several competing placements
+func mapQ(best, second, numSecond int) byte {
+	if numSecond == 0 {
+		return MaxMapQ
+	}
+	if second >= best {
+		return 0
+	}
+	q := 6.02*float64(best-second)/matchScore - 4.343*math.Log(float64(numSecond+1))
+	switch {
+	case q < 0:
+		return 0
+	case q > MaxMapQ:
+		return MaxMapQ
+	}
+	return byte(q + 0.499)
+}
+
+// alignmentScore is a function to get the alignment score (AS tag) of a record, records without one score 0
+func alignmentScore(record *sam.Record) int {
+	aux, ok := record.Tag([]byte("AS"))
+	if !ok {
+		return 0
+	}
+	switch value := aux.Value().(type) {
+	case int8:
+		return int(value)
+	case uint8:
+		return int(value)
+	case int16:
+		return int(value)
+	case uint16:
+		return int(value)
+	case int32:
+		return int(value)
+	case uint32:
+		return int(value)
+	}
+	return 0
+}
+
+// setAux is a function to add an aux field to a record, replacing any existing field with the same tag
+func setAux(record *sam.Record, tag string, value interface{}) error {
+	aux, err := sam.NewAux(sam.NewTag(tag), value)
+	if err != nil {
+		return err
+	}
+	for i, field := range record.AuxFields {
+		if field.Tag() == aux.Tag() {
+			record.AuxFields[i] = aux
+			return nil
+		}
+	}
+	record.AuxFields = append(record.AuxFields, aux)
+	return nil
+}
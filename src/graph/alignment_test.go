@@ -2,6 +2,7 @@ package graph
 
 import (
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/biogo/hts/sam"
@@ -82,7 +83,7 @@ func TestExactMatchMultiMapper(t *testing.T) {
 	}
 
 	// align the read to the graph
-	alignments, err := grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)])
+	alignments, _, err := grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], AlignmentParams{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -92,3 +93,266 @@ func TestExactMatchMultiMapper(t *testing.T) {
 	}
 
 }
+
+// this tests that a read with a mismatch is only aligned if there is a mismatch budget, and that the NM and MD tags are set
+func TestMismatchAlignment(t *testing.T) {
+	testRead, seed, err := setupRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	grootGraph, references, err := setupGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add a mismatch (T->C) to the read
+	testRead.Seq[9] = 'C'
+	origSeed := *seed
+	alignments, _, err := grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], AlignmentParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alignments) != 0 {
+		t.Fatal("read with a mismatch should not align without a mismatch budget")
+	}
+	*seed = origSeed
+	alignments, _, err = grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], AlignmentParams{MaxMismatches: 1, ExtendedCigar: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alignments) == 0 {
+		t.Fatal("read with a mismatch should align with a mismatch budget of 1")
+	}
+	for _, alignment := range alignments {
+		t.Log(alignment.String())
+		if alignment.Cigar.String() != "9=1X8=" {
+			t.Fatalf("expected CIGAR 9=1X8=, got %v", alignment.Cigar)
+		}
+		if nm, ok := alignment.Tag([]byte("NM")); !ok || nm.String() != "NM:i:1" {
+			t.Fatalf("expected NM:i:1, got %v", nm)
+		}
+		if md, ok := alignment.Tag([]byte("MD")); !ok || md.Value() != "9T8" {
+			t.Fatalf("expected MD:Z:9T8, got %v", md)
+		}
+	}
+}
+
+// this tests the CIGAR and MD tag for ungapped alignments with mismatches
+func TestMismatchCigar(t *testing.T) {
+	mismatches := []mismatch{{pos: 0, ref: 'A'}, {pos: 4, ref: 'C'}, {pos: 5, ref: 'G'}}
+	if cigar := alignmentCigar(10, mismatches, true).String(); cigar != "1X3=2X4=" {
+		t.Fatalf("expected CIGAR 1X3=2X4=, got %v", cigar)
+	}
+	if cigar := alignmentCigar(10, mismatches, false).String(); cigar != "10M" {
+		t.Fatalf("expected CIGAR 10M, got %v", cigar)
+	}
+	if md := mdTag(10, mismatches); md != "0A3C0G4" {
+		t.Fatalf("expected MD 0A3C0G4, got %v", md)
+	}
+	if md := mdTag(10, nil); md != "10" {
+		t.Fatalf("expected MD 10, got %v", md)
+	}
+}
+
+// this tests that reads with an indel are only aligned when gapped alignment is requested, and that the indel is in the CIGAR
+func TestGappedAlignment(t *testing.T) {
+	grootGraph, references, err := setupGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	longRead, seed, err := setupUniqmapRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origSeed := *seed
+	params := AlignmentParams{Gapped: true, MinScore: 0.8}
+	for _, test := range []struct {
+		seq   []byte
+		cigar string
+		md    string
+	}{
+		{seq: append(append([]byte{}, longRead.Seq[:38]...), longRead.Seq[39:80]...), cigar: "38M1D41M", md: "38^C41"},
+		{seq: append(append(append([]byte{}, longRead.Seq[:42]...), 'G'), longRead.Seq[42:80]...), cigar: "42M1I38M", md: "80"},
+		{seq: append(append([]byte{}, longRead.Seq[:75]...), []byte("CCCCC")...), cigar: "75M5S", md: "75"},
+	} {
+		testRead, err := seqio.NewFASTQread([]byte("@read-with-indel"), test.seq, []byte("+"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		*seed = origSeed
+		alignments, _, err := grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], AlignmentParams{MaxMismatches: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alignments) != 0 {
+			t.Fatal("read with an indel should not align without gapped alignment")
+		}
+		*seed = origSeed
+		alignments, _, err = grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alignments) == 0 {
+			t.Fatal("read with an indel should align with gapped alignment")
+		}
+		for _, alignment := range alignments {
+			t.Log(alignment.String())
+			if alignment.Cigar.String() != test.cigar {
+				t.Fatalf("expected CIGAR %v, got %v", test.cigar, alignment.Cigar)
+			}
+			if md, ok := alignment.Tag([]byte("MD")); !ok || md.Value() != test.md {
+				t.Fatalf("expected MD:Z:%v, got %v", test.md, md)
+			}
+			if _, ok := alignment.Tag([]byte("AS")); !ok {
+				t.Fatal("no AS tag for gapped alignment")
+			}
+			if alignment.Pos != 0 {
+				t.Fatalf("expected alignment to start at 0, got %d", alignment.Pos)
+			}
+		}
+	}
+}
+
+// this tests that reads overhanging the ends of the graph, or that only partially match a path, are soft clipped
+func TestSoftClipAlignment(t *testing.T) {
+	grootGraph, references, err := setupGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	longRead, seed, err := setupUniqmapRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// find the node holding the last 40 bases of B10, to seed a read overhanging the end of the graph
+	var pathID uint32
+	for id, name := range grootGraph.Paths {
+		if strings.Contains(string(name), "B-10") {
+			pathID = id
+		}
+	}
+	endStart := len(longRead.Seq) - 40
+	endSeed := &lshe.Key{GraphID: 1}
+	for _, node := range grootGraph.SortedNodes {
+		pos, ok := node.Position[int(pathID)]
+		if ok && pos <= endStart && endStart < pos+len(node.Sequence) {
+			endSeed.Node, endSeed.OffSet = node.SegmentID, uint32(endStart-pos)
+		}
+	}
+
+	// a seed that is elsewhere in the window, so that start clipping has to be tried from the other nodes in the window
+	windowSeed := *endSeed
+	windowSeed.ContainedNodes = map[uint64]float64{endSeed.Node: 1.0, seed.Node: 1.0}
+	for _, test := range []struct {
+		seq   []byte
+		seed  lshe.Key
+		cigar string
+		pos   int
+	}{
+		{seq: append([]byte("TTTTTT"), longRead.Seq[:60]...), seed: *seed, cigar: "6S60M", pos: 0},
+		{seq: append([]byte("TTTTTT"), longRead.Seq[:60]...), seed: windowSeed, cigar: "6S60M", pos: 0},
+		{seq: append(append([]byte{}, longRead.Seq[endStart:]...), []byte("CCCCC")...), seed: *endSeed, cigar: "40M5S", pos: endStart},
+		{seq: append(append([]byte{}, longRead.Seq[:75]...), []byte("CCCCC")...), seed: *seed, cigar: "75M5S", pos: 0},
+	} {
+		testRead, err := seqio.NewFASTQread([]byte("@read-with-clipping"), test.seq, []byte("+"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mapping := test.seed
+		alignments, _, err := grootGraph.AlignRead(testRead, &mapping, references[int(grootGraph.GraphID)], AlignmentParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alignments) != 0 {
+			t.Fatal("read should not align without soft clipping")
+		}
+		mapping = test.seed
+		alignments, _, err = grootGraph.AlignRead(testRead, &mapping, references[int(grootGraph.GraphID)], AlignmentParams{MinAligned: 30})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(alignments) == 0 {
+			t.Fatal("read should align with soft clipping")
+		}
+		for _, alignment := range alignments {
+			t.Log(alignment.String())
+			if alignment.Cigar.String() != test.cigar {
+				t.Fatalf("expected CIGAR %v, got %v", test.cigar, alignment.Cigar)
+			}
+			if alignment.Pos != test.pos {
+				t.Fatalf("expected alignment to start at %d, got %d", test.pos, alignment.Pos)
+			}
+			if alignment.Seq.Length != len(test.seq) {
+				t.Fatalf("soft clipped alignment should keep the whole read sequence (%d vs. %d bases)", alignment.Seq.Length, len(test.seq))
+			}
+		}
+	}
+}
+
+// this tests that the primary alignment is picked by score and that the MAPQ and XS tags reflect the competing alignments
+func TestRankAlignments(t *testing.T) {
+	newRecord := func(name string, score int) *sam.Record {
+		ref, err := sam.NewReference(name, "", "", 1000, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aux, err := sam.NewAux(sam.NewTag("AS"), score)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &sam.Record{Name: "read", Ref: ref, AuxFields: []sam.Aux{aux}}
+	}
+
+	// a unique alignment gets the maximum MAPQ and no XS tag
+	records := []*sam.Record{newRecord("refA", 100)}
+	if err := RankAlignments(records); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].MapQ != MaxMapQ || records[0].Flags&sam.Secondary != 0 {
+		t.Fatalf("expected a primary alignment with MAPQ %d, got %v", MaxMapQ, records[0])
+	}
+	if _, ok := records[0].Tag([]byte("XS")); ok {
+		t.Fatal("unique alignment should not have an XS tag")
+	}
+
+	// the best scoring alignment is primary, regardless of the order it was found in
+	records = []*sam.Record{newRecord("refB", 95), newRecord("refA", 100), newRecord("refC", 95)}
+	if err := RankAlignments(records); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Ref.Name() != "refA" || records[0].Flags&sam.Secondary != 0 {
+		t.Fatalf("expected refA to be the primary alignment, got %v", records[0])
+	}
+	if records[0].MapQ != mapQ(100, 95, 2) || records[0].MapQ == 0 || records[0].MapQ == MaxMapQ {
+		t.Fatalf("unexpected MAPQ for primary alignment with a competing placement: %d", records[0].MapQ)
+	}
+	if xs, ok := records[0].Tag([]byte("XS")); !ok || xs.String() != "XS:i:95" {
+		t.Fatalf("expected XS:i:95, got %v", xs)
+	}
+	for _, record := range records[1:] {
+		if record.Flags&sam.Secondary == 0 || record.MapQ != 0 {
+			t.Fatalf("expected a secondary alignment with MAPQ 0, got %v", record)
+		}
+	}
+
+	// equally good alignments are tied on MAPQ 0, and re-ranking replaces the previous ranking
+	records = append(records, newRecord("refD", 100))
+	if err := RankAlignments(records); err != nil {
+		t.Fatal(err)
+	}
+	if records[0].Ref.Name() != "refA" || records[0].MapQ != 0 {
+		t.Fatalf("expected refA to be the primary alignment with MAPQ 0, got %v", records[0])
+	}
+	numPrimary := 0
+	for _, record := range records {
+		if record.Flags&sam.Secondary == 0 {
+			numPrimary++
+		}
+		if len(record.AuxFields) != 2 {
+			t.Fatalf("expected the AS and XS tags only, got %v", record.AuxFields)
+		}
+	}
+	if numPrimary != 1 {
+		t.Fatalf("expected 1 primary alignment, got %d", numPrimary)
+	}
+}
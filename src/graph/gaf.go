@@ -0,0 +1,153 @@
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// GAFRecord is an alignment of a read to a traversal of a graph, which is reported in the Graph Alignment Format (GAF)
+// a BAM record projects the alignment onto a single reference sequence, whereas a GAF record keeps the traversal (so there is one GAF record for all the references that share it)
+type GAFRecord struct {
+	ReadName     string
+	ReadLength   int
+	ReadStart    int  // the start of the aligned part of the read (in the orientation the read was given in)
+	ReadEnd      int  // the end of the aligned part of the read (in the orientation the read was given in)
+	Reverse      bool // the read was reverse complemented to align it to the traversal
+	GraphID      uint32
+	Path         []uint64 // the nodes in the traversal (these are the segment IDs in the GFA for the graph)
+	PathLength   int      // the combined length of the nodes in the traversal
+	PathStart    int      // the start of the alignment on the traversal
+	PathEnd      int      // the end of the alignment on the traversal
+	Matches      int      // the number of matching bases
+	BlockLength  int      // the number of bases in the alignment (including gaps)
+	MapQ         byte
+	Primary      bool
+	Score        int
+	EditDistance int
+	Cigar        sam.Cigar     // the alignment CIGAR (without clipping)
+	Records      []*sam.Record // the BAM records for the references that share the traversal
+}
+
+// newGAFRecord is a method to get the GAF record for an alignment result
+func (GrootGraph *GrootGraph) newGAFRecord(read *seqio.FASTQread, result *alignmentResult) *GAFRecord {
+	gafRecord := &GAFRecord{
+		ReadName:     read.Name(),
+		ReadLength:   len(read.Seq),
+		Reverse:      read.RC,
+		GraphID:      GrootGraph.GraphID,
+		Path:         result.path,
+		PathStart:    result.pathStart,
+		Matches:      result.matches,
+		Score:        result.score,
+		EditDistance: result.nm,
+		Cigar:        sam.Cigar{},
+	}
+	if read.Pair != 0 {
+		gafRecord.ReadName = fmt.Sprintf("%v/%d", gafRecord.ReadName, read.Pair)
+	}
+	for _, node := range result.path {
+		gafRecord.PathLength += len(GrootGraph.SortedNodes[GrootGraph.NodeLookup[node]].Sequence)
+	}
+
+	// get the aligned part of the read and the traversal from the CIGAR
+	startClip, endClip, refLength := 0, 0, 0
+	for i, op := range result.cigar {
+		switch op.Type() {
+		case sam.CigarSoftClipped, sam.CigarHardClipped:
+			if i == 0 {
+				startClip = op.Len()
+			} else {
+				endClip = op.Len()
+			}
+			continue
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch, sam.CigarDeletion:
+			refLength += op.Len()
+		}
+		gafRecord.BlockLength += op.Len()
+		gafRecord.Cigar = append(gafRecord.Cigar, op)
+	}
+	gafRecord.PathEnd = gafRecord.PathStart + refLength
+	gafRecord.ReadStart, gafRecord.ReadEnd = startClip, len(read.Seq)-endClip
+	if read.RC {
+		gafRecord.ReadStart, gafRecord.ReadEnd = endClip, len(read.Seq)-startClip
+	}
+	return gafRecord
+}
+
+// String is a method to get the GAF line for the record (without a newline)
+// the graph that the record is for is given in the gr tag
+func (GAFRecord *GAFRecord) String() string {
+	var path strings.Builder
+	for _, node := range GAFRecord.Path {
+		path.WriteByte('>')
+		path.WriteString(strconv.FormatUint(node, 10))
+	}
+	strand, alignmentType, identity := "+", "S", 0.0
+	if GAFRecord.Reverse {
+		strand = "-"
+	}
+	if GAFRecord.Primary {
+		alignmentType = "P"
+	}
+	if GAFRecord.BlockLength != 0 {
+		identity = float64(GAFRecord.Matches) / float64(GAFRecord.BlockLength)
+	}
+	return fmt.Sprintf("%v\t%d\t%d\t%d\t%v\t%v\t%d\t%d\t%d\t%d\t%d\t%d\ttp:A:%v\tNM:i:%d\tAS:i:%d\tid:f:%.4f\tgr:i:%d\tcg:Z:%v",
+		GAFRecord.ReadName, GAFRecord.ReadLength, GAFRecord.ReadStart, GAFRecord.ReadEnd, strand,
+		path.String(), GAFRecord.PathLength, GAFRecord.PathStart, GAFRecord.PathEnd,
+		GAFRecord.Matches, GAFRecord.BlockLength, GAFRecord.MapQ,
+		alignmentType, GAFRecord.EditDistance, GAFRecord.Score, identity, GAFRecord.GraphID, GAFRecord.Cigar)
+}
+
+// RankGAFRecords is a function to pick the primary GAF record for a read and set the MAPQ of each record (as RankAlignments does for BAM records)
+// ties are broken using the primary BAM record (so RankAlignments should be run first), then the graph ID and the traversal
+func RankGAFRecords(gafRecords []*GAFRecord) {
+	if len(gafRecords) == 0 {
+		return
+	}
+	hasPrimary := func(gafRecord *GAFRecord) bool {
+		for _, record := range gafRecord.Records {
+			if record.Flags&sam.Secondary == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	sort.SliceStable(gafRecords, func(a, b int) bool {
+		x, y := gafRecords[a], gafRecords[b]
+		if x.Score != y.Score {
+			return x.Score > y.Score
+		}
+		if xPrimary, yPrimary := hasPrimary(x), hasPrimary(y); xPrimary != yPrimary {
+			return xPrimary
+		}
+		if x.GraphID != y.GraphID {
+			return x.GraphID < y.GraphID
+		}
+		if x.Path[0] != y.Path[0] {
+			return x.Path[0] < y.Path[0]
+		}
+		return x.PathStart < y.PathStart
+	})
+	best, second, numSecond := gafRecords[0].Score, 0, 0
+	if len(gafRecords) > 1 {
+		second = gafRecords[1].Score
+		for _, gafRecord := range gafRecords[1:] {
+			if gafRecord.Score == second {
+				numSecond++
+			}
+		}
+	}
+	for i, gafRecord := range gafRecords {
+		gafRecord.Primary = i == 0
+		gafRecord.MapQ = 0
+		if i == 0 {
+			gafRecord.MapQ = mapQ(best, second, numSecond)
+		}
+	}
+}
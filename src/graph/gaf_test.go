@@ -0,0 +1,70 @@
+package graph
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// this tests that the reference sequences sharing a traversal share a GAF record, and that the GAF line describes the traversal
+func TestGAFRecord(t *testing.T) {
+	grootGraph, references, err := setupGraph()
+	if err != nil {
+		t.Fatal(err)
+	}
+	longRead, seed, err := setupUniqmapRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a read with a deletion and some unaligned bases at the end, which is flagged as having been reverse complemented to align it
+	seq := append(append(append([]byte{}, longRead.Seq[:38]...), longRead.Seq[39:80]...), []byte("CCCCC")...)
+	testRead, err := seqio.NewFASTQread([]byte("@read-for-gaf"), seq, []byte("+"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRead.RC = true
+	alignments, gafRecords, err := grootGraph.AlignRead(testRead, seed, references[int(grootGraph.GraphID)], AlignmentParams{Gapped: true, MinScore: 0.8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gafRecords) != 1 || len(gafRecords[0].Records) != len(alignments) || len(alignments) < 2 {
+		t.Fatalf("expected all %d alignments to share a single GAF record, got %d GAF records", len(alignments), len(gafRecords))
+	}
+	gafRecord := gafRecords[0]
+	t.Log(gafRecord)
+	fields := strings.Split(gafRecord.String(), "\t")
+	if len(fields) != 18 {
+		t.Fatalf("expected 12 GAF columns and 6 tags, got %d fields", len(fields))
+	}
+
+	// the read was reverse complemented, so the clipped bases are at the start of the read as it was given
+	for i, expected := range []string{"read-for-gaf", "84", "5", "84", "-"} {
+		if fields[i] != expected {
+			t.Fatalf("expected GAF column %d to be %v, got %v", i+1, expected, fields[i])
+		}
+	}
+	if !strings.HasPrefix(fields[5], ">2>") {
+		t.Fatalf("expected the traversal to start at the seed node, got %v", fields[5])
+	}
+	for i, expected := range []string{"0", "80", "79", "80"} {
+		if fields[i+7] != expected {
+			t.Fatalf("expected GAF column %d to be %v, got %v", i+8, expected, fields[i+7])
+		}
+	}
+	for _, tag := range []string{"tp:A:P", "NM:i:1", "id:f:0.9875", "gr:i:1", "cg:Z:38M1D41M"} {
+		if !strings.Contains(gafRecord.String(), "\t"+tag) {
+			t.Fatalf("expected GAF tag %v in %v", tag, gafRecord)
+		}
+	}
+
+	// the path length is the combined length of the nodes in the traversal
+	pathLength := 0
+	for _, node := range gafRecord.Path {
+		pathLength += len(grootGraph.SortedNodes[grootGraph.NodeLookup[node]].Sequence)
+	}
+	if gafRecord.PathLength != pathLength || gafRecord.PathEnd > pathLength {
+		t.Fatalf("unexpected path length (%d vs. %d)", gafRecord.PathLength, pathLength)
+	}
+}
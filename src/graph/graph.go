@@ -10,6 +10,7 @@ import (
 
 	"github.com/will-rowe/gfa"
 	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/misc"
 	"github.com/will-rowe/groot/src/seqio"
 )
@@ -23,6 +24,7 @@ type GrootGraph struct {
 	Lengths             map[uint32]int     // lengths of sequences held in graph (lookup key corresponds to key in Paths)
 	NodeLookup          map[uint64]int     // this map returns a the position of a node in the SortedNodes array, using the node segmentID as the locator
 	Masked              bool               // a flag to prevent the graph being used by GROOT
+	Database            string             // the database the graph came from (set when indexes are merged)
 	KmerTotal           uint64             // the total number of k-mers projected onto the graph
 	EMiterations        int                // the number of EM iterations ran
 	alpha               []float64          // indices match the Paths
@@ -225,8 +227,23 @@ func (GrootGraph *GrootGraph) GetSketchStats() (int, int, int, error) {
 	return GrootGraph.numWindows, GrootGraph.numDistinctSketches, int(GrootGraph.maxSpan), nil
 }
 
+// SetSketchStats is a method to restore the sketch stats for a graph loaded from an index, using the windows held in the LSH Ensemble (the stats aren't saved in the graph store)
+func (GrootGraph *GrootGraph) SetSketchStats(windowSize int, windows lshe.Keys) {
+	GrootGraph.numWindows = 0
+	for _, length := range GrootGraph.Lengths {
+		GrootGraph.numWindows += length - windowSize + 1
+	}
+	GrootGraph.numDistinctSketches = len(windows)
+	GrootGraph.maxSpan = 0
+	for _, window := range windows {
+		if window.MergeSpan > GrootGraph.maxSpan {
+			GrootGraph.maxSpan = window.MergeSpan
+		}
+	}
+}
+
 // WindowGraph is a method to slide a window over each path through the graph, sketching the paths and getting window information
-func (GrootGraph *GrootGraph) WindowGraph(windowSize, kmerSize, sketchSize int) (map[string]lshe.Keys, error) {
+func (GrootGraph *GrootGraph) WindowGraph(windowSize, kmerSize, sketchSize int, algorithm minhash.Algorithm) (map[string]lshe.Keys, error) {
 
 	// get the linear sequences for this graph
 	pathSeqs, err := GrootGraph.Graph2Seqs()
@@ -290,7 +307,7 @@ func (GrootGraph *GrootGraph) WindowGraph(windowSize, kmerSize, sketchSize int)
 
 				// sketch the current window
 				windowSeq := seqio.Sequence{Seq: pathSequence[i : i+windowSize]}
-				sketch, err := windowSeq.RunMinHash(kmerSize, sketchSize, false, nil)
+				sketch, strands, err := windowSeq.RunMinHash(kmerSize, sketchSize, algorithm, nil)
 				if err != nil {
 					panic(err)
 				}
@@ -317,6 +334,7 @@ func (GrootGraph *GrootGraph) WindowGraph(windowSize, kmerSize, sketchSize int)
 						ContainedNodes: make(map[uint64]float64),
 						Ref:            []uint32{pathID},
 						Sketch:         sketch,
+						Strands:        strands,
 						MergeSpan:      0,
 						WindowSize:     uint32(windowSize),
 					}
@@ -655,6 +673,72 @@ func (GrootGraph *GrootGraph) GetRefIDs() ([]string, error) {
 	return paths, nil
 }
 
+// Copy is a method to return a deep copy of a GrootGraph, so that the copy can be weighted and pruned without affecting the original
+// Note: node sequences and path names are shared with the original, as these are not modified after graph construction
+func (GrootGraph *GrootGraph) Copy() *GrootGraph {
+
+	// start with a shallow copy and then replace everything that can be modified during weighting, pruning and EM
+	newGraph := *GrootGraph
+	newGraph.SortedNodes = make([]*GrootGraphNode, len(GrootGraph.SortedNodes))
+	newGraph.Paths = make(map[uint32][]byte, len(GrootGraph.Paths))
+	newGraph.Lengths = make(map[uint32]int, len(GrootGraph.Lengths))
+	newGraph.NodeLookup = make(map[uint64]int, len(GrootGraph.NodeLookup))
+	newGraph.alpha = append([]float64(nil), GrootGraph.alpha...)
+	newGraph.abundances = nil
+	newGraph.grootPaths = nil
+	for i, node := range GrootGraph.SortedNodes {
+		newNode := &GrootGraphNode{
+			SegmentID:     node.SegmentID,
+			SegmentLength: node.SegmentLength,
+			Sequence:      node.Sequence,
+			OutEdges:      make(Nodes, len(node.OutEdges)),
+			PathIDs:       make([]uint32, len(node.PathIDs)),
+			Position:      make(map[int]int, len(node.Position)),
+			KmerFreq:      node.KmerFreq,
+			Marked:        node.Marked,
+		}
+		copy(newNode.OutEdges, node.OutEdges)
+		copy(newNode.PathIDs, node.PathIDs)
+		for pathID, pos := range node.Position {
+			newNode.Position[pathID] = pos
+		}
+		newGraph.SortedNodes[i] = newNode
+	}
+	for pathID, path := range GrootGraph.Paths {
+		newGraph.Paths[pathID] = path
+	}
+	for pathID, length := range GrootGraph.Lengths {
+		newGraph.Lengths[pathID] = length
+	}
+	for segID, lookup := range GrootGraph.NodeLookup {
+		newGraph.NodeLookup[segID] = lookup
+	}
+	return &newGraph
+}
+
+// ResetWeights is a method to remove any k-mer weighting and EM results from a graph
+func (GrootGraph *GrootGraph) ResetWeights() {
+	for _, node := range GrootGraph.SortedNodes {
+		node.KmerFreq = 0.0
+	}
+	GrootGraph.KmerTotal = 0
+	GrootGraph.EMiterations = 0
+	GrootGraph.alpha = nil
+	GrootGraph.abundances = nil
+}
+
+// GetNodeWeights is a method to return the combined k-mer frequency of the nodes remaining in the graph (i.e. the nodes that would be written to GFA)
+func (GrootGraph *GrootGraph) GetNodeWeights() float64 {
+	total := 0.0
+	for _, node := range GrootGraph.SortedNodes {
+		if node.Marked {
+			continue
+		}
+		total += float64(int(node.KmerFreq))
+	}
+	return total
+}
+
 // IncrementKmerCount is a method to increment the counter for the number of kmers projected onto the graph
 func (GrootGraph *GrootGraph) IncrementKmerCount(increment uint64) {
 	GrootGraph.KmerTotal += increment
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/will-rowe/gfa"
+	"github.com/will-rowe/groot/src/minhash"
 )
 
 var (
@@ -79,7 +80,7 @@ func TestWindowGraph(t *testing.T) {
 		t.Fatal(err)
 	}
 	counter := 0
-	graphWindows, err := grootGraph.WindowGraph(windowSize, kmerSize, sketchSize)
+	graphWindows, err := grootGraph.WindowGraph(windowSize, kmerSize, sketchSize, minhash.KHF)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,3 +159,32 @@ func TestGraphDump(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// test Copy and ResetWeights keep graph weights isolated
+func TestGraphCopy(t *testing.T) {
+	myGFA, err := LoadGFA(inputFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grootGraph, err := CreateGrootGraph(myGFA, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	origFreq, origTotal := grootGraph.SortedNodes[0].KmerFreq, grootGraph.KmerTotal
+	graphCopy := grootGraph.Copy()
+	graphCopy.SortedNodes[0].IncrementKmerFreq(100.0)
+	graphCopy.IncrementKmerCount(100)
+	graphCopy.Prune(1.0)
+	if grootGraph.SortedNodes[0].KmerFreq != origFreq || grootGraph.KmerTotal != origTotal {
+		t.Fatal("weighting a graph copy altered the original graph")
+	}
+	for _, node := range grootGraph.SortedNodes {
+		if node.Marked {
+			t.Fatal("pruning a graph copy altered the original graph")
+		}
+	}
+	graphCopy.ResetWeights()
+	if graphCopy.SortedNodes[0].KmerFreq != 0.0 || graphCopy.KmerTotal != 0 {
+		t.Fatal("graph weights were not reset")
+	}
+}
@@ -27,6 +27,9 @@ func (GrootGraph *GrootGraph) SaveGraphAsGFA(fileName string, totalKmers int) (i
 	_ = newGFA.AddVersion(1)
 	newGFA.AddComment([]byte(stamp))
 	newGFA.AddComment([]byte(msg))
+	if GrootGraph.Database != "" {
+		newGFA.AddComment([]byte(fmt.Sprintf("source database: %v", GrootGraph.Database)))
+	}
 	// transfer all the GrootGraphNode content to the GFA instance
 	for _, node := range GrootGraph.SortedNodes {
 
@@ -137,6 +140,15 @@ func LoadGFA(fileName string) (*gfa.GFA, error) {
 	return myGFA, nil
 }
 
+// Copy is a method to deep copy a graph store, allowing each copy to be weighted independently
+func (graphStore Store) Copy() Store {
+	newStore := make(Store, len(graphStore))
+	for graphID, grootGraph := range graphStore {
+		newStore[graphID] = grootGraph.Copy()
+	}
+	return newStore
+}
+
 // GetSAMrefs is a method to convert all paths held in graphStore to sam.References
 func (graphStore Store) GetSAMrefs() (map[int][]*sam.Reference, error) {
 	references := make(map[int][]*sam.Reference)
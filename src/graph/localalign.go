@@ -0,0 +1,344 @@
+package graph
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+)
+
+// the scoring used for gapped alignment (these are the BWA-MEM defaults), ungapped alignments are scored the same way
+const (
+	matchScore       = 1
+	mismatchPenalty  = 4
+	gapOpenPenalty   = 6
+	gapExtendPenalty = 1
+)
+
+// DefaultBandwidth is the default band used for gapped alignment, it limits the number of indel bases in an alignment
+const DefaultBandwidth = 10
+
+// ScoreAlignment is a function to score an alignment from its number of matches and mismatches and the length of each gap, using the same scoring as AlignRead
+func ScoreAlignment(matches, mismatches int, gaps []int) int {
+	score := matches*matchScore - mismatches*mismatchPenalty
+	for _, gap := range gaps {
+		score -= gapOpenPenalty + gap*gapExtendPenalty
+	}
+	return score
+}
+
+// poaColumn is a base of the graph in the region used for gapped alignment
+type poaColumn struct {
+	node    *GrootGraphNode
+	offset  int   // the position of the base in the node sequence
+	preds   []int // the columns preceding this one in the graph (empty at the start of the region)
+	minDist int   // the shortest distance (in bases) from the start of the region to this column
+	maxDist int   // the longest distance (in bases) from the start of the region to this column
+}
+
+// poaOp is a step in a gapped alignment traceback
+type poaOp struct {
+	op  sam.CigarOpType // CigarMatch (match or mismatch), CigarInsertion or CigarDeletion
+	col int             // the column (-1 for insertions)
+}
+
+// gappedAlignment is the best local alignment of a read to the region
+type gappedAlignment struct {
+	score     int
+	readStart int     // the first aligned base of the read
+	readEnd   int     // the end of the aligned bases of the read
+	ops       []poaOp // the alignment, in read order
+}
+
+// performGappedAlignment is a method to align a read to the region of the graph following a seed, returning the reference IDs and start positions (as for performAlignment) plus the alignment
+// the read is expected to start between offset and offset+shift bases into the seed node, nothing is returned if the alignment scores below the minimum score
+func (GrootGraph *GrootGraph) performGappedAlignment(nodeLookup int, read []byte, offset, shift int, params AlignmentParams) ([]int, map[int]int, *alignmentResult) {
+	band := params.Bandwidth
+	if band <= 0 {
+		band = DefaultBandwidth
+	}
+	cols, slack := GrootGraph.alignmentRegion(nodeLookup, offset, len(read)+shift, band)
+	alignment := GrootGraph.localAlign(read, cols, slack, shift, band)
+	if alignment == nil || float64(alignment.score) < params.MinScore*float64(len(read)*matchScore) {
+		return nil, nil, nil
+	}
+	path, pathOffset := alignment.traversal(cols)
+	IDs, startPos := GrootGraph.processTraversal([][]uint64{path}, pathOffset)
+	if len(IDs) == 0 {
+		return nil, nil, nil
+	}
+	result := alignment.result(read, cols, params.ExtendedCigar)
+	result.path, result.pathStart = path, pathOffset
+	return IDs, startPos, result
+}
+
+// alignmentRegion is a method to collect the bases of the graph that a read seeded at a node could align to, in topological order
+// the region starts band bases before the seed offset (if the seed node is long enough) and follows every path from the seed node until the length (plus the band) is covered
+func (GrootGraph *GrootGraph) alignmentRegion(nodeLookup, offset, length, band int) ([]poaColumn, int) {
+	start := offset - band
+	if start < 0 {
+		start = 0
+	}
+	maxDist := length + offset - start + band
+	distances := map[uint64][2]int{GrootGraph.SortedNodes[nodeLookup].SegmentID: {0, 0}}
+	inPreds := make(map[uint64][]int)
+	cols := []poaColumn{}
+	for i := nodeLookup; i < len(GrootGraph.SortedNodes); i++ {
+		node := GrootGraph.SortedNodes[i]
+		dist, ok := distances[node.SegmentID]
+		if !ok || dist[0] > maxDist {
+			continue
+		}
+		preds := inPreds[node.SegmentID]
+		nodeStart := 0
+		if i == nodeLookup {
+			nodeStart = start
+		}
+		for j := nodeStart; j < len(node.Sequence); j++ {
+			cols = append(cols, poaColumn{node: node, offset: j, preds: preds, minDist: dist[0], maxDist: dist[1]})
+			preds = []int{len(cols) - 1}
+			dist = [2]int{dist[0] + 1, dist[1] + 1}
+		}
+
+		// pass the last column of this node on to the next nodes
+		for _, next := range node.OutEdges {
+			inPreds[next] = append(inPreds[next], preds...)
+			if nextDist, ok := distances[next]; ok {
+				if dist[0] < nextDist[0] {
+					nextDist[0] = dist[0]
+				}
+				if dist[1] > nextDist[1] {
+					nextDist[1] = dist[1]
+				}
+				distances[next] = nextDist
+			} else {
+				distances[next] = dist
+			}
+		}
+	}
+	return cols, offset - start
+}
+
+// localAlign is a method to run a banded partial-order Smith-Waterman alignment (with affine gaps) of a read to a region of the graph
+// the read is expected to start between slack and slack+shift bases into the region, and only cells within band bases of these diagonals (on any path) are filled
+func (GrootGraph *GrootGraph) localAlign(read []byte, cols []poaColumn, slack, shift, band int) *gappedAlignment {
+	numRows, numCols := len(read)+1, len(cols)
+	if numCols == 0 {
+		return nil
+	}
+	H := make([]int32, numRows*numCols)
+	E := make([]int32, numRows*numCols)
+	F := make([]int32, numRows*numCols)
+	neg := int32(math.MinInt32 / 2)
+	for i := range E {
+		E[i], F[i] = neg, neg
+	}
+	cell := func(i, c int) int { return i*numCols + c }
+	score := func(i, c int) int32 {
+		base := cols[c].node.Sequence[cols[c].offset]
+		if base == read[i-1] || base == 'N' {
+			return matchScore
+		}
+		return -mismatchPenalty
+	}
+
+	// fill the matrices one column at a time (predecessors always come first as the graph is topologically sorted)
+	bestScore, bestRow, bestCol := int32(0), 0, 0
+	for c := 0; c < numCols; c++ {
+		lo, hi := cols[c].minDist-slack-shift-band+1, cols[c].maxDist-slack+band+1
+		if lo < 1 {
+			lo = 1
+		}
+		if hi > numRows-1 {
+			hi = numRows - 1
+		}
+		for i := lo; i <= hi; i++ {
+			diag, e := int32(0), neg
+			for _, p := range cols[c].preds {
+				if H[cell(i-1, p)] > diag {
+					diag = H[cell(i-1, p)]
+				}
+				if v := H[cell(i, p)] - gapOpenPenalty - gapExtendPenalty; v > e {
+					e = v
+				}
+				if v := E[cell(i, p)] - gapExtendPenalty; v > e {
+					e = v
+				}
+			}
+			f := H[cell(i-1, c)] - gapOpenPenalty - gapExtendPenalty
+			if v := F[cell(i-1, c)] - gapExtendPenalty; v > f {
+				f = v
+			}
+			h := diag + score(i, c)
+			if e > h {
+				h = e
+			}
+			if f > h {
+				h = f
+			}
+			if h < 0 {
+				h = 0
+			}
+			H[cell(i, c)], E[cell(i, c)], F[cell(i, c)] = h, e, f
+			if h > bestScore {
+				bestScore, bestRow, bestCol = h, i, c
+			}
+		}
+	}
+	if bestScore == 0 {
+		return nil
+	}
+
+	// traceback from the best cell until the score drops to zero
+	ops := []poaOp{}
+	i, c, state := bestRow, bestCol, sam.CigarMatch
+	for i > 0 {
+		switch state {
+		case sam.CigarMatch:
+			h := H[cell(i, c)]
+			if h == 0 {
+				break
+			}
+			s := score(i, c)
+			if h == s {
+				ops = append(ops, poaOp{op: sam.CigarMatch, col: c})
+				i = 0
+				continue
+			}
+			found := false
+			for _, p := range cols[c].preds {
+				if H[cell(i-1, p)]+s == h {
+					ops = append(ops, poaOp{op: sam.CigarMatch, col: c})
+					i, c, found = i-1, p, true
+					break
+				}
+			}
+			if found {
+				continue
+			}
+			if h == E[cell(i, c)] {
+				state = sam.CigarDeletion
+			} else {
+				state = sam.CigarInsertion
+			}
+			continue
+		case sam.CigarDeletion:
+			ops = append(ops, poaOp{op: sam.CigarDeletion, col: c})
+			e, pred := E[cell(i, c)], -1
+			for _, p := range cols[c].preds {
+				if H[cell(i, p)]-gapOpenPenalty-gapExtendPenalty == e {
+					pred, state = p, sam.CigarMatch
+					break
+				}
+				if E[cell(i, p)]-gapExtendPenalty == e {
+					pred = p
+					break
+				}
+			}
+			if pred == -1 {
+				return nil
+			}
+			c = pred
+			continue
+		case sam.CigarInsertion:
+			ops = append(ops, poaOp{op: sam.CigarInsertion, col: -1})
+			if H[cell(i-1, c)]-gapOpenPenalty-gapExtendPenalty == F[cell(i, c)] {
+				state = sam.CigarMatch
+			}
+			i--
+			continue
+		}
+		break
+	}
+
+	// reverse the traceback and work out where the alignment starts on the read
+	for a, b := 0, len(ops)-1; a < b; a, b = a+1, b-1 {
+		ops[a], ops[b] = ops[b], ops[a]
+	}
+	readStart := bestRow
+	for _, op := range ops {
+		if op.op != sam.CigarDeletion {
+			readStart--
+		}
+	}
+	return &gappedAlignment{score: int(bestScore), readStart: readStart, readEnd: bestRow, ops: ops}
+}
+
+// traversal is a method to get the nodes that a gapped alignment passes through, along with the offset of the alignment in the first node
+func (gappedAlignment *gappedAlignment) traversal(cols []poaColumn) ([]uint64, int) {
+	path := []uint64{}
+	offset := -1
+	for _, op := range gappedAlignment.ops {
+		if op.col == -1 {
+			continue
+		}
+		if offset == -1 {
+			offset = cols[op.col].offset
+		}
+		if node := cols[op.col].node.SegmentID; len(path) == 0 || path[len(path)-1] != node {
+			path = append(path, node)
+		}
+	}
+	return path, offset
+}
+
+// result is a method to get the CIGAR (with soft clipping), edit distance and MD tag for a gapped alignment
+func (gappedAlignment *gappedAlignment) result(read []byte, cols []poaColumn, extended bool) *alignmentResult {
+	result := &alignmentResult{score: gappedAlignment.score}
+	addOp := func(op sam.CigarOpType, n int) {
+		if last := len(result.cigar) - 1; last >= 0 && result.cigar[last].Type() == op {
+			result.cigar[last] = sam.NewCigarOp(op, result.cigar[last].Len()+n)
+			return
+		}
+		result.cigar = append(result.cigar, sam.NewCigarOp(op, n))
+	}
+	if gappedAlignment.readStart != 0 {
+		addOp(sam.CigarSoftClipped, gappedAlignment.readStart)
+	}
+	var md strings.Builder
+	matched := 0
+	readPos := gappedAlignment.readStart
+	for i, op := range gappedAlignment.ops {
+		switch op.op {
+		case sam.CigarMatch:
+			base := cols[op.col].node.Sequence[cols[op.col].offset]
+			match := base == read[readPos] || base == 'N'
+			switch {
+			case !extended:
+				addOp(sam.CigarMatch, 1)
+			case match:
+				addOp(sam.CigarEqual, 1)
+			default:
+				addOp(sam.CigarMismatch, 1)
+			}
+			if match {
+				matched++
+				result.matches++
+			} else {
+				fmt.Fprintf(&md, "%d%c", matched, base)
+				matched = 0
+				result.nm++
+			}
+			readPos++
+		case sam.CigarInsertion:
+			addOp(sam.CigarInsertion, 1)
+			result.nm++
+			readPos++
+		case sam.CigarDeletion:
+			addOp(sam.CigarDeletion, 1)
+			result.nm++
+			if i == 0 || gappedAlignment.ops[i-1].op != sam.CigarDeletion {
+				fmt.Fprintf(&md, "%d^", matched)
+				matched = 0
+			}
+			md.WriteByte(cols[op.col].node.Sequence[cols[op.col].offset])
+		}
+	}
+	fmt.Fprintf(&md, "%d", matched)
+	if end := len(read) - gappedAlignment.readEnd; end != 0 {
+		addOp(sam.CigarSoftClipped, end)
+	}
+	result.md = md.String()
+	return result
+}
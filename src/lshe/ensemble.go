@@ -0,0 +1,179 @@
+package lshe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ekzhu/lshensemble"
+)
+
+// hashValueSize is the number of bytes kept from each sketch value when making the LSH Forest hash keys (the same as lshensemble.NewLshForest32)
+const hashValueSize = 4
+
+// Ensemble is an LSH Ensemble that is built once and saved with the index, so that it doesn't need bootstrapping every time the index is loaded
+// it is laid out the same as the lshensemble LSH Ensemble (equi-depth partitions, each holding an LSH Forest) but the window keys are stored as IDs
+type Ensemble struct {
+	Partitions []lshensemble.Partition // the domain size partitions
+	MaxK       int                     // the number of hash functions per band
+	NumHash    int                     // the number of hash functions in the sketches (sketch size)
+	WindowKeys []string                // the WindowLookup keys, indexed by the window IDs used in the forests
+	Forests    []*Forest               // one LSH Forest per partition
+
+	// unexported
+	tuner      *lshensemble.LshForest // an empty LSH Forest with the same dimensions as the ensemble, used to find the optimal K and L for a query
+	paramCache sync.Map               // caches the optimal K and L for each query size and threshold
+}
+
+// Forest is an LSH Forest, holding a sorted hash table for each band
+type Forest struct {
+	K          int
+	L          int
+	HashTables [][]Bucket
+}
+
+// Bucket holds the windows that share a hash key in an LSH Forest hash table
+type Bucket struct {
+	HashKey string
+	Windows []uint32
+}
+
+// queryParams are the LSH parameters used to query a partition
+type queryParams struct {
+	k, l int
+}
+
+// paramKey is used to cache the query parameters for a partition, query size and threshold
+type paramKey struct {
+	x, q      int
+	threshold float64
+}
+
+// buildEnsemble is a function to build an LSH Ensemble for a set of windows, using equi-depth partitioning
+// the windows are added in order of their keys so that the same windows always give the same ensemble
+func buildEnsemble(windows map[string]Key, numPart, numHash, maxK, windowKmers int) (*Ensemble, error) {
+	if numPart < 1 || maxK < 1 || numHash < maxK {
+		return nil, fmt.Errorf("can't build LSH Ensemble with %d partitions, %d hash functions and maxK of %d", numPart, numHash, maxK)
+	}
+	ensemble := &Ensemble{
+		Partitions: make([]lshensemble.Partition, numPart),
+		MaxK:       maxK,
+		NumHash:    numHash,
+		WindowKeys: make([]string, 0, len(windows)),
+		Forests:    make([]*Forest, numPart),
+	}
+	for windowKey := range windows {
+		ensemble.WindowKeys = append(ensemble.WindowKeys, windowKey)
+	}
+	sort.Strings(ensemble.WindowKeys)
+
+	// all windows are the same size, so the partitions share bounds and each gets an equal share of the windows (the last also gets the remainder)
+	depth := len(ensemble.WindowKeys) / numPart
+	if depth == 0 {
+		depth = 1
+	}
+	tables := make([][]map[string][]uint32, numPart)
+	for i := range tables {
+		ensemble.Partitions[i] = lshensemble.Partition{Lower: windowKmers, Upper: windowKmers}
+		tables[i] = make([]map[string][]uint32, numHash/maxK)
+		for j := range tables[i] {
+			tables[i][j] = make(map[string][]uint32)
+		}
+	}
+	ensemble.Partitions[0].Lower = 0
+	for id, windowKey := range ensemble.WindowKeys {
+		sketch := windows[windowKey].Sketch
+		if len(sketch) < numHash {
+			return nil, fmt.Errorf("window %v has a sketch of size %d, expected %d", windowKey, len(sketch), numHash)
+		}
+		part := id / depth
+		if part >= numPart {
+			part = numPart - 1
+		}
+		for band, table := range tables[part] {
+			hashKey := hashKey(sketch[band*maxK : (band+1)*maxK])
+			table[hashKey] = append(table[hashKey], uint32(id))
+		}
+	}
+
+	// convert the hash tables to sorted buckets
+	for i, partTables := range tables {
+		forest := &Forest{K: maxK, L: numHash / maxK, HashTables: make([][]Bucket, len(partTables))}
+		for band, table := range partTables {
+			buckets := make([]Bucket, 0, len(table))
+			for hashKey, windowIDs := range table {
+				buckets = append(buckets, Bucket{HashKey: hashKey, Windows: windowIDs})
+			}
+			sort.Slice(buckets, func(a, b int) bool { return buckets[a].HashKey < buckets[b].HashKey })
+			forest.HashTables[band] = buckets
+		}
+		ensemble.Forests[i] = forest
+	}
+	ensemble.init()
+	return ensemble, nil
+}
+
+// init is a method to get a built or loaded ensemble ready for querying
+func (Ensemble *Ensemble) init() {
+	Ensemble.tuner = lshensemble.NewLshForest(Ensemble.MaxK, Ensemble.NumHash/Ensemble.MaxK)
+}
+
+// query is a method to get the candidate windows for a query sketch, returning their WindowLookup keys
+func (Ensemble *Ensemble) query(sig []uint64, size int, threshold float64) []string {
+	var candidates []string
+	for i, forest := range Ensemble.Forests {
+		params := Ensemble.params(Ensemble.Partitions[i].Upper, size, threshold)
+		for _, id := range forest.query(sig, params.k, params.l) {
+			candidates = append(candidates, Ensemble.WindowKeys[id])
+		}
+	}
+	return candidates
+}
+
+// params is a method to get the optimal K and L for querying a partition holding domains of size x with a query of size q
+func (Ensemble *Ensemble) params(x, q int, threshold float64) queryParams {
+	key := paramKey{x, q, threshold}
+	if cached, ok := Ensemble.paramCache.Load(key); ok {
+		return cached.(queryParams)
+	}
+	k, l, _, _ := Ensemble.tuner.OptimalKL(x, q, threshold)
+	params := queryParams{k, l}
+	Ensemble.paramCache.Store(key, params)
+	return params
+}
+
+// query is a method to get the windows that share a hash key prefix of length K with the query in any of the first L bands
+func (Forest *Forest) query(sig []uint64, K, L int) []uint32 {
+	prefixSize := hashValueSize * K
+	seen := make(map[uint32]struct{})
+	var windows []uint32
+	for band := 0; band < L; band++ {
+		table := Forest.HashTables[band]
+		hk := hashKey(sig[band*Forest.K : band*Forest.K+K])
+		i := sort.Search(len(table), func(x int) bool {
+			return table[x].HashKey[:prefixSize] >= hk
+		})
+		for ; i < len(table) && table[i].HashKey[:prefixSize] == hk; i++ {
+			for _, id := range table[i].Windows {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+				windows = append(windows, id)
+			}
+		}
+	}
+	return windows
+}
+
+// hashKey is a function to convert a band of a sketch to an LSH Forest hash key, keeping the low bytes of each value
+func hashKey(band []uint64) string {
+	key := make([]byte, hashValueSize*len(band))
+	buf := make([]byte, 8)
+	for i, hv := range band {
+		binary.LittleEndian.PutUint64(buf, hv)
+		copy(key[i*hashValueSize:(i+1)*hashValueSize], buf[:hashValueSize])
+	}
+	return string(key)
+}
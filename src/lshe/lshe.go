@@ -6,11 +6,13 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
-	"os"
-	"runtime"
+	"sort"
 	"sync"
 
 	"github.com/ekzhu/lshensemble"
+	"github.com/will-rowe/groot/src/minhash"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/version"
 )
 
 // Key relates sketches of reads and graph traversals to specific windows of a graph
@@ -20,13 +22,18 @@ type Key struct {
 	OffSet         uint32             // identifies the offset of a window within the first node
 	ContainedNodes map[uint64]float64 // describes the traversal through the graph for the window
 	Ref            []uint32           // the IDs for the reference sequences that contains this window
-	RC             bool               // identifies if the read has been reverse complemented (NOT USED)
+	RC             bool               // identifies if the read is on the reverse strand relative to this window (set when the index is queried)
+	Containment    float64            // the estimated containment of the read in this window (set when the index is queried)
 	Sketch         []uint64           // the sketch of this graph window
+	Strands        []bool             // the orientation of the k-mer that gave each value in the sketch of this graph window
 	Freq           float64            // records the number of k-mers this graph window has received during read mapping
 	MergeSpan      uint32             // indicates maximum distance between graph windows this key represents (used in window merging if sketches identical)
 	WindowSize     uint32             // the size of the window that was sketched (prior to merging)
 }
 
+// indexContent identifies LSH Ensemble index files in the index file header
+const indexContent = "lshe"
+
 // Keys is used to hold multiple keys (and satisfies the sort interface)
 type Keys []Key
 
@@ -36,25 +43,29 @@ func (k Keys) Swap(i, j int)      { k[i], k[j] = k[j], k[i] }
 
 // ContainmentIndex is a wrapper for the LSH Ensemble data structure
 type ContainmentIndex struct {
-	NumPart        int            // NumPart is the number of partitions
-	MaxK           int            // MaxK is the number of hash funcs per band
-	NumWindowKmers int            // NumWindowKmers is the number of k-mers in the graph windows
-	SketchSize     int            // SketchSize is the size of the sketches being indexed (num hash funcs)
-	WindowLookup   map[string]Key // WindowLookup is a map linking windows to a their sketch in the LSH Ensemble
+	NumPart        int               // NumPart is the number of partitions
+	MaxK           int               // MaxK is the number of hash funcs per band
+	NumWindowKmers int               // NumWindowKmers is the number of k-mers in the graph windows
+	SketchSize     int               // SketchSize is the size of the sketches being indexed (num hash funcs)
+	Algorithm      minhash.Algorithm // Algorithm is the MinHash algorithm used to sketch the windows (and which must be used to sketch queries)
+	WindowLookup   map[string]Key    // WindowLookup is a map linking windows to a their sketch in the LSH Ensemble
+	Ensemble       *Ensemble         // Ensemble is the LSH Ensemble index, it is built when the index is dumped (KHF and OPH sketches only)
 
 	// unexported
-	lshEnsemble *lshensemble.LshEnsemble // lshEnsemble is the LSH Ensemble index
-	numSketches int                      // numSketches in the containment index
-	locker      sync.Mutex               // locker to control access to the WindowLookup
+	valueIndex    map[uint64][]string // the windows holding each sketch value, used instead of the LSH Ensemble for KMV sketches
+	numSketches   int                 // numSketches in the containment index
+	formatVersion uint32              // the format version of the index file the index was loaded from
+	locker        sync.Mutex          // locker to control access to the WindowLookup
 }
 
 // InitIndex will get a containment index struct ready
-func InitIndex(numPart, maxK, numWindowKmers, sketchSize int) *ContainmentIndex {
+func InitIndex(numPart, maxK, numWindowKmers, sketchSize int, algorithm minhash.Algorithm) *ContainmentIndex {
 	return &ContainmentIndex{
 		NumPart:        numPart,
 		MaxK:           maxK,
 		NumWindowKmers: numWindowKmers,
 		SketchSize:     sketchSize,
+		Algorithm:      algorithm,
 		WindowLookup:   make(map[string]Key),
 	}
 }
@@ -65,10 +76,32 @@ func (ContainmentIndex *ContainmentIndex) AddWindow(windowLookup string, window
 		return fmt.Errorf("duplicate window key can't be inserted into index: %v", windowLookup)
 	}
 	ContainmentIndex.WindowLookup[windowLookup] = window
+
+	// the LSH Ensemble needs rebuilding to include the new window
+	ContainmentIndex.Ensemble = nil
+	ContainmentIndex.valueIndex = nil
 	return nil
 }
 
-// Dump is a method to write a containment index to disk
+// RemoveGraph will remove all the windows for a graph from a ContainmentIndex, returning the number of windows removed
+func (ContainmentIndex *ContainmentIndex) RemoveGraph(graphID uint32) int {
+	removed := 0
+	for windowLookup, window := range ContainmentIndex.WindowLookup {
+		if window.GraphID == graphID {
+			delete(ContainmentIndex.WindowLookup, windowLookup)
+			removed++
+		}
+	}
+
+	// the LSH Ensemble needs rebuilding without the removed windows
+	if removed != 0 {
+		ContainmentIndex.Ensemble = nil
+		ContainmentIndex.valueIndex = nil
+	}
+	return removed
+}
+
+// Dump is a method to write the containment index to disk, building the LSH Ensemble first if needed
 func (ContainmentIndex *ContainmentIndex) Dump(filePath string) error {
 
 	// make sure it has had the prepare method run
@@ -76,22 +109,37 @@ func (ContainmentIndex *ContainmentIndex) Dump(filePath string) error {
 		return fmt.Errorf("must run PrepareIndex before dumping index to disk")
 	}
 
-	// error if the index has already been loaded once
-	if ContainmentIndex.numSketches != 0 {
-		return fmt.Errorf("this index cannot be dumped a second time")
+	// build the LSH Ensemble so that it is saved with the windows (KMV sketches use the value index instead, which isn't saved)
+	if ContainmentIndex.Algorithm == minhash.KMV {
+		ContainmentIndex.Ensemble = nil
+		ContainmentIndex.valueIndex = buildValueIndex(ContainmentIndex.WindowLookup)
+	} else if ContainmentIndex.Ensemble == nil {
+		var err error
+		ContainmentIndex.Ensemble, err = buildEnsemble(ContainmentIndex.WindowLookup, ContainmentIndex.NumPart, ContainmentIndex.SketchSize, ContainmentIndex.MaxK, ContainmentIndex.NumWindowKmers)
+		if err != nil {
+			return err
+		}
 	}
 
-	// write to disk
-	fh, err := os.Create(filePath)
-	defer fh.Close()
-	if err != nil {
+	// encode the index and write it to disk with a header
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(ContainmentIndex); err != nil {
 		return err
 	}
-	encoder := gob.NewEncoder(fh)
-	return encoder.Encode(ContainmentIndex)
+	header := misc.IndexHeader{
+		Content:  indexContent,
+		Software: version.GetVersion(),
+		Params: misc.IndexParams{
+			SketchSize:      ContainmentIndex.SketchSize,
+			NumPart:         ContainmentIndex.NumPart,
+			MaxK:            ContainmentIndex.MaxK,
+			SketchAlgorithm: string(ContainmentIndex.Algorithm),
+		},
+	}
+	return misc.WriteIndexFile(filePath, header, payload.Bytes())
 }
 
-// Load is a method to load a containment index from disk and populate the LSH Ensemble
+// Load is a method to load a containment index from disk
 func (ContainmentIndex *ContainmentIndex) Load(filePath string) error {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
@@ -105,64 +153,82 @@ func (ContainmentIndex *ContainmentIndex) Load(filePath string) error {
 }
 
 // LoadFromBytes is a method to load the containment index from a byte array
+// the saved LSH Ensemble is used if there is one, otherwise (for index files from before it was saved) the LSH Ensemble is rebuilt from the windows
 func (ContainmentIndex *ContainmentIndex) LoadFromBytes(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buf)
-	var err error
-	if err := decoder.Decode(ContainmentIndex); err != nil {
+
+	// check the header, falling back to the legacy format
+	header, payload, err := misc.ReadIndexFile(data, indexContent)
+	switch {
+	case err == nil:
+		ContainmentIndex.formatVersion = header.FormatVersion
+	case err == misc.ErrLegacyIndex:
+		ContainmentIndex.formatVersion = 0
+		payload = data
+	default:
 		return err
 	}
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(ContainmentIndex); err != nil {
+		return fmt.Errorf("could not decode %v index file: %v", indexContent, err)
+	}
 	ContainmentIndex.numSketches = len(ContainmentIndex.WindowLookup)
+
+	// indexes from before the algorithm was recorded used KHF
+	if ContainmentIndex.Algorithm == "" {
+		ContainmentIndex.Algorithm = minhash.KHF
+	}
 	if ContainmentIndex.numSketches == 0 {
 		return fmt.Errorf("loaded an empty index file")
 	}
 
-	// convert the sketched windows into domain records and a lookup map - put recs into a channel for LSH ensemble bootstrapping
-	// NOTE: not sorting the domain records as all were built using same window size
-	recChan := make(chan *lshensemble.DomainRecord, 100)
-	go func() {
-		i := 0
-		for windowStringKey, window := range ContainmentIndex.WindowLookup {
-
-			// this is a massive kludge to fix the out of memory issue on index load in wasm
-			// see: https://github.com/golang/go/issues/32840#issuecomment-506929883
-			if runtime.GOOS == "js" && i%100000 == 0 {
-				runtime.GC()
-			}
-
-			// send the domain record for this window
-			recChan <- &lshensemble.DomainRecord{
-				windowStringKey,
-				ContainmentIndex.NumWindowKmers,
-				window.Sketch,
-			}
-			i++
-		}
-		close(recChan)
-	}()
-
-	// create index using equi-depth partitioning
-	ContainmentIndex.lshEnsemble, err = lshensemble.BootstrapLshEnsembleEquiDepth(ContainmentIndex.NumPart, ContainmentIndex.SketchSize, ContainmentIndex.MaxK, ContainmentIndex.numSketches, recChan)
+	// KMV sketches use the value index, otherwise use the saved LSH Ensemble or rebuild it for older index files
+	if ContainmentIndex.Algorithm == minhash.KMV {
+		ContainmentIndex.Ensemble = nil
+		ContainmentIndex.valueIndex = buildValueIndex(ContainmentIndex.WindowLookup)
+		return nil
+	}
+	if ContainmentIndex.Ensemble != nil {
+		ContainmentIndex.Ensemble.init()
+		return nil
+	}
+	ContainmentIndex.Ensemble, err = buildEnsemble(ContainmentIndex.WindowLookup, ContainmentIndex.NumPart, ContainmentIndex.SketchSize, ContainmentIndex.MaxK, ContainmentIndex.NumWindowKmers)
 	return err
 }
 
+// FormatVersion is a method to get the format version of the index file that the containment index was loaded from
+func (ContainmentIndex *ContainmentIndex) FormatVersion() uint32 {
+	return ContainmentIndex.formatVersion
+}
+
 // Query wraps the LSH ensemble query method
 // query sig is the sketch
+// query strands are the orientations of the k-mers in the sketch (used to set the RC field of each key returned, can be nil)
 // query size is the number of k-mers in the query sequence
 // containment threshold is the containment threshold...
-func (ContainmentIndex *ContainmentIndex) Query(querySig []uint64, querySize int, containmentThreshold float64) (map[uint32]Keys, error) {
-	done := make(chan struct{})
-	defer close(done)
+func (ContainmentIndex *ContainmentIndex) Query(querySig []uint64, queryStrands []bool, querySize int, containmentThreshold float64) (map[uint32]Keys, error) {
+	if len(querySig) != ContainmentIndex.SketchSize {
+		return nil, fmt.Errorf("query sketch has %d values but the index was built with a sketch size of %d", len(querySig), ContainmentIndex.SketchSize)
+	}
+	var candidates []string
+	switch {
+	case ContainmentIndex.Algorithm == minhash.KMV && ContainmentIndex.valueIndex != nil:
+		candidates = ContainmentIndex.kmvCandidates(querySig)
+	case ContainmentIndex.Algorithm != minhash.KMV && ContainmentIndex.Ensemble != nil:
+		candidates = ContainmentIndex.Ensemble.query(querySig, querySize, containmentThreshold)
+	default:
+		return nil, fmt.Errorf("the LSH Ensemble hasn't been built, the index must be dumped and loaded before it can be queried")
+	}
 	results := make(map[uint32]Keys)
-	for hit := range ContainmentIndex.lshEnsemble.Query(querySig, querySize, containmentThreshold, done) {
-		key, err := ContainmentIndex.getKey(hit.(string))
+	for _, hit := range candidates {
+		key, err := ContainmentIndex.getKey(hit)
 		if err != nil {
 			return nil, err
 		}
 
 		// full containment check
 		// TODO: this should probably be optional but overhead seems minimal
-		if lshensemble.Containment(querySig, key.Sketch, querySize, ContainmentIndex.NumWindowKmers) > containmentThreshold {
+		if containment := ContainmentIndex.containment(querySig, key.Sketch, querySize); containment > containmentThreshold {
+			key.Containment = containment
+			key.RC = reverseStrand(querySig, queryStrands, key)
 			if len(results[key.GraphID]) == 0 {
 				results[key.GraphID] = Keys{key}
 			} else {
@@ -174,6 +240,125 @@ func (ContainmentIndex *ContainmentIndex) Query(querySig []uint64, querySize int
 	return results, nil
 }
 
+// buildValueIndex is a function to index windows by their sketch values, which is used to find the candidate windows for a query when the windows have KMV sketches
+// bottom-k sketches are sorted lists of values, not a minimum for each hash function, so the values at the same position in two sketches aren't comparable and the sketches can't be banded for the LSH Ensemble
+func buildValueIndex(windows map[string]Key) map[uint64][]string {
+	windowKeys := make([]string, 0, len(windows))
+	for windowKey := range windows {
+		windowKeys = append(windowKeys, windowKey)
+	}
+	sort.Strings(windowKeys)
+	valueIndex := make(map[uint64][]string)
+	for _, windowKey := range windowKeys {
+		for _, hv := range windows[windowKey].Sketch {
+			if hv != minhash.EMPTYSLOT {
+				valueIndex[hv] = append(valueIndex[hv], windowKey)
+			}
+		}
+	}
+	return valueIndex
+}
+
+// kmvCandidates is a method to get the windows that share at least one sketch value with a KMV query sketch, returning their WindowLookup keys
+// every window with a containment above zero shares a value with the query, so the containment check can then be used to filter these
+func (ContainmentIndex *ContainmentIndex) kmvCandidates(querySig []uint64) []string {
+	seen := make(map[string]struct{})
+	var candidates []string
+	for _, hv := range querySig {
+		if hv == minhash.EMPTYSLOT {
+			continue
+		}
+		for _, windowKey := range ContainmentIndex.valueIndex[hv] {
+			if _, ok := seen[windowKey]; ok {
+				continue
+			}
+			seen[windowKey] = struct{}{}
+			candidates = append(candidates, windowKey)
+		}
+	}
+	return candidates
+}
+
+// containment is a method to estimate the containment of a query in a graph window, using the estimator for the MinHash algorithm that the index was built with
+func (ContainmentIndex *ContainmentIndex) containment(querySig, windowSig []uint64, querySize int) float64 {
+	if ContainmentIndex.Algorithm != minhash.KMV {
+		return lshensemble.Containment(querySig, windowSig, querySize, ContainmentIndex.NumWindowKmers)
+	}
+
+	// bottom-k sketches are compared by taking the bottom-k of their union, ignoring any empty slots used to pad sketches that aren't at capacity
+	queryMins := make(map[uint64]struct{}, len(querySig))
+	for _, hv := range querySig {
+		if hv != minhash.EMPTYSLOT {
+			queryMins[hv] = struct{}{}
+		}
+	}
+	windowMins := make(map[uint64]struct{}, len(windowSig))
+	for _, hv := range windowSig {
+		if hv != minhash.EMPTYSLOT {
+			windowMins[hv] = struct{}{}
+		}
+	}
+	k := len(queryMins)
+	if len(windowMins) < k {
+		k = len(windowMins)
+	}
+	if k == 0 || querySize == 0 {
+		return 0.0
+	}
+	union := make([]uint64, 0, len(queryMins)+len(windowMins))
+	for hv := range queryMins {
+		union = append(union, hv)
+	}
+	for hv := range windowMins {
+		if _, ok := queryMins[hv]; !ok {
+			union = append(union, hv)
+		}
+	}
+	sort.Slice(union, func(i, j int) bool { return union[i] < union[j] })
+	intersect := 0
+	for _, hv := range union[:k] {
+		_, inQuery := queryMins[hv]
+		_, inWindow := windowMins[hv]
+		if inQuery && inWindow {
+			intersect++
+		}
+	}
+
+	// convert the Jaccard similarity estimate to containment (as lshensemble does for KHF)
+	jaccard := float64(intersect) / float64(k)
+	containment := (float64(ContainmentIndex.NumWindowKmers)/float64(querySize) + 1.0) * jaccard / (1.0 + jaccard)
+	if containment > 1.0 {
+		return 1.0
+	}
+	return containment
+}
+
+// reverseStrand is a function to decide if a query is on the reverse strand relative to a graph window
+// each sketch value shared by the query and the window comes from the same k-mer, so it votes for the reverse strand if the k-mer has a different orientation in the query and the window
+// ties (or missing orientations, e.g. in indexes built before they were recorded) give the forward strand
+func reverseStrand(querySig []uint64, queryStrands []bool, window Key) bool {
+	if len(queryStrands) != len(querySig) || len(window.Strands) != len(window.Sketch) {
+		return false
+	}
+	queryOrientations := make(map[uint64]bool, len(querySig))
+	for i, hv := range querySig {
+		if hv != minhash.EMPTYSLOT {
+			queryOrientations[hv] = queryStrands[i]
+		}
+	}
+	vote := 0
+	for i, hv := range window.Sketch {
+		if strand, ok := queryOrientations[hv]; ok {
+			if strand != window.Strands[i] {
+				vote++
+			} else {
+				vote--
+			}
+		}
+	}
+	return vote > 0
+}
+
 // getKey will return the Key for the stringified version
 func (ContainmentIndex *ContainmentIndex) getKey(keystring string) (Key, error) {
 	ContainmentIndex.locker.Lock()
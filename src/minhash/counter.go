@@ -0,0 +1,74 @@
+package minhash
+
+import (
+	"github.com/will-rowe/nthash"
+)
+
+// bitsPerKmer is the number of Bloom filter bits allocated for each k-mer added to a KmerCounter
+const bitsPerKmer = 8
+
+// maxFilterBits is the maximum size of each Bloom filter used by a KmerCounter (128MB)
+const maxFilterBits = 1 << 30
+
+// KmerCounter uses a pair of Bloom filters to find the k-mers that occur more than once in a set of sequences
+// the first time a k-mer is seen it is added to the seen filter, the second time it is added to the solid filter
+type KmerCounter struct {
+	kmerSize uint
+	seen     *BloomFilter
+	solid    *BloomFilter
+}
+
+// NewKmerCounter is the constructor, the Bloom filters are sized using the total number of k-mers that will be added
+func NewKmerCounter(kmerSize uint, numKmers int) *KmerCounter {
+	size := numKmers * bitsPerKmer
+	if size > maxFilterBits {
+		size = maxFilterBits
+	}
+	return &KmerCounter{
+		kmerSize: kmerSize,
+		seen:     NewBloomFilter(size),
+		solid:    NewBloomFilter(size),
+	}
+}
+
+// AddSequence is a method to decompose a sequence to canonical k-mers and count them
+func (KmerCounter *KmerCounter) AddSequence(sequence []byte) error {
+	if len(sequence) < int(KmerCounter.kmerSize) {
+		return nil
+	}
+	hasher, err := nthash.NewHasher(&sequence, KmerCounter.kmerSize)
+	if err != nil {
+		return err
+	}
+	for hv := range hasher.Hash(CANONICAL) {
+		if KmerCounter.seen.Check(hv) {
+			KmerCounter.solid.Add(hv)
+		} else {
+			KmerCounter.seen.Add(hv)
+		}
+	}
+	return nil
+}
+
+// CountSolid is a method to get the number of k-mers in a sequence that have been seen more than once
+func (KmerCounter *KmerCounter) CountSolid(sequence []byte) (int, error) {
+	if len(sequence) < int(KmerCounter.kmerSize) {
+		return 0, nil
+	}
+	hasher, err := nthash.NewHasher(&sequence, KmerCounter.kmerSize)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for hv := range hasher.Hash(CANONICAL) {
+		if KmerCounter.solid.Check(hv) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// GetFilter is a method to get the Bloom filter holding the k-mers that have been seen more than once
+func (KmerCounter *KmerCounter) GetFilter() *BloomFilter {
+	return KmerCounter.solid
+}
@@ -12,6 +12,8 @@ type KHFsketch struct {
 	kmerSize   uint
 	sketchSize uint
 	sketch     []uint64
+	strands    []bool       // the orientation of the k-mer that gave each minimum in the sketch
+	filter     *BloomFilter // if set, only k-mers in the filter are added to the sketch
 }
 
 // NewKHFsketch is the constructor for a KHFsketch data structure
@@ -28,6 +30,7 @@ func NewKHFsketch(k, s uint) *KHFsketch {
 		kmerSize:   k,
 		sketchSize: s,
 		sketch:     sketch,
+		strands:    make([]bool, s),
 	}
 }
 
@@ -40,17 +43,38 @@ func (KHFsketch *KHFsketch) AddSequence(sequence []byte) error {
 		return err
 	}
 
+	// keep track of which k-mer gave each new minimum, so that its orientation can be recorded
+	minPositions := make([]int, KHFsketch.sketchSize)
+	for i := range minPositions {
+		minPositions[i] = -1
+	}
+
 	// range over the output of the hasher, where each iteration is a set of hash values for a k-mer
+	position := -1
 	for multiHashes := range hasher.MultiHash(CANONICAL, KHFsketch.sketchSize) {
+		position++
+
+		// skip k-mers that aren't in the filter (the first hash value is the canonical ntHash of the k-mer)
+		if KHFsketch.filter != nil && !KHFsketch.filter.Check(multiHashes[0]) {
+			continue
+		}
 
 		// evaluate if each hash value is lower than the existing one in the appropriate sketch position
 		for i, min := range KHFsketch.sketch {
 			if multiHashes[i] < min {
 				KHFsketch.sketch[i] = multiHashes[i]
+				minPositions[i] = position
 			}
 		}
 	}
 
+	// record the orientation of the k-mers that gave the new minimums
+	for i, position := range minPositions {
+		if position != -1 {
+			KHFsketch.strands[i] = reverseStrand(sequence[position : position+int(KHFsketch.kmerSize)])
+		}
+	}
+
 	return nil
 }
 
@@ -59,6 +83,11 @@ func (KHFsketch *KHFsketch) GetSketch() []uint64 {
 	return KHFsketch.sketch
 }
 
+// GetStrands is a method to return the orientation of the k-mer that gave each value in the sketch (true for the reverse strand)
+func (KHFsketch *KHFsketch) GetStrands() []bool {
+	return KHFsketch.strands
+}
+
 // GetSimilarity estimates the similarity between two k-mer sets based on the KHF sketch
 func (mh *KHFsketch) GetSimilarity(mh2 MinHash) (float64, error) {
 
@@ -14,6 +14,8 @@ type KMVsketch struct {
 	sketchSize uint
 	sketch     []uint64
 	heap       *IntHeap
+	strands    map[uint64]bool // the orientation of the k-mer that gave each value in the sketch
+	filter     *BloomFilter    // if set, only k-mers in the filter are added to the sketch
 }
 
 // NewKMVsketch is the constructor for a KMVsketch data structure
@@ -22,6 +24,7 @@ func NewKMVsketch(k, s uint) *KMVsketch {
 		kmerSize:   k,
 		sketchSize: s,
 		heap:       &IntHeap{},
+		strands:    make(map[uint64]bool),
 	}
 
 	// init the heap
@@ -43,12 +46,23 @@ func (KMVsketch *KMVsketch) AddSequence(sequence []byte) error {
 		return err
 	}
 
+	// keep track of which k-mer gave each hash added to the heap, so that its orientation can be recorded
+	positions := make(map[uint64]int)
+
 	// get hashed kmers from sequence and evaluate
+	position := -1
 	for hv := range hasher.Hash(CANONICAL) {
+		position++
+
+		// skip k-mers that aren't in the filter
+		if KMVsketch.filter != nil && !KMVsketch.filter.Check(hv) {
+			continue
+		}
 
 		// if the heap isn't full yet, go ahead and add the hash
 		if len(*KMVsketch.heap) < int(KMVsketch.sketchSize) {
 			heap.Push(KMVsketch.heap, hv)
+			positions[hv] = position
 
 			// re-establish the heap ordering after adding the new hash
 			heap.Fix(KMVsketch.heap, 0)
@@ -57,12 +71,21 @@ func (KMVsketch *KMVsketch) AddSequence(sequence []byte) error {
 		} else if hv < (*KMVsketch.heap)[0] {
 
 			// replace the largest value currently in the sketch with the new hash
+			delete(KMVsketch.strands, (*KMVsketch.heap)[0])
 			(*KMVsketch.heap)[0] = hv
+			positions[hv] = position
 
 			// re-establish the heap ordering after adding the new hash
 			heap.Fix(KMVsketch.heap, 0)
 		}
 	}
+
+	// record the orientation of the k-mers that gave the hashes now in the sketch
+	for _, hv := range *KMVsketch.heap {
+		if position, ok := positions[hv]; ok {
+			KMVsketch.strands[hv] = reverseStrand(sequence[position : position+int(KMVsketch.kmerSize)])
+		}
+	}
 	return nil
 }
 
@@ -74,6 +97,16 @@ func (KMVsketch *KMVsketch) GetSketch() []uint64 {
 	return sketch
 }
 
+// GetStrands is a method to return the orientation of the k-mer that gave each value in the sketch (true for the reverse strand), in the same order as GetSketch
+func (KMVsketch *KMVsketch) GetStrands() []bool {
+	sketch := KMVsketch.GetSketch()
+	strands := make([]bool, len(sketch))
+	for i, hv := range sketch {
+		strands[i] = KMVsketch.strands[hv]
+	}
+	return strands
+}
+
 // GetSimilarity estimates the similarity between two k-mer sets based on the KMV sketch
 func (mh1 *KMVsketch) GetSimilarity(mh2 MinHash) (float64, error) {
 
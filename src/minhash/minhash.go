@@ -1,11 +1,92 @@
-// Package minhash contains implementations of bottom-k and kmv MinHash algorithms. These implementations use the nthash rolling hash function.
+// Package minhash contains implementations of k hash function, bottom-k (kmv) and one permutation MinHash algorithms. These implementations use the nthash rolling hash function.
 package minhash
 
+import (
+	"fmt"
+	"math"
+)
+
 // CANONICAL tell nthash to return the canonical k-mer (this is used in the KMV sketch)
 const CANONICAL bool = true
 
+// EMPTYSLOT is the value used to pad bottom-k sketches that aren't at capacity (nthash can return 0, e.g. for a k-mer of Ns, so the largest value is used)
+const EMPTYSLOT uint64 = math.MaxUint64
+
+// Algorithm identifies the MinHash algorithm used to sketch sequences
+type Algorithm string
+
+// the supported MinHash algorithms
+const (
+	KHF Algorithm = "khf" // K-Hash Functions
+	KMV Algorithm = "kmv" // K-Minimum Values (bottom-k)
+	OPH Algorithm = "oph" // One Permutation Hashing (with densification)
+)
+
+// ParseAlgorithm is a function to get the MinHash algorithm from its name, an empty name gives the default (KHF)
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch Algorithm(name) {
+	case "", KHF:
+		return KHF, nil
+	case KMV:
+		return KMV, nil
+	case OPH:
+		return OPH, nil
+	}
+	return "", fmt.Errorf("unknown MinHash algorithm: %v (must be khf, kmv or oph)", name)
+}
+
 // MinHash is an interface to group the different flavours of MinHash implemented here
 type MinHash interface {
 	AddSequence([]byte) error
 	GetSketch() []uint64
+	GetStrands() []bool
+}
+
+// NewSketch is a function to get an empty MinHash sketch for the specified algorithm
+// if a Bloom filter is provided, only k-mers that are in the filter are added to the sketch
+func NewSketch(algorithm Algorithm, k, s uint, bf *BloomFilter) (MinHash, error) {
+	switch algorithm {
+	case KHF:
+		sketch := NewKHFsketch(k, s)
+		sketch.filter = bf
+		return sketch, nil
+	case KMV:
+		sketch := NewKMVsketch(k, s)
+		sketch.filter = bf
+		return sketch, nil
+	case OPH:
+		sketch := NewOPHsketch(k, s)
+		sketch.filter = bf
+		return sketch, nil
+	}
+	return nil, fmt.Errorf("unknown MinHash algorithm: %v", algorithm)
+}
+
+// complementBases is the lookup table used to compare a k-mer to its reverse complement, lowercase (soft-masked) bases give the uppercase complement as nthash hashes them the same as uppercase bases
+var complementBases = [256]byte{
+	'A': 'T',
+	'T': 'A',
+	'C': 'G',
+	'G': 'C',
+	'N': 'N',
+	'a': 'T',
+	't': 'A',
+	'c': 'G',
+	'g': 'C',
+	'n': 'N',
+}
+
+// reverseStrand is a function to get the orientation of a k-mer, returning true if its reverse complement is lexicographically smaller
+// the reverse complement of a k-mer always has the opposite orientation (odd k-mer sizes can't be palindromic), so comparing the orientations of the k-mer that gave the same sketch value in two sequences tells us if the sequences are on the same strand
+func reverseStrand(kmer []byte) bool {
+	for i, j := 0, len(kmer)-1; i <= j; i, j = i+1, j-1 {
+		base := kmer[i]
+		if base >= 'a' && base <= 'z' {
+			base -= 'a' - 'A'
+		}
+		if rc := complementBases[kmer[j]]; base != rc {
+			return rc < base
+		}
+	}
+	return false
 }
@@ -1,6 +1,8 @@
 package minhash
 
 import (
+	"bytes"
+	"math"
 	"testing"
 
 	"github.com/adam-hanna/arrayOperations"
@@ -76,6 +78,10 @@ func TestMinHashConstructors(t *testing.T) {
 	if mhKMV.sketchSize != sketchSize || mhKMV.kmerSize != kmerSize {
 		t.Fatalf("NewKMVsketch constructor did not initiate MinHash KMV sketch correctly")
 	}
+	mhOPH := NewOPHsketch(kmerSize, sketchSize)
+	if len(mhOPH.GetSketch()) != int(sketchSize) || mhOPH.sketchSize != sketchSize || mhOPH.kmerSize != kmerSize {
+		t.Fatalf("NewOPHsketch constructor did not initiate MinHash OPH sketch correctly")
+	}
 }
 
 // Add test for KHF
@@ -106,6 +112,37 @@ func TestKMVadd(t *testing.T) {
 	if err := mhKMV.AddSequence(seqA); err != nil {
 		t.Fatal(err)
 	}
+
+	// a k-mer of Ns hashes to 0, which shouldn't be mistaken for the padding used for empty slots
+	mhN := NewKMVsketch(kmerSize, sketchSize)
+	if err := mhN.AddSequence([]byte("NNNNNNNN")); err != nil {
+		t.Fatal(err)
+	}
+	if sketch := mhN.GetSketch(); len(sketch) == 0 || sketch[0] == EMPTYSLOT {
+		t.Fatalf("a k-mer of Ns should give a sketch value that isn't an empty slot, got %v", sketch)
+	}
+}
+
+// Add test for OPH
+func TestOPHadd(t *testing.T) {
+	mhOPH := NewOPHsketch(kmerSize, sketchSize)
+
+	// try adding a sequence that is too short for the given k
+	if err := mhOPH.AddSequence(seqA[0:1]); err == nil {
+		t.Fatal("should fault as sequences must be >= kmerSize")
+	}
+
+	// try adding a sequence that passes the length check
+	if err := mhOPH.AddSequence(seqA); err != nil {
+		t.Fatal(err)
+	}
+
+	// densification should have filled any empty bins
+	for _, hv := range mhOPH.GetSketch() {
+		if hv == math.MaxUint64 {
+			t.Fatal("OPH sketch should not have any empty bins after densification")
+		}
+	}
 }
 
 func TestSimilarityEstimates(t *testing.T) {
@@ -146,6 +183,23 @@ func TestSimilarityEstimates(t *testing.T) {
 		t.Fatalf("similarity estimate from KHF MinHash should be 1.0, not: %.2f", khfJS)
 	}
 
+	// test OPH
+	mhOPH1 := NewOPHsketch(kmerSize, sketchSize)
+	if err := mhOPH1.AddSequence(seqA); err != nil {
+		t.Fatal(err)
+	}
+	mhOPH2 := NewOPHsketch(kmerSize, sketchSize)
+	if err := mhOPH2.AddSequence(seqArcomplement); err != nil {
+		t.Fatal(err)
+	}
+	ophJS, err := mhOPH1.GetSimilarity(mhOPH2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ophJS != 1.0 {
+		t.Fatalf("similarity estimate from OPH MinHash should be 1.0, not: %.2f", ophJS)
+	}
+
 	kmvJS, err := mhKMV1.GetSimilarity(mhKMV2)
 	if err != nil {
 		t.Fatal(err)
@@ -156,6 +210,94 @@ func TestSimilarityEstimates(t *testing.T) {
 
 }
 
+// KmerCounter test
+func TestKmerCounter(t *testing.T) {
+	seqB := []byte("TTGACCATGGCAATTCGGATCCTTAGGCAT")
+	counter := NewKmerCounter(kmerSize, 1000)
+
+	// k-mers from seqA are seen twice and k-mers from seqB only once
+	for _, seq := range [][]byte{seqA, seqArcomplement, seqB} {
+		if err := counter.AddSequence(seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count, err := counter.CountSolid(seqA); err != nil || count != len(seqA)-int(kmerSize)+1 {
+		t.Fatalf("all k-mers in seqA should be solid, got %d (err: %v)", count, err)
+	}
+	if count, err := counter.CountSolid(seqB); err != nil || count != 0 {
+		t.Fatalf("no k-mers in seqB should be solid, got %d (err: %v)", count, err)
+	}
+
+	// a filtered sketch of both sequences should only contain k-mers from seqA
+	mhKMV1, err := NewSketch(KMV, kmerSize, sketchSize, counter.GetFilter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mhKMV1.AddSequence(append(append([]byte(nil), seqB...), seqA...)); err != nil {
+		t.Fatal(err)
+	}
+	mhKMV2 := NewKMVsketch(kmerSize, sketchSize)
+	if err := mhKMV2.AddSequence(seqA); err != nil {
+		t.Fatal(err)
+	}
+	sketch1, sketch2 := mhKMV1.GetSketch(), mhKMV2.GetSketch()
+	if len(sketch1) != len(sketch2) {
+		t.Fatalf("filtered sketch has %d hashes, expected %d", len(sketch1), len(sketch2))
+	}
+	for i := range sketch1 {
+		if sketch1[i] != sketch2[i] {
+			t.Fatal("filtered sketch should only contain k-mers from seqA")
+		}
+	}
+}
+
+// Strand test, the sketches of a sequence and its reverse complement should be identical but with every k-mer orientation flipped
+// the test sequence doesn't contain any k-mer more than once in either orientation
+func TestStrands(t *testing.T) {
+	seqB := []byte("CCGTAATGCCTTTCCCTAACAGAGTTTTTCGAACTCGTGT")
+	seqBrcomplement := []byte("ACACGAGTTCGAAAAACTCTGTTAGGGAAAGGCATTACGG")
+	for _, algorithm := range []Algorithm{KHF, KMV, OPH} {
+		mh1, err := NewSketch(algorithm, kmerSize, sketchSize, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mh1.AddSequence(seqB); err != nil {
+			t.Fatal(err)
+		}
+		mh2, err := NewSketch(algorithm, kmerSize, sketchSize, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mh2.AddSequence(seqBrcomplement); err != nil {
+			t.Fatal(err)
+		}
+		sketch1, sketch2 := mh1.GetSketch(), mh2.GetSketch()
+		strands1, strands2 := mh1.GetStrands(), mh2.GetStrands()
+		if len(strands1) != len(sketch1) || len(strands2) != len(sketch2) {
+			t.Fatalf("%v sketch should have an orientation for each value", algorithm)
+		}
+		for i := range sketch1 {
+			if sketch1[i] != sketch2[i] || strands1[i] == strands2[i] {
+				t.Fatalf("%v sketch value %d should be the same k-mer in the opposite orientation", algorithm, i)
+			}
+		}
+
+		// lowercase (soft-masked) sequence should give the same orientations
+		mh3, err := NewSketch(algorithm, kmerSize, sketchSize, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mh3.AddSequence(bytes.ToLower(seqB)); err != nil {
+			t.Fatal(err)
+		}
+		for i, strand := range mh3.GetStrands() {
+			if strand != strands1[i] {
+				t.Fatalf("%v sketch value %d should have the same orientation for lowercase sequence", algorithm, i)
+			}
+		}
+	}
+}
+
 // benchmark KHF
 func BenchmarkKHF(b *testing.B) {
 	mhKHF1 := NewKHFsketch(kmerSize, sketchSize)
@@ -179,3 +321,15 @@ func BenchmarkKMV(b *testing.B) {
 		}
 	}
 }
+
+// benchmark OPH
+func BenchmarkOPH(b *testing.B) {
+	mhOPH1 := NewOPHsketch(kmerSize, sketchSize)
+
+	// run the add method b.N times
+	for n := 0; n < b.N; n++ {
+		if err := mhOPH1.AddSequence(seqA); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
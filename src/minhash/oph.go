@@ -0,0 +1,166 @@
+package minhash
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/will-rowe/nthash"
+)
+
+// OPHsketch is the structure for the One Permutation Hashing MinHash sketch of a set of k-mers
+/* the sketch only needs one hash value per k-mer:
+-1. the hash value range is split into sketchSize bins and each k-mer hash goes to the bin for its high bits
+-2. the minimum hash value is kept for each bin
+-3. empty bins are filled by densification, taking the value of a non-empty bin picked using a hash of the empty bin's number
+*/
+type OPHsketch struct {
+	kmerSize   uint
+	sketchSize uint
+	bins       []uint64     // the minimum hash value in each bin (math.MaxUint64 if empty)
+	strands    []bool       // the orientation of the k-mer that gave the minimum in each bin
+	filter     *BloomFilter // if set, only k-mers in the filter are added to the sketch
+}
+
+// NewOPHsketch is the constructor for an OPHsketch data structure
+func NewOPHsketch(k, s uint) *OPHsketch {
+
+	// init the bins with maximum values
+	bins := make([]uint64, s)
+	for i := range bins {
+		bins[i] = math.MaxUint64
+	}
+
+	// return the data structure
+	return &OPHsketch{
+		kmerSize:   k,
+		sketchSize: s,
+		bins:       bins,
+		strands:    make([]bool, s),
+	}
+}
+
+// AddSequence is a method to decompose a read to canonical kmers, hash them and add any minimums to the sketch
+func (OPHsketch *OPHsketch) AddSequence(sequence []byte) error {
+
+	// check the sequence length
+	if len(sequence) < int(OPHsketch.kmerSize) {
+		return fmt.Errorf("sequence length (%d) is short than k-mer length (%d)", len(sequence), OPHsketch.kmerSize)
+	}
+
+	// initiate the rolling nthash
+	hasher, err := nthash.NewHasher(&sequence, OPHsketch.kmerSize)
+	if err != nil {
+		return err
+	}
+
+	// keep track of which k-mer gave each new minimum, so that its orientation can be recorded
+	minPositions := make(map[uint64]int)
+
+	// get hashed kmers from sequence and evaluate
+	position := -1
+	for hv := range hasher.Hash(CANONICAL) {
+		position++
+
+		// skip k-mers that aren't in the filter
+		if OPHsketch.filter != nil && !OPHsketch.filter.Check(hv) {
+			continue
+		}
+
+		// the bin is given by the high bits of the hash value, so the hash values in a bin are still uniformly ordered
+		bin, _ := bits.Mul64(hv, uint64(OPHsketch.sketchSize))
+		if hv < OPHsketch.bins[bin] {
+			OPHsketch.bins[bin] = hv
+			minPositions[bin] = position
+		}
+	}
+
+	// record the orientation of the k-mers that gave the new minimums
+	for bin, position := range minPositions {
+		OPHsketch.strands[bin] = reverseStrand(sequence[position : position+int(OPHsketch.kmerSize)])
+	}
+	return nil
+}
+
+// densify is a method to get the sketch and k-mer orientations, with any empty bins filled by borrowing from a non-empty bin
+// each empty bin probes the other bins in a pseudo-random order that only depends on the bin number (optimal densification), so two sketches borrow from the same bins
+func (OPHsketch *OPHsketch) densify() ([]uint64, []bool) {
+	sketch := make([]uint64, OPHsketch.sketchSize)
+	strands := make([]bool, OPHsketch.sketchSize)
+	copy(sketch, OPHsketch.bins)
+	copy(strands, OPHsketch.strands)
+	filled := false
+	for _, hv := range OPHsketch.bins {
+		if hv != math.MaxUint64 {
+			filled = true
+			break
+		}
+	}
+	if !filled {
+		return sketch, strands
+	}
+	for i := range sketch {
+		if OPHsketch.bins[i] != math.MaxUint64 {
+			continue
+		}
+		for attempt := uint64(1); ; attempt++ {
+			j, _ := bits.Mul64(mix64(uint64(i)<<32|attempt), uint64(OPHsketch.sketchSize))
+			if OPHsketch.bins[j] != math.MaxUint64 {
+				sketch[i] = OPHsketch.bins[j]
+				strands[i] = OPHsketch.strands[j]
+				break
+			}
+		}
+	}
+	return sketch, strands
+}
+
+// mix64 is a function to scramble a 64 bit integer (the splitmix64 finalizer), it is used to pick the bins to borrow from during densification
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// GetSketch is a method to return the densified sketch held by a MinHash OPH sketch object
+func (OPHsketch *OPHsketch) GetSketch() []uint64 {
+	sketch, _ := OPHsketch.densify()
+	return sketch
+}
+
+// GetStrands is a method to return the orientation of the k-mer that gave each value in the sketch (true for the reverse strand)
+func (OPHsketch *OPHsketch) GetStrands() []bool {
+	_, strands := OPHsketch.densify()
+	return strands
+}
+
+// GetSimilarity estimates the similarity between two k-mer sets based on the OPH sketch
+func (mh *OPHsketch) GetSimilarity(mh2 MinHash) (float64, error) {
+
+	// check this is a pair of OPH
+	if fmt.Sprintf("%T", mh) != fmt.Sprintf("%T", mh2) {
+		return 0.0, fmt.Errorf("mismatched MinHash types: %T vs. %T", mh, mh2)
+	}
+	querySketch, ok := mh2.(*OPHsketch)
+	if !ok {
+		return 0.0, fmt.Errorf("could not assert sketch is an OPH")
+	}
+
+	// check sketch lengths match
+	if mh.sketchSize != querySketch.sketchSize {
+		return 0.0, fmt.Errorf("sketches do not have the same number of bins: %d vs %d", mh.sketchSize, querySketch.sketchSize)
+	}
+
+	// find intersection
+	sketch1, sketch2 := mh.GetSketch(), querySketch.GetSketch()
+	intersect := 0
+	for i := range sketch1 {
+		if sketch1[i] == sketch2[i] {
+			intersect++
+		}
+	}
+
+	// return jaccard similarity estimate
+	return float64(intersect) / float64(mh.sketchSize), nil
+}
@@ -0,0 +1,132 @@
+package misc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// IndexFormatVersion is the version of the index file format written by this version of GROOT
+// index files are compatible if they have the same format version, regardless of the version of GROOT that wrote them
+/* format history:
+-0. raw gob dump of the graph store / LSH Ensemble windows
+-1. both index files have a header (magic, format version, parameter block, payload length and checksum) and the LSH Ensemble is saved
+*/
+const IndexFormatVersion uint32 = 1
+
+// indexMagic marks the start of a GROOT index file
+var indexMagic = []byte("GROOTIDX")
+
+// ErrLegacyIndex is returned when an index file doesn't have a header, i.e. it was written before the header was introduced
+var ErrLegacyIndex = errors.New("index file is in a legacy format")
+
+// IndexParams are the parameters used to build an index, they are stored in the index file headers so that they can be checked without decoding the index
+type IndexParams struct {
+	KmerSize        int    `json:"kmerSize,omitempty"`
+	SketchSize      int    `json:"sketchSize,omitempty"`
+	WindowSize      int    `json:"windowSize,omitempty"`
+	NumPart         int    `json:"numPart,omitempty"`
+	MaxK            int    `json:"maxK,omitempty"`
+	MaxSketchSpan   int    `json:"maxSketchSpan,omitempty"`
+	SketchAlgorithm string `json:"sketchAlgorithm,omitempty"`
+}
+
+// IndexHeader is the header of an index file
+type IndexHeader struct {
+	FormatVersion uint32      `json:"-"`
+	Content       string      `json:"content"`  // what the file holds (e.g. the graph store or the LSH Ensemble)
+	Software      string      `json:"software"` // the version of GROOT that wrote the file
+	Params        IndexParams `json:"params"`
+}
+
+// WriteIndexFile is a function to write an index file, the file is written to a temporary file first and then renamed, so an existing index isn't left half written
+/* the layout is:
+-1. magic (8 bytes)
+-2. format version (uint32)
+-3. length of the parameter block (uint32) and the parameter block (JSON)
+-4. length of the payload (uint64)
+-5. CRC32 checksum of the parameter block and payload (uint32)
+-6. the payload
+*/
+func WriteIndexFile(path string, header IndexHeader, payload []byte) error {
+	block, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	checksum := crc32.NewIEEE()
+	checksum.Write(block)
+	checksum.Write(payload)
+	var buf bytes.Buffer
+	buf.Write(indexMagic)
+	binary.Write(&buf, binary.LittleEndian, IndexFormatVersion)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(block)))
+	buf.Write(block)
+	binary.Write(&buf, binary.LittleEndian, uint64(len(payload)))
+	binary.Write(&buf, binary.LittleEndian, checksum.Sum32())
+	fh, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fh.Name())
+	if _, err := buf.WriteTo(fh); err != nil {
+		fh.Close()
+		return err
+	}
+	if _, err := fh.Write(payload); err != nil {
+		fh.Close()
+		return err
+	}
+	if err := fh.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fh.Name(), path)
+}
+
+// ReadIndexFile is a function to check the header of an index file, returning the header and the payload
+// ErrLegacyIndex is returned for files without a header, otherwise an error is returned if the file holds the wrong content, is from a newer format, is truncated or fails the checksum
+func ReadIndexFile(data []byte, content string) (*IndexHeader, []byte, error) {
+	if !bytes.HasPrefix(data, indexMagic) {
+		return nil, nil, ErrLegacyIndex
+	}
+	truncated := fmt.Errorf("%v index file is truncated", content)
+	data = data[len(indexMagic):]
+	if len(data) < 8 {
+		return nil, nil, truncated
+	}
+	header := &IndexHeader{FormatVersion: binary.LittleEndian.Uint32(data)}
+	if header.FormatVersion > IndexFormatVersion {
+		return nil, nil, fmt.Errorf("%v index file format (v%d) is newer than this version of GROOT can read (v%d), please update GROOT", content, header.FormatVersion, IndexFormatVersion)
+	}
+	blockLength := int(binary.LittleEndian.Uint32(data[4:]))
+	data = data[8:]
+	if len(data) < blockLength+12 {
+		return nil, nil, truncated
+	}
+	block := data[:blockLength]
+	payloadLength := binary.LittleEndian.Uint64(data[blockLength:])
+	expected := binary.LittleEndian.Uint32(data[blockLength+8:])
+	payload := data[blockLength+12:]
+	if uint64(len(payload)) < payloadLength {
+		return nil, nil, truncated
+	}
+	payload = payload[:payloadLength]
+	checksum := crc32.NewIEEE()
+	checksum.Write(block)
+	checksum.Write(payload)
+	if checksum.Sum32() != expected {
+		return nil, nil, fmt.Errorf("%v index file is corrupt (checksum mismatch)", content)
+	}
+	if err := json.Unmarshal(block, header); err != nil {
+		return nil, nil, fmt.Errorf("could not read %v index file header: %v", content, err)
+	}
+	if header.Content != content {
+		return nil, nil, fmt.Errorf("expected a %v index file but got a %v index file", content, header.Content)
+	}
+	return header, payload, nil
+}
@@ -103,13 +103,13 @@ func CheckFile(file string) error {
 	return nil
 }
 
+// CompressionExts are the extensions used for compressed files (the compression format is detected from the file contents, these are just skipped when checking extensions)
+var CompressionExts = []string{"gz", "bgz", "bz2", "zst", "xz"}
+
 // CheckExt is a function to check the extensions of a file
 func CheckExt(file string, exts []string) error {
-	splitFilename := strings.Split(file, ".")
+	splitFilename := strings.Split(TrimCompressionExt(file), ".")
 	finalIdx := len(splitFilename) - 1
-	if splitFilename[finalIdx] == "gz" {
-		finalIdx--
-	}
 	err := fmt.Errorf("file does not have recognised extension: %v", file)
 	for _, ext := range exts {
 		if splitFilename[finalIdx] == ext {
@@ -120,6 +120,16 @@ func CheckExt(file string, exts []string) error {
 	return err
 }
 
+// TrimCompressionExt is a function to remove a compression extension from a file name
+func TrimCompressionExt(file string) string {
+	for _, ext := range CompressionExts {
+		if strings.HasSuffix(file, "."+ext) {
+			return strings.TrimSuffix(file, "."+ext)
+		}
+	}
+	return file
+}
+
 // Uint64SliceEqual returns true if two uint64[] are identical
 func Uint64SliceEqual(a []uint64, b []uint64) bool {
 	if len(a) != len(b) {
@@ -4,6 +4,7 @@ import (
 	"os"
 	"testing"
 
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/version"
 )
 
@@ -21,6 +22,9 @@ var fastq = []string{"test-data/test-reads-OXA90-OXA106-100bp-with-errors.fastq"
 // test reads derived from bla-OXA-90 only, simulated with sequencing errors
 //var fastq = []string{"test-data/test-reads-OXA90-100bp-50x-with-errors.fastq"}
 
+// paired-end test reads (R1/R2) derived from bla-OXA-90, simulated without sequencing errors
+var pairedFastq = []string{"test-data/test-reads-OXA90-paired_R1.fastq", "test-data/test-reads-OXA90-paired_R2.fastq"}
+
 // the GFA produced by the sketch test
 var gfaList = []string{"test-data/tmp/groot-graph-0.gfa"}
 
@@ -39,6 +43,7 @@ var testParameters = &Info{
 	MaxK:                 4,
 	MaxSketchSpan:        30,
 	ContainmentThreshold: 0.99,
+	SketchAlgorithm:      minhash.KHF,
 	IndexDir:             "test-data/tmp",
 	Sketch: AlignCmd{
 		MinKmerCoverage: 10,
@@ -1,7 +1,17 @@
 package pipeline
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/seqio"
 )
 
 func TestIndexBuild(t *testing.T) {
@@ -16,7 +26,11 @@ func TestIndexBuild(t *testing.T) {
 	sketchIndexer := NewSketchIndexer(testParameters)
 
 	// connect the pipeline processes
-	msaConverter.Connect(msaList)
+	msaToBuild, err := testParameters.AssignGraphIDs(msaList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msaConverter.Connect(msaToBuild)
 	graphSketcher.Connect(msaConverter)
 	sketchIndexer.Connect(graphSketcher)
 
@@ -34,15 +48,431 @@ func TestIndexBuild(t *testing.T) {
 	}
 }
 
+// TestIndexFormat checks that the saved LSH Ensemble is loaded, that corrupt index files are refused and that the LSH Ensemble is rebuilt for index files in the older format
+func TestIndexFormat(t *testing.T) {
+	data, err := ioutil.ReadFile("test-data/tmp/groot.lshe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.LoadFromBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	if index.FormatVersion() != misc.IndexFormatVersion || index.Ensemble == nil {
+		t.Fatal("the saved LSH Ensemble should have been loaded")
+	}
+
+	// flip a bit in the encoded index
+	corrupt := append([]byte(nil), data...)
+	corrupt[len(corrupt)-1] ^= 1
+	if err := new(lshe.ContainmentIndex).LoadFromBytes(corrupt); err == nil {
+		t.Fatal("a corrupt index file should be refused")
+	}
+	if err := new(lshe.ContainmentIndex).LoadFromBytes(data[:len(data)/2]); err == nil {
+		t.Fatal("a truncated index file should be refused")
+	}
+
+	// older index files were the gob encoded index without the LSH Ensemble or a header
+	ensemble := index.Ensemble
+	index.Ensemble = nil
+	var legacy bytes.Buffer
+	if err := gob.NewEncoder(&legacy).Encode(index); err != nil {
+		t.Fatal(err)
+	}
+	rebuiltIndex := &lshe.ContainmentIndex{}
+	if err := rebuiltIndex.LoadFromBytes(legacy.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if rebuiltIndex.FormatVersion() != 0 {
+		t.Fatalf("a legacy index file should be reported as format v0, got v%d", rebuiltIndex.FormatVersion())
+	}
+	if !reflect.DeepEqual(rebuiltIndex.Ensemble.Forests, ensemble.Forests) || !reflect.DeepEqual(rebuiltIndex.Ensemble.WindowKeys, ensemble.WindowKeys) {
+		t.Fatal("the rebuilt LSH Ensemble does not match the saved one")
+	}
+
+	// the graph store has the same header and older graph stores can still be loaded
+	info := new(Info)
+	if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	if info.FormatVersion() != misc.IndexFormatVersion {
+		t.Fatalf("expected graph store format v%d, got v%d", misc.IndexFormatVersion, info.FormatVersion())
+	}
+	graphData, err := ioutil.ReadFile("test-data/tmp/groot.gg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := new(lshe.ContainmentIndex).LoadFromBytes(graphData); err == nil {
+		t.Fatal("a graph store should not load as an LSH Ensemble index")
+	}
+	legacy.Reset()
+	if err := gob.NewEncoder(&legacy).Encode(info); err != nil {
+		t.Fatal(err)
+	}
+	legacyInfo := new(Info)
+	if err := legacyInfo.LoadFromBytes(legacy.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if legacyInfo.FormatVersion() != 0 || legacyInfo.KmerSize != info.KmerSize || len(legacyInfo.Store) != len(info.Store) {
+		t.Fatal("the legacy graph store was not loaded correctly")
+	}
+}
+
+// TestIndexUpdate checks that clusters can be added to and replaced in an existing index, leaving the other clusters alone
+func TestIndexUpdate(t *testing.T) {
+	info := new(Info)
+	if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	originalGraph := info.Store[0]
+	numWindows := len(index.WindowLookup)
+
+	// unchanged clusters are skipped
+	msaToBuild, err := info.AssignGraphIDs(msaList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msaToBuild) != 0 {
+		t.Fatal("an unchanged cluster should not be rebuilt")
+	}
+
+	// older indexes didn't record their MSA files, so clusters are matched to graphs by their sequences
+	legacyInfo := &Info{Store: info.Store.Copy()}
+	msaToBuild, err = legacyInfo.AssignGraphIDs(msaList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msaToBuild) != 1 || legacyInfo.Clusters["test-genes.msa"].GraphID != 0 {
+		t.Fatal("the cluster should have been matched to graph 0 of an older index")
+	}
+
+	// add a new cluster, made from a subset of the test MSA
+	data, err := ioutil.ReadFile(msaList[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := bytes.Split(bytes.TrimSpace(data), []byte("\n>"))
+	newMSA := "test-data/tmp/cluster-new.msa"
+	writeMSA := func(numSeqs int) {
+		if err := ioutil.WriteFile(newMSA, append(bytes.Join(records[:numSeqs], []byte("\n>")), '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMSA(40)
+	runUpdate := func(msaFiles []string) int {
+		msaToBuild, err := info.AssignGraphIDs(msaFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(msaToBuild) != 0 {
+			indexingPipeline := NewPipeline()
+			msaConverter := NewMSAconverter(info)
+			graphSketcher := NewGraphSketcher(info)
+			sketchIndexer := NewSketchIndexer(info)
+			msaConverter.Connect(msaToBuild)
+			graphSketcher.Connect(msaConverter)
+			sketchIndexer.Connect(graphSketcher)
+			indexingPipeline.AddProcesses(msaConverter, graphSketcher, sketchIndexer)
+			indexingPipeline.Run()
+		}
+		return len(msaToBuild)
+	}
+	if runUpdate(append(msaList, newMSA)) != 1 {
+		t.Fatal("only the new cluster should have been built")
+	}
+	if len(info.Store) != 2 || info.Clusters["cluster-new.msa"].GraphID != 1 || info.Store[0] != originalGraph {
+		t.Fatal("the new cluster should have been added as graph 1, leaving graph 0 alone")
+	}
+	windowsPerGraph := func() map[uint32]int {
+		counts := make(map[uint32]int)
+		for _, window := range info.db.WindowLookup {
+			counts[window.GraphID]++
+		}
+		return counts
+	}
+	addedWindows := windowsPerGraph()
+	if addedWindows[0] != numWindows || addedWindows[1] == 0 {
+		t.Fatalf("windows were not added correctly: %v", addedWindows)
+	}
+
+	// change the new cluster so that it is replaced
+	writeMSA(20)
+	if runUpdate([]string{newMSA}) != 1 {
+		t.Fatal("the changed cluster should have been rebuilt")
+	}
+	replacedWindows := windowsPerGraph()
+	if len(info.Store) != 2 || info.Store[0] != originalGraph || replacedWindows[0] != numWindows || len(info.Store[1].Paths) != 20 {
+		t.Fatalf("the changed cluster should have replaced graph 1, leaving graph 0 alone (windows: %v)", replacedWindows)
+	}
+	if replacedWindows[1] == 0 || replacedWindows[1] == addedWindows[1] {
+		t.Fatalf("the windows for the changed cluster were not replaced: %v", replacedWindows)
+	}
+
+	// remove the new cluster, as if its MSA file had been deleted
+	removed := info.RemoveMissingClusters(msaList)
+	if len(removed) != 1 || removed[0] != "cluster-new.msa" || len(info.Store) != 1 || info.Store[0] != originalGraph {
+		t.Fatalf("only the new cluster should have been removed: %v", removed)
+	}
+	if remainingWindows := windowsPerGraph(); remainingWindows[0] != numWindows || remainingWindows[1] != 0 {
+		t.Fatalf("the windows for the removed cluster were not removed: %v", remainingWindows)
+	}
+
+	// the MSA converter should assign a graph ID to an MSA file that hasn't been through AssignGraphIDs
+	indexingPipeline := NewPipeline()
+	msaConverter := NewMSAconverter(info)
+	graphSketcher := NewGraphSketcher(info)
+	sketchIndexer := NewSketchIndexer(info)
+	msaConverter.Connect([]string{newMSA})
+	graphSketcher.Connect(msaConverter)
+	sketchIndexer.Connect(graphSketcher)
+	indexingPipeline.AddProcesses(msaConverter, graphSketcher, sketchIndexer)
+	indexingPipeline.Run()
+	if cluster, ok := info.Clusters["cluster-new.msa"]; !ok || len(info.Store) != 2 || info.Store[cluster.GraphID] == nil {
+		t.Fatal("the MSA converter did not assign a graph ID to the new cluster")
+	}
+
+	// remove the original cluster and add a copy of it under a new name, which leaves a gap in the graph IDs
+	info.RemoveMissingClusters([]string{newMSA})
+	copyMSA := "test-data/tmp/cluster-copy.msa"
+	if err := ioutil.WriteFile(copyMSA, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if runUpdate([]string{newMSA, copyMSA}) != 1 {
+		t.Fatal("only the copied cluster should have been built")
+	}
+	if _, ok := info.Store[0]; ok || len(info.Store) != 2 || info.Clusters["cluster-copy.msa"].GraphID != 2 {
+		t.Fatal("the copied cluster should have been added as graph 2, leaving graph 0 unused")
+	}
+
+	// reads should still map to the updated index, once it has been saved and loaded again
+	if err := info.SaveDB("test-data/tmp/update.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.Dump("test-data/tmp/update.gg"); err != nil {
+		t.Fatal(err)
+	}
+	info = new(Info)
+	if err := info.Load("test-data/tmp/update.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index = &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/update.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	info.NumProc = 1
+	info.ContainmentThreshold = testParameters.ContainmentThreshold
+	info.Sketch = AlignCmd{MinKmerCoverage: 10, BAMout: "test-data/tmp/update.bam"}
+	alignmentPipeline := NewPipeline()
+	dataStream := NewDataStreamer(info)
+	fastqHandler := NewFastqHandler(info)
+	fastqChecker := NewFastqChecker(info)
+	readMapper := NewReadMapper(info)
+	graphPruner := NewGraphPruner(info, false)
+	dataStream.Connect(fastq)
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner)
+	alignmentPipeline.Run()
+	if readStats := readMapper.CollectReadStats(); readStats[1] == 0 {
+		t.Fatalf("no reads mapped to the updated index: %v", readStats)
+	}
+}
+
+// TestIndexMerge checks that indexes can be merged, without their graph IDs or window lookups colliding
+func TestIndexMerge(t *testing.T) {
+	loadIndex := func() *Info {
+		info := new(Info)
+		if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+			t.Fatal(err)
+		}
+		index := &lshe.ContainmentIndex{}
+		if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+			t.Fatal(err)
+		}
+		if err := info.AttachDB(index); err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	indexA, indexB := loadIndex(), loadIndex()
+	numWindows := len(indexA.db.WindowLookup)
+	merged, err := MergeIndexes([]*Info{indexA, indexB}, []string{"dbA", "dbB"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Store) != 2 || merged.Store[0].Database != "dbA" || merged.Store[1].Database != "dbB" {
+		t.Fatal("the merged index should have a graph from each database")
+	}
+	if len(merged.db.WindowLookup) != 2*numWindows {
+		t.Fatalf("expected %d windows in the merged index, got %d", 2*numWindows, len(merged.db.WindowLookup))
+	}
+	for windowLookup, window := range merged.db.WindowLookup {
+		if merged.Store[window.GraphID].GraphID != window.GraphID || !strings.HasPrefix(windowLookup, fmt.Sprintf("g%dn", window.GraphID)) {
+			t.Fatalf("window %v does not match its graph", windowLookup)
+		}
+	}
+	if err := merged.SaveDB("test-data/tmp/merged.lshe"); err != nil {
+		t.Fatal(err)
+	}
+
+	// indexes built with different parameters can't be merged
+	indexC := loadIndex()
+	indexC.KmerSize++
+	if _, err := MergeIndexes([]*Info{loadIndex(), indexC}, []string{"dbA", "dbC"}); err == nil {
+		t.Fatal("indexes with different k-mer sizes should not be merged")
+	}
+}
+
+// TestInspect checks that the index report can be filtered by graph and reference sequence
+func TestInspect(t *testing.T) {
+	info := new(Info)
+	if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	report, err := info.Inspect(nil, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Graphs) != 1 || len(report.Windows) != 0 || report.Params.KmerSize != testParameters.KmerSize {
+		t.Fatal("report should describe the single graph and no windows")
+	}
+	graphReport := report.Graphs[0]
+	if graphReport.DistinctSketches != len(index.WindowLookup) || graphReport.NumWindows < graphReport.DistinctSketches || len(graphReport.Paths) != len(info.Store[0].Paths) {
+		t.Fatalf("graph stats are wrong: %+v", graphReport)
+	}
+
+	// filter the windows by reference sequence
+	report, err = info.Inspect(nil, []string{"OXA-90~"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Windows) == 0 || len(report.Windows) >= len(index.WindowLookup) {
+		t.Fatalf("expected a subset of the windows for OXA-90, got %d of %d", len(report.Windows), len(index.WindowLookup))
+	}
+	for _, window := range report.Windows {
+		found := false
+		for _, ref := range window.Refs {
+			found = found || strings.Contains(ref, "OXA-90~")
+		}
+		if !found {
+			t.Fatalf("window %v is not from OXA-90: %v", window.Lookup, window.Refs)
+		}
+	}
+	if report, err = info.Inspect(nil, []string{"not-a-reference"}, true); err != nil || len(report.Graphs) != 0 || len(report.Windows) != 0 {
+		t.Fatal("nothing should be reported for an unknown reference")
+	}
+	if _, err := info.Inspect([]uint32{42}, nil, false); err == nil {
+		t.Fatal("an unknown graph ID should give an error")
+	}
+}
+
+func TestQuerySequence(t *testing.T) {
+	info := new(Info)
+	if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	info.ContainmentThreshold = testParameters.ContainmentThreshold
+
+	// a sketch of the wrong size (e.g. made with a different -s) should be refused rather than crash the query
+	if _, err := index.Query(make([]uint64, index.SketchSize-1), nil, 70, info.ContainmentThreshold); err == nil {
+		t.Fatal("a query sketch of the wrong size should be refused")
+	}
+
+	// a read from OXA-90, followed by its reverse complement
+	query, err := seqio.NewFASTQread([]byte("@query"), []byte("TACCTGCTTCGACCTTCAAAATGCTTAATGCTTTGATCGGCCTTGAGCACCATAAGGCAACCACCACAGAAGTATTTAAGTGGGATGGTAAAAAAAGGTT"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range []bool{false, true} {
+		if rc {
+			query.RevComplement()
+		}
+		hits, err := info.QuerySequence(query, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) == 0 {
+			t.Fatal("query should hit the graph")
+		}
+		for i, hit := range hits {
+			if hit.Query != "query" || hit.QueryStart != 0 || hit.QueryEnd != len(query.Seq) || hit.RC != rc || hit.Containment < info.ContainmentThreshold || len(hit.Refs) == 0 {
+				t.Fatalf("bad hit: %+v", hit)
+			}
+			if i > 0 && hit.Containment > hits[i-1].Containment {
+				t.Fatal("hits are not sorted by containment")
+			}
+		}
+		if len(hits[0].Alignments) == 0 {
+			t.Fatal("top hit should align to the graph")
+		}
+	}
+	if _, err := info.QuerySequence(&seqio.FASTQread{Sequence: seqio.Sequence{ID: []byte("@short"), Seq: []byte("ACGT")}}, false); err == nil {
+		t.Fatal("a query shorter than the k-mer size should give an error")
+	}
+}
+
+// benchmark index loading
+func BenchmarkIndexLoading(b *testing.B) {
+	data, err := ioutil.ReadFile("test-data/tmp/groot.lshe")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for n := 0; n < b.N; n++ {
+		index := &lshe.ContainmentIndex{}
+		if err := index.LoadFromBytes(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 // benchmark indexing
 func BenchmarkIndexing(b *testing.B) {
 	// run the add method b.N times
 	for n := 0; n < b.N; n++ {
+		info := &Info{
+			KmerSize:        testParameters.KmerSize,
+			SketchSize:      testParameters.SketchSize,
+			WindowSize:      testParameters.WindowSize,
+			NumPart:         testParameters.NumPart,
+			MaxK:            testParameters.MaxK,
+			MaxSketchSpan:   testParameters.MaxSketchSpan,
+			SketchAlgorithm: testParameters.SketchAlgorithm,
+		}
+		msaToBuild, err := info.AssignGraphIDs(msaList)
+		if err != nil {
+			b.Fatal(err)
+		}
 		indexingPipeline := NewPipeline()
-		msaConverter := NewMSAconverter(testParameters)
-		graphSketcher := NewGraphSketcher(testParameters)
-		sketchIndexer := NewSketchIndexer(testParameters)
-		msaConverter.Connect(msaList)
+		msaConverter := NewMSAconverter(info)
+		graphSketcher := NewGraphSketcher(info)
+		sketchIndexer := NewSketchIndexer(info)
+		msaConverter.Connect(msaToBuild)
 		graphSketcher.Connect(msaConverter)
 		sketchIndexer.Connect(graphSketcher)
 		indexingPipeline.AddProcesses(msaConverter, graphSketcher, sketchIndexer)
@@ -1,13 +1,871 @@
 package pipeline
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/seqio"
 )
 
+// TestDecompression checks that compressed input is detected from its contents, regardless of the file extension
+func TestDecompression(t *testing.T) {
+	outDir := "test-data/tmp/compressed"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bzip2 file is a test fixture (there's no bzip2 writer in the standard library)
+	testFiles := []string{"test-data/test-reads-OXA90-50-reads.fastq.bz2"}
+	bz2Reader, closeBz2, err := openInput(testFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{}
+	for bz2Reader.Scan() {
+		expected = append(expected, bz2Reader.Bytes()...)
+		expected = append(expected, '\n')
+	}
+	closeBz2()
+	if len(expected) == 0 {
+		t.Fatal("could not read the bzip2 test file")
+	}
+
+	// write the same reads using the other compression formats, with a misleading file extension
+	gzBuf := &bytes.Buffer{}
+	for _, member := range [][]byte{expected[:len(expected)/2], expected[len(expected)/2:]} {
+		gz := gzip.NewWriter(gzBuf)
+		gz.Write(member)
+		gz.Close()
+	}
+	zstdBuf := &bytes.Buffer{}
+	zw, err := zstd.NewWriter(zstdBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(expected)
+	zw.Close()
+	xzBuf := &bytes.Buffer{}
+	xw, err := xz.NewWriter(xzBuf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write(expected)
+	xw.Close()
+	for name, data := range map[string][]byte{"multi-member-gzip": gzBuf.Bytes(), "zstd": zstdBuf.Bytes(), "xz": xzBuf.Bytes(), "plain": expected} {
+		fileName := fmt.Sprintf("%v/%v.fq", outDir, name)
+		if err := ioutil.WriteFile(fileName, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		testFiles = append(testFiles, fileName)
+	}
+
+	// stream each file and check the contents
+	for _, testFile := range testFiles {
+		dataStream := NewDataStreamer(testParameters)
+		dataStream.Connect([]string{testFile})
+		go dataStream.Run()
+		got := []byte{}
+		for line := range dataStream.output {
+			got = append(got, line.data...)
+			got = append(got, '\n')
+		}
+		if !bytes.Equal(got, expected) {
+			t.Fatalf("could not decompress %v", testFile)
+		}
+
+		// the decompressed size is used to size the Bloom filters for k-mer counting
+		if size, err := estimateDecompressedSize(testFile); err != nil || size != len(expected) {
+			t.Fatalf("expected a decompressed size of %d for %v, got %d (%v)", len(expected), testFile, size, err)
+		}
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSinglePassHaplotyping runs the alignment pipeline with the EM path finder connected to the graph pruner
+func TestSinglePassHaplotyping(t *testing.T) {
+	outDir := "test-data/tmp/single-pass"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the files from the previous tests
+	testParameters := new(Info)
+	if err := testParameters.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	testParameters.Sketch.MinKmerCoverage = 10
+	testParameters.Sketch.BAMout = outDir + "/out.bam"
+	testParameters.Sketch.GraphDir = outDir
+	testParameters.Haplotype = HaploCmd{
+		Cutoff:        1.0,
+		MaxIterations: 10000,
+		MinIterations: 50,
+	}
+
+	// run the pipeline
+	alignmentPipeline := NewPipeline()
+	dataStream := NewDataStreamer(testParameters)
+	fastqHandler := NewFastqHandler(testParameters)
+	fastqChecker := NewFastqChecker(testParameters)
+	readMapper := NewReadMapper(testParameters)
+	graphPruner := NewGraphPruner(testParameters, true)
+	emPathFinder := NewEMpathFinder(testParameters)
+	haploParser := NewHaplotypeParser(testParameters)
+	dataStream.Connect(fastq)
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	emPathFinder.ConnectPruner(graphPruner)
+	haploParser.Connect(emPathFinder)
+	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner, emPathFinder, haploParser)
+	alignmentPipeline.Run()
+
+	// check the weighted graph was written prior to EM
+	if _, err := os.Stat(outDir + "/groot-graph-0.gfa"); err != nil {
+		t.Fatal("weighted graph was not written by the graph pruner: ", err)
+	}
+
+	// check the called alleles
+	correctPath := false
+	for _, haplotype := range haploParser.CollectHaplotypes() {
+		t.Logf("%d\t%v\t%.3f", haplotype.GraphID, haplotype.Allele, haplotype.Abundance)
+		if haplotype.Allele == "argannot~~~(Bla)OXA-90~~~EU547443:1-825" {
+			correctPath = true
+		}
+	}
+	if !correctPath {
+		t.Fatal("single pass haplotyping did not identify correct allele in graph")
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPairedAlignment runs the alignment pipeline on R1/R2 files and checks the pair information in the BAM
+func TestPairedAlignment(t *testing.T) {
+	outDir := "test-data/tmp/paired"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the files from the previous tests
+	testParameters := new(Info)
+	if err := testParameters.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	testParameters.Sketch.MinKmerCoverage = 10
+	testParameters.Sketch.BAMout = outDir + "/out.bam"
+	testParameters.Sketch.Paired = true
+	testParameters.Sketch.Concordance = "filter"
+	testParameters.Sketch.ReadReport = outDir + "/reads.jsonl"
+	testParameters.Sketch.ReadReportFormat = "jsonl"
+
+	// run the pipeline
+	alignmentPipeline := NewPipeline()
+	dataStream := NewDataStreamer(testParameters)
+	fastqHandler := NewFastqHandler(testParameters)
+	fastqChecker := NewFastqChecker(testParameters)
+	readMapper := NewReadMapper(testParameters)
+	graphPruner := NewGraphPruner(testParameters, false)
+	dataStream.Connect(pairedFastq)
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner)
+	alignmentPipeline.Run()
+	readStats := readMapper.CollectReadStats()
+	if readStats[0] != 1000 {
+		t.Fatalf("expected 1000 reads from 500 pairs, got %d", readStats[0])
+	}
+
+	// check the pair information in the BAM
+	fh, err := os.Open(testParameters.Sketch.BAMout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	read1, read2, properPairs := 0, 0, 0
+	for {
+		record, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Flags&sam.Paired == 0 {
+			t.Fatalf("paired read not flagged as paired: %v", record.Name)
+		}
+		if record.Flags&sam.Read1 != 0 {
+			read1++
+		}
+		if record.Flags&sam.Read2 != 0 {
+			read2++
+		}
+		if record.Flags&sam.ProperPair != 0 {
+			properPairs++
+			if record.MateRef == nil || record.TempLen == 0 {
+				t.Fatalf("proper pair is missing mate information: %v", record.Name)
+			}
+		}
+		if !sam.IsValidRecord(record) {
+			t.Fatalf("invalid SAM record: %v", record)
+		}
+	}
+	t.Logf("alignments for read 1: %d, read 2: %d, in proper pairs: %d", read1, read2, properPairs)
+	if read1 == 0 || read2 == 0 || properPairs == 0 {
+		t.Fatal("no proper pairs were aligned")
+	}
+
+	// check there is a classification for each read of each pair
+	report, err := ioutil.ReadFile(testParameters.Sketch.ReadReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mates := make(map[string]int)
+	for _, line := range bytes.Split(bytes.TrimSpace(report), []byte("\n")) {
+		classification := &ReadClassification{}
+		if err := json.Unmarshal(line, classification); err != nil {
+			t.Fatal(err)
+		}
+		mates[classification.Read[len(classification.Read)-2:]]++
+	}
+	if mates["/1"] != 500 || mates["/2"] != 500 {
+		t.Fatalf("expected a classification for both reads of 500 pairs, got %v", mates)
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReadReport checks that the per-read report has a line for every read, which agrees with the read stats
+func TestReadReport(t *testing.T) {
+	outDir := "test-data/tmp/readreport"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	testParameters := new(Info)
+	if err := testParameters.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	testParameters.NumProc = 4
+	testParameters.Sketch.MinKmerCoverage = 10
+	testParameters.Sketch.BAMout = outDir + "/out.bam"
+	testParameters.Sketch.ReadReport = outDir + "/reads.tsv"
+	testParameters.Sketch.ReadReportFormat = "tsv"
+
+	// run the pipeline
+	alignmentPipeline := NewPipeline()
+	dataStream := NewDataStreamer(testParameters)
+	fastqHandler := NewFastqHandler(testParameters)
+	fastqChecker := NewFastqChecker(testParameters)
+	readMapper := NewReadMapper(testParameters)
+	graphPruner := NewGraphPruner(testParameters, false)
+	dataStream.Connect(fastq)
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner)
+	alignmentPipeline.Run()
+	readStats := readMapper.CollectReadStats()
+
+	// check the report
+	fh, err := os.Open(testParameters.Sketch.ReadReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	numReads, numMapped, numAligned := -1, 0, 0
+	for scanner.Scan() {
+		numReads++
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			t.Fatalf("expected 6 fields in the per-read report, got %d: %v", len(fields), scanner.Text())
+		}
+		if numReads == 0 {
+			continue
+		}
+		if fields[1] != "0" {
+			numMapped++
+		}
+		if fields[4] == "true" {
+			numAligned++
+			if fields[5] == "-" {
+				t.Fatalf("aligned read has no references: %v", scanner.Text())
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("reads: %d, mapped: %d, aligned: %d", numReads, numMapped, numAligned)
+	if numReads != readStats[0] || numMapped != readStats[1] || numAligned == 0 || numAligned > numMapped {
+		t.Fatalf("per-read report doesn't match the read stats: %v", readStats)
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestBAMinput converts the test reads to an unaligned BAM and checks that they align and keep their read group
+func TestBAMinput(t *testing.T) {
+	outDir := "test-data/tmp/bam-input"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// write the test reads to an unaligned BAM with a read group
+	rg, err := sam.NewReadGroup("testRG", "", "", "", "", "illumina", "", "testSample", "", "", time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := sam.NewHeader(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := header.AddReadGroup(rg); err != nil {
+		t.Fatal(err)
+	}
+	uBAM, err := os.Create(outDir + "/reads.bam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bw, err := bam.NewWriter(uBAM, header, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Open(fastq[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(fh)
+	inputCount := 0
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		name := scanner.Text()[1:]
+		scanner.Scan()
+		seq := scanner.Bytes()
+		scanner.Scan()
+		scanner.Scan()
+		qual := make([]byte, len(scanner.Bytes()))
+		for i, q := range scanner.Bytes() {
+			qual[i] = q - 33
+		}
+		record, err := sam.NewRecord(name, nil, nil, -1, -1, 0, 0, nil, seq, qual, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Flags = sam.Unmapped
+		aux, err := sam.NewAux(sam.NewTag("RG"), "testRG")
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.AuxFields = append(record.AuxFields, aux)
+		if err := bw.Write(record); err != nil {
+			t.Fatal(err)
+		}
+		inputCount++
+	}
+	fh.Close()
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	uBAM.Close()
+
+	// load the files from the previous tests
+	testParameters := new(Info)
+	if err := testParameters.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	testParameters.Sketch.MinKmerCoverage = 10
+	testParameters.Sketch.BAMout = outDir + "/out.bam"
+	testParameters.Sketch.BAM = true
+
+	// run the pipeline
+	alignmentPipeline := NewPipeline()
+	bamReader := NewBAMreader(testParameters)
+	fastqChecker := NewFastqChecker(testParameters)
+	readMapper := NewReadMapper(testParameters)
+	graphPruner := NewGraphPruner(testParameters, false)
+	bamReader.Connect([]string{outDir + "/reads.bam"})
+	fastqChecker.ConnectBAM(bamReader)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(bamReader, fastqChecker, readMapper, graphPruner)
+	alignmentPipeline.Run()
+	if readStats := readMapper.CollectReadStats(); readStats[0] != inputCount {
+		t.Fatalf("expected %d reads from the BAM, got %d", inputCount, readStats[0])
+	}
+
+	// check the read group has been kept in the output
+	outBAM, err := os.Open(testParameters.Sketch.BAMout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outBAM.Close()
+	br, err := bam.NewReader(outBAM, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	if rgs := br.Header().RGs(); len(rgs) != 1 || rgs[0].Name() != "testRG" || rgs[0].Get(sam.NewTag("SM")) != "testSample" {
+		t.Fatalf("read group was not propagated to the output BAM header: %v", rgs)
+	}
+	record, err := br.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aux, ok := record.Tag([]byte("RG")); !ok || aux.Value().(string) != "testRG" {
+		t.Fatal("read group tag was not propagated to the output BAM records")
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestLongReads tiles long reads into segments and checks that each read gets one primary alignment, with supplementary alignments for the other segment runs
+// it also checks that a deletion in a long read is kept when the segment alignments are merged
+func TestLongReads(t *testing.T) {
+	outDir := "test-data/tmp/longreads"
+	if err := os.MkdirAll(outDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// make some long reads from the bla-OXA-90 sequence in the MSA: the full length gene, the gene with a deleted base and a chimera of the two halves of the gene in opposite orientations
+	msa, err := ioutil.ReadFile(msaList[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oxa90 []byte
+	for _, record := range bytes.Split(msa, []byte(">"))[1:] {
+		lines := bytes.SplitN(record, []byte("\n"), 2)
+		if bytes.Contains(lines[0], []byte("OXA-90~")) {
+			oxa90 = bytes.ToUpper(bytes.Replace(bytes.Replace(lines[1], []byte("\n"), nil, -1), []byte("-"), nil, -1))
+		}
+	}
+	if len(oxa90) != 825 {
+		t.Fatalf("could not get the OXA-90 sequence from the MSA (length %d)", len(oxa90))
+	}
+	secondHalf := &seqio.FASTQread{Sequence: seqio.Sequence{Seq: append([]byte(nil), oxa90[425:]...)}}
+	secondHalf.RevComplement()
+	chimera := append(append([]byte(nil), oxa90[:400]...), secondHalf.Seq...)
+	deletion := append(append([]byte(nil), oxa90[:440]...), oxa90[441:]...)
+	longReads := fmt.Sprintf(">fullLength\n%s\n>deletion\n%s\n>chimera\n%s\n", oxa90, deletion, chimera)
+	if err := ioutil.WriteFile(outDir+"/long-reads.fasta", []byte(longReads), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// load the files from the previous tests
+	testParameters := new(Info)
+	if err := testParameters.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+	testParameters.Sketch.Fasta = true
+	testParameters.Sketch.LongReads = true
+	testParameters.Sketch.Alignment.Gapped = true
+	testParameters.Sketch.BAMout = outDir + "/out.bam"
+
+	// run the pipeline
+	alignmentPipeline := NewPipeline()
+	dataStream := NewDataStreamer(testParameters)
+	fastqHandler := NewFastqHandler(testParameters)
+	fastqChecker := NewFastqChecker(testParameters)
+	readMapper := NewReadMapper(testParameters)
+	graphPruner := NewGraphPruner(testParameters, false)
+	dataStream.Connect([]string{outDir + "/long-reads.fasta"})
+	fastqHandler.Connect(dataStream)
+	fastqChecker.Connect(fastqHandler)
+	readMapper.Connect(fastqChecker)
+	graphPruner.Connect(readMapper)
+	alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper, graphPruner)
+	alignmentPipeline.Run()
+	if readStats := readMapper.CollectReadStats(); readStats[1] != 3 {
+		t.Fatalf("expected all the long reads to map, got %d", readStats[1])
+	}
+
+	// check the alignments in the BAM
+	fh, err := os.Open(testParameters.Sketch.BAMout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	br, err := bam.NewReader(fh, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	primary, supplementary := make(map[string]int), make(map[string]int)
+	for {
+		record, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sam.IsValidRecord(record) {
+			t.Fatalf("invalid SAM record: %v", record)
+		}
+		t.Logf("%v\t%v\t%v\t%d\t%v", record.Name, record.Flags, record.Ref.Name(), record.Pos, record.Cigar)
+		switch {
+		case record.Flags&sam.Secondary != 0:
+			continue
+		case record.Flags&sam.Supplementary != 0:
+			supplementary[record.Name]++
+		default:
+			primary[record.Name]++
+		}
+		if record.Name == "deletion" {
+			md, ok := record.Tag([]byte("MD"))
+			if !strings.Contains(record.Cigar.String(), "M1D") || !ok || !strings.Contains(md.Value().(string), "^") {
+				t.Errorf("expected the deletion to be kept in the long read alignment, got %v %v", record.Cigar, md)
+			}
+		}
+	}
+	if primary["fullLength"] != 1 || supplementary["fullLength"] != 0 {
+		t.Errorf("expected a single alignment for the full length read, got %d primary and %d supplementary", primary["fullLength"], supplementary["fullLength"])
+	}
+	if primary["deletion"] != 1 || supplementary["deletion"] != 0 {
+		t.Errorf("expected a single alignment for the read with a deletion, got %d primary and %d supplementary", primary["deletion"], supplementary["deletion"])
+	}
+	if primary["chimera"] != 1 || supplementary["chimera"] == 0 {
+		t.Errorf("expected a primary and supplementary alignments for the chimeric read, got %d primary and %d supplementary", primary["chimera"], supplementary["chimera"])
+	}
+	if err := os.RemoveAll(outDir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAlternativeSketching builds an index using KMV and OPH sketches, checks each can't be used with the KHF index from the previous tests and then maps reads with it
+func TestAlternativeSketching(t *testing.T) {
+	for _, algorithm := range []minhash.Algorithm{minhash.KMV, minhash.OPH} {
+		outDir := "test-data/tmp/" + string(algorithm)
+		if err := os.MkdirAll(outDir, 0777); err != nil {
+			t.Fatal(err)
+		}
+		altParameters := &Info{
+			NumProc:              1,
+			Version:              testParameters.Version,
+			KmerSize:             testParameters.KmerSize,
+			SketchSize:           testParameters.SketchSize,
+			WindowSize:           testParameters.WindowSize,
+			NumPart:              testParameters.NumPart,
+			MaxK:                 testParameters.MaxK,
+			MaxSketchSpan:        testParameters.MaxSketchSpan,
+			ContainmentThreshold: testParameters.ContainmentThreshold,
+			SketchAlgorithm:      algorithm,
+		}
+		msaToBuild, err := altParameters.AssignGraphIDs(msaList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexingPipeline := NewPipeline()
+		msaConverter := NewMSAconverter(altParameters)
+		graphSketcher := NewGraphSketcher(altParameters)
+		sketchIndexer := NewSketchIndexer(altParameters)
+		msaConverter.Connect(msaToBuild)
+		graphSketcher.Connect(msaConverter)
+		sketchIndexer.Connect(graphSketcher)
+		indexingPipeline.AddProcesses(msaConverter, graphSketcher, sketchIndexer)
+		indexingPipeline.Run()
+		if err := altParameters.SaveDB(outDir + "/groot.lshe"); err != nil {
+			t.Fatal(err)
+		}
+
+		// the KHF index from the previous tests should be refused
+		khfIndex := &lshe.ContainmentIndex{}
+		if err := khfIndex.Load("test-data/tmp/groot.lshe"); err != nil {
+			t.Fatal(err)
+		}
+		if err := altParameters.AttachDB(khfIndex); err == nil {
+			t.Fatalf("a KHF index should not be attached to a %v graph store", algorithm)
+		}
+
+		// map the reads using the new index
+		altIndex := &lshe.ContainmentIndex{}
+		if err := altIndex.Load(outDir + "/groot.lshe"); err != nil {
+			t.Fatal(err)
+		}
+		if err := altParameters.AttachDB(altIndex); err != nil {
+			t.Fatal(err)
+		}
+		altParameters.Sketch.NoExactAlign = true
+		alignmentPipeline := NewPipeline()
+		dataStream := NewDataStreamer(altParameters)
+		fastqHandler := NewFastqHandler(altParameters)
+		fastqChecker := NewFastqChecker(altParameters)
+		readMapper := NewReadMapper(altParameters)
+		dataStream.Connect(fastq)
+		fastqHandler.Connect(dataStream)
+		fastqChecker.Connect(fastqHandler)
+		readMapper.Connect(fastqChecker)
+		alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper)
+		go alignmentPipeline.Run()
+		for range readMapper.output {
+		}
+		readStats := readMapper.CollectReadStats()
+		t.Logf("reads mapped using %v sketches: %d of %d", algorithm, readStats[1], readStats[0])
+		if readStats[1] < readStats[0]/2 {
+			t.Fatalf("too few reads mapped using %v sketches", algorithm)
+		}
+		if err := os.RemoveAll(outDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestKmerFiltering checks that excluding the k-mers seen only once in the sample from the read sketches doesn't lose any mapped reads
+func TestKmerFiltering(t *testing.T) {
+	mapReads := func(bloomFilter bool) [4]int {
+		info := new(Info)
+		if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+			t.Fatal(err)
+		}
+		index := &lshe.ContainmentIndex{}
+		if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+			t.Fatal(err)
+		}
+		if err := info.AttachDB(index); err != nil {
+			t.Fatal(err)
+		}
+		info.Sketch.NoExactAlign = true
+		info.Sketch.BloomFilter = bloomFilter
+
+		// the k-mers are counted by streaming the reads through their own pipeline first
+		if bloomFilter {
+			countingPipeline := NewPipeline()
+			dataStream := NewDataStreamer(info)
+			fastqHandler := NewFastqHandler(info)
+			fastqChecker := NewFastqChecker(info)
+			kmerCounter, err := NewKmerCounter(info, fastq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dataStream.Connect(fastq)
+			fastqHandler.Connect(dataStream)
+			fastqChecker.Connect(fastqHandler)
+			kmerCounter.Connect(fastqChecker)
+			countingPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, kmerCounter)
+			countingPipeline.Run()
+		}
+		alignmentPipeline := NewPipeline()
+		dataStream := NewDataStreamer(info)
+		fastqHandler := NewFastqHandler(info)
+		fastqChecker := NewFastqChecker(info)
+		readMapper := NewReadMapper(info)
+		dataStream.Connect(fastq)
+		fastqHandler.Connect(dataStream)
+		fastqChecker.Connect(fastqHandler)
+		readMapper.Connect(fastqChecker)
+		alignmentPipeline.AddProcesses(dataStream, fastqHandler, fastqChecker, readMapper)
+		go alignmentPipeline.Run()
+		for range readMapper.output {
+		}
+		return readMapper.CollectReadStats()
+	}
+	unfiltered, filtered := mapReads(false), mapReads(true)
+	t.Logf("reads mapped without k-mer filtering: %d of %d", unfiltered[1], unfiltered[0])
+	t.Logf("reads mapped with k-mer filtering: %d of %d", filtered[1], filtered[0])
+	if filtered[0] != unfiltered[0] {
+		t.Fatalf("k-mer filtering should not change the number of reads processed (%d vs %d)", filtered[0], unfiltered[0])
+	}
+	if filtered[1] < unfiltered[1] {
+		t.Fatal("fewer reads mapped with k-mer filtering")
+	}
+}
+
+// TestStrandAwareSketching checks that the strand of a read relative to the graph windows is found when the index is queried
+func TestStrandAwareSketching(t *testing.T) {
+	info := new(Info)
+	if err := info.Load("test-data/tmp/groot.gg"); err != nil {
+		t.Fatal(err)
+	}
+	index := &lshe.ContainmentIndex{}
+	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := info.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
+
+	// the orientation recorded for each hit should flip when the read is reverse complemented
+	fh, err := os.Open(fastq[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	parser := seqio.NewParser(fastq[0], false)
+	scanner := bufio.NewScanner(fh)
+	checked := 0
+	for checked < 10 && scanner.Scan() {
+		read, err := parser.Parse(scanner.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read == nil {
+			continue
+		}
+		read.Seq = append([]byte(nil), read.Seq...)
+		orientations := [2]map[string]bool{}
+		for i := range orientations {
+			sketch, strands, err := read.RunMinHash(info.KmerSize, info.SketchSize, info.SketchAlgorithm, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results, err := info.db.Query(sketch, strands, len(read.Seq)-info.KmerSize+1, info.ContainmentThreshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orientations[i] = make(map[string]bool)
+			for _, keys := range results {
+				for _, key := range keys {
+					orientations[i][fmt.Sprintf("g%dn%do%d", key.GraphID, key.Node, key.OffSet)] = key.RC
+				}
+			}
+			read.RevComplement()
+		}
+		for window, rc := range orientations[0] {
+			if reverse, ok := orientations[1][window]; ok && reverse == rc {
+				t.Fatalf("orientation of %v did not change for window %v when the read was reverse complemented", string(read.ID), window)
+			}
+		}
+		if len(orientations[0]) != 0 {
+			checked++
+		}
+	}
+	if checked == 0 {
+		t.Fatal("no reads mapped")
+	}
+}
+
+// TestQualityControl checks that the FastqChecker trims and removes reads, and that pairs with a failed read are split
+func TestQualityControl(t *testing.T) {
+	info := *testParameters
+	info.Sketch.QualTrim = 20
+	info.Sketch.MinLength = 0.6
+	info.Sketch.MaxNfrac = 0.1
+	info.Sketch.Adapters = [][]byte{[]byte("AGATCGGAAGAGC")}
+	checker := NewFastqChecker(&info)
+	checker.input = make(chan *seqio.FASTQread, BUFFERSIZE)
+
+	// build some reads, one for each filter
+	seq := bytes.Repeat([]byte("ACGTTGCA"), 10)
+	newRead := func(id string, seq []byte, qual byte) *seqio.FASTQread {
+		read, err := seqio.NewFASTQread([]byte(id), append([]byte(nil), seq...), []byte("+"), bytes.Repeat([]byte{qual}, len(seq)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return read
+	}
+	good := newRead("@good", seq, 'I')
+	adapter := newRead("@adapter", append(append([]byte(nil), seq...), []byte("AGATCGG")...), 'I')
+	lowQual := newRead("@lowQual", seq, 'I')
+	for i := 70; i < len(lowQual.Qual); i++ {
+		lowQual.Qual[i] = '#'
+	}
+	tooShort := newRead("@tooShort", seq[:50], 'I')
+	nRich := newRead("@nRich", append(bytes.Repeat([]byte("N"), 10), seq...), 'I')
+	r1, r2 := newRead("@pair/1", seq, 'I'), newRead("@pair/2", seq, '#')
+	if err := seqio.PairReads(r1, r2); err != nil {
+		t.Fatal(err)
+	}
+	for _, read := range []*seqio.FASTQread{good, adapter, lowQual, tooShort, nRich, r1} {
+		checker.input <- read
+	}
+	close(checker.input)
+	go checker.Run()
+	received := make(map[string]*seqio.FASTQread)
+	for read := range checker.output {
+		received[string(read.ID)] = read
+	}
+
+	// check the reads that passed and the per-filter counts
+	for _, id := range []string{"@good", "@adapter", "@lowQual", "@pair/1"} {
+		if _, ok := received[id]; !ok {
+			t.Fatalf("%v should have passed QC", id)
+		}
+	}
+	if len(received) != 4 {
+		t.Errorf("expected 4 reads to pass QC, got %d", len(received))
+	}
+	if len(received["@adapter"].Seq) != len(seq) {
+		t.Errorf("adapter was not trimmed: %v", string(received["@adapter"].Seq))
+	}
+	if len(received["@lowQual"].Seq) != 70 {
+		t.Errorf("low quality bases were not trimmed: %v", string(received["@lowQual"].Seq))
+	}
+	if received["@pair/1"].Mate != nil || received["@pair/1"].Pair != 0 {
+		t.Errorf("the surviving read of a failed pair should be sent on as a single-end read")
+	}
+	if stats := checker.CollectQCStats(); stats != [5]int{7, 1, 2, 1, 2} {
+		t.Errorf("unexpected QC stats: %v", stats)
+	}
+}
+
 func TestSketching(t *testing.T) {
 
 	// load the files from the previous tests
@@ -20,7 +878,9 @@ func TestSketching(t *testing.T) {
 	if err := index.Load("test-data/tmp/groot.lshe"); err != nil {
 		t.Fatal(err)
 	}
-	testParameters.AttachDB(index)
+	if err := testParameters.AttachDB(index); err != nil {
+		t.Fatal(err)
+	}
 
 	// run the pipeline
 	sketchingPipeline := NewPipeline()
@@ -61,6 +61,15 @@ func TestHaplotyping(t *testing.T) {
 	if correctPath != true {
 		t.Fatal("haplotyping did not identify correct allele in graph")
 	}
+	haplotypes := haploParser.CollectHaplotypes()
+	if len(haplotypes) != len(foundPaths) {
+		t.Fatal("haplotyping did not record a graph and abundance for each called allele")
+	}
+	for _, haplotype := range haplotypes {
+		if _, ok := testParameters.Store[haplotype.GraphID]; !ok {
+			t.Fatalf("called allele has an unknown graph ID: %d", haplotype.GraphID)
+		}
+	}
 
 	// remove the tmp files from all tests
 	if err := os.Remove("test-data/tmp/groot.gg"); err != nil {
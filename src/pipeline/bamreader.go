@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/biogo/hts/bam"
+	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// recordReader is satisfied by both the BAM and SAM readers
+type recordReader interface {
+	Header() *sam.Header
+	Read() (*sam.Record, error)
+}
+
+// BAMreader is a pipeline process that streams reads from unaligned BAM/SAM files or STDIN
+type BAMreader struct {
+	info    *Info
+	input   []string
+	readers []recordReader
+	closers []func()
+	output  chan *seqio.FASTQread
+}
+
+// NewBAMreader is the constructor
+func NewBAMreader(info *Info) *BAMreader {
+	return &BAMreader{info: info, output: make(chan *seqio.FASTQread, BUFFERSIZE)}
+}
+
+// Connect is the method to connect the BAMreader to some data source (STDIN is used if no files are given)
+// the headers are read here so that the read groups are available to the rest of the pipeline before it starts
+func (proc *BAMreader) Connect(input []string) {
+	proc.input = input
+	if len(input) == 0 {
+		reader, closer, err := openRecordReader(os.Stdin)
+		misc.ErrorCheck(err)
+		proc.addReader(reader, closer)
+		return
+	}
+	for _, fileName := range input {
+		fh, err := os.Open(fileName)
+		misc.ErrorCheck(err)
+		reader, closer, err := openRecordReader(fh)
+		misc.ErrorCheck(err)
+		proc.addReader(reader, func() { closer(); fh.Close() })
+	}
+}
+
+// addReader is a method to register a record reader and collect the read groups from its header
+func (proc *BAMreader) addReader(reader recordReader, closer func()) {
+	proc.readers = append(proc.readers, reader)
+	proc.closers = append(proc.closers, closer)
+	for _, rg := range reader.Header().RGs() {
+		duplicate := false
+		for _, seen := range proc.info.Sketch.readGroups {
+			if seen.Name() == rg.Name() {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			proc.info.Sketch.readGroups = append(proc.info.Sketch.readGroups, rg.Clone())
+		}
+	}
+}
+
+// Run is the method to run this process, which satisfies the pipeline interface
+func (proc *BAMreader) Run() {
+	defer close(proc.output)
+	pairer := &readPairer{}
+	for i, reader := range proc.readers {
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			misc.ErrorCheck(err)
+
+			// only use each read once if the input has been aligned previously
+			if record.Flags&(sam.Secondary|sam.Supplementary) != 0 {
+				continue
+			}
+			read := recordToRead(record)
+
+			// if the input is paired, the reads of a pair should be next to each other - pair them up and send them on together (as the first read)
+			if proc.info.Sketch.Paired {
+				read, err = pairer.add(read, 0)
+				misc.ErrorCheck(err)
+				if read == nil {
+					continue
+				}
+			}
+			proc.output <- read
+		}
+		proc.closers[i]()
+	}
+	misc.ErrorCheck(pairer.check())
+}
+
+// openRecordReader is a function to get a BAM or SAM reader for some input
+// BAM is identified by checking the first BGZF block for the BAM magic number, anything else is treated as SAM (which can be compressed)
+func openRecordReader(input io.Reader) (recordReader, func(), error) {
+	bufferedInput := bufio.NewReaderSize(input, maxBGZFblockSize)
+	isBAM, err := checkBAM(bufferedInput)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read BAM/SAM input: %v", err)
+	}
+	if isBAM {
+		reader, err := bam.NewReader(bufferedInput, 1)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read BAM input: %v", err)
+		}
+		return reader, func() { reader.Close() }, nil
+	}
+	decompressedInput, closeInput, err := decompress(bufferedInput)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := sam.NewReader(decompressedInput)
+	if err != nil {
+		closeInput()
+		return nil, nil, fmt.Errorf("could not read SAM input: %v", err)
+	}
+	return reader, closeInput, nil
+}
+
+// maxBGZFblockSize is the maximum size of a BGZF block
+const maxBGZFblockSize = 65536
+
+// checkBAM is a function to check if buffered input is BAM, without consuming any of the input
+func checkBAM(bufferedInput *bufio.Reader) (bool, error) {
+	magic, err := bufferedInput.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if !bytes.HasPrefix(magic, gzipMagic) {
+		return false, nil
+	}
+
+	// decompress the start of the first block and look for the BAM magic number
+	firstBlock, err := bufferedInput.Peek(maxBGZFblockSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return false, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(firstBlock))
+	if err != nil {
+		return false, err
+	}
+	bamMagic := make([]byte, 4)
+	if _, err := io.ReadFull(gz, bamMagic); err != nil {
+		return false, nil
+	}
+	return bytes.Equal(bamMagic, []byte("BAM\x01")), nil
+}
+
+// recordToRead is a function to convert a SAM record to a FASTQ read, putting the read back in its original orientation if it was previously aligned to the reverse strand
+func recordToRead(record *sam.Record) *seqio.FASTQread {
+	seq := record.Seq.Expand()
+
+	// SAM quality scores are not ASCII encoded and are all 0xff if absent (in which case the read is treated like FASTA)
+	var qual []byte
+	if len(record.Qual) == len(seq) && (len(seq) == 0 || record.Qual[0] != 0xff) {
+		qual = make([]byte, len(seq))
+		for i := range qual {
+			qual[i] = record.Qual[i] + 33
+		}
+	}
+	read := &seqio.FASTQread{
+		Sequence: seqio.Sequence{ID: append([]byte("@"), record.Name...), Seq: seq},
+		Misc:     []byte("+"),
+		Qual:     qual,
+	}
+	read.BaseCheck()
+	if rg, ok := record.Tag([]byte("RG")); ok {
+		if rgID, ok := rg.Value().(string); ok {
+			read.RG = rgID
+		}
+	}
+	if record.Flags&sam.Reverse != 0 {
+		read.RevComplement()
+		read.RC = false
+	}
+	return read
+}
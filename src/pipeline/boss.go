@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
@@ -9,35 +10,49 @@ import (
 
 	"github.com/biogo/hts/bam"
 	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/graph"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/seqio"
 	"github.com/will-rowe/groot/src/version"
 )
 
 // theBoss is used to orchestrate the minions
 type theBoss struct {
-	info                *Info                    // the runtime info for the pipeline
-	graphMinionRegister []*graphMinion           // used to keep a record of the graph minions
-	refSAMheaders       map[int][]*sam.Reference // map of SAM headers for each reference sequence, indexed by path ID
-	reads               chan *seqio.FASTQread    // the boss uses this channel to receive data from the main sketching pipeline
-	alignments          chan *sam.Record         // used to receive alignments from the graph minions
-	bamwriter           *bam.Writer              // destination for the BAM output
-	receivedReadCount   int                      // the number of reads the boss is sent during it's lifetime
-	mappedCount         int                      // the total number of reads that were successful mapped to at least one graph
-	multimappedCount    int                      // the total number of reads that had mappings to multiple graphs
-	alignmentCount      int                      // the total number of alignment segments reported post hierarchical alignment of mapped reads
-	sync.Mutex                                   // allows sketching minions to update the Boss's count
+	info                *Info                      // the runtime info for the pipeline
+	graphMinionRegister map[uint32]*graphMinion    // used to keep a record of the graph minions, keyed by graph ID (the IDs can have gaps once an index has been updated)
+	refSAMheaders       map[int][]*sam.Reference   // map of SAM headers for each reference sequence, indexed by path ID
+	reads               chan *seqio.FASTQread      // the boss uses this channel to receive data from the main sketching pipeline
+	alignments          chan *readAlignment        // used to receive alignments for single-end reads from the graph minions
+	pairedAlignments    chan *pairedAlignment      // used to receive alignments for paired reads from the graph minions
+	longReadAlignments  chan *longReadAlignment    // used to receive alignments for long reads from the graph minions
+	classifications     chan *classificationUpdate // used to receive read classifications for the per-read report
+	readReport          *readReporter              // destination for the per-read report (nil if not requested)
+	gafWriter           *bufio.Writer              // destination for the GAF output (nil if not requested)
+	gafFile             *os.File                   // the GAF file being written to
+	bamwriter           *bam.Writer                // destination for the BAM output
+	bamFile             *os.File                   // the BAM file being written to (nil if using STDOUT)
+	kmerCounter         *minhash.KmerCounter       // used to exclude k-mers seen only once in the sample from the read sketches (nil if not requested)
+	receivedReadCount   int                        // the number of reads the boss is sent during it's lifetime
+	mappedCount         int                        // the total number of reads that were successful mapped to at least one graph
+	multimappedCount    int                        // the total number of reads that had mappings to multiple graphs
+	alignmentCount      int                        // the total number of alignment segments reported post hierarchical alignment of mapped reads
+	sync.Mutex                                     // allows sketching minions to update the Boss's count
 }
 
 // newBoss will initialise and return theBoss
 func newBoss(runtimeInfo *Info, inputChan chan *seqio.FASTQread) *theBoss {
 	return &theBoss{
-		info:              runtimeInfo,
-		reads:             inputChan,
-		alignments:        make(chan *sam.Record, BUFFERSIZE),
-		receivedReadCount: 0,
-		mappedCount:       0,
-		multimappedCount:  0,
-		alignmentCount:    0,
+		info:               runtimeInfo,
+		reads:              inputChan,
+		alignments:         make(chan *readAlignment, BUFFERSIZE),
+		pairedAlignments:   make(chan *pairedAlignment, BUFFERSIZE),
+		longReadAlignments: make(chan *longReadAlignment, BUFFERSIZE),
+		classifications:    make(chan *classificationUpdate, BUFFERSIZE),
+		receivedReadCount:  0,
+		mappedCount:        0,
+		multimappedCount:   0,
+		alignmentCount:     0,
 	}
 }
 
@@ -54,10 +69,21 @@ func (theBoss *theBoss) setupBAM() error {
 	// get program info for SAM header (unique ID, name, command, previous program ID, version)
 	programInfo := sam.NewProgram("1", "groot", "groot align", "", version.GetVersion())
 
-	// get some readgroup information TODO: set this properly
-	rg, err := sam.NewReadGroup("readsID", "", "", "", "groot align", "illumina", "", "sampleID", "", "", time.Now(), 1000)
-	if err != nil {
-		return err
+	// get some readgroup information, using the read groups from the input if there are any TODO: set this properly
+	readGroups := []*sam.ReadGroup{}
+	for _, rg := range theBoss.info.Sketch.readGroups {
+		readGroups = append(readGroups, rg.Clone())
+	}
+	if len(readGroups) == 0 {
+		sampleID := "sampleID"
+		if theBoss.info.Sketch.SampleID != "" {
+			sampleID = theBoss.info.Sketch.SampleID
+		}
+		rg, err := sam.NewReadGroup("readsID", "", "", "", "groot align", "illumina", "", sampleID, "", "", time.Now(), 1000)
+		if err != nil {
+			return err
+		}
+		readGroups = append(readGroups, rg)
 	}
 
 	// get all the reference sequences ready for the SAM file
@@ -79,18 +105,21 @@ func (theBoss *theBoss) setupBAM() error {
 	}
 
 	// add the readgroup info
-	if err := header.AddReadGroup(rg); err != nil {
-		return err
+	for _, rg := range readGroups {
+		if err := header.AddReadGroup(rg); err != nil {
+			return err
+		}
 	}
 
 	// use a BAM file or STDOUT (TODO: not exposed to CLI yet)
 	var fh io.Writer
 	if theBoss.info.Sketch.BAMout != "" {
 		var err error
-		fh, err = os.Create(theBoss.info.Sketch.BAMout)
+		theBoss.bamFile, err = os.Create(theBoss.info.Sketch.BAMout)
 		if err != nil {
 			return (fmt.Errorf("could not open file for BAM writing: %v", err))
 		}
+		fh = theBoss.bamFile
 	} else {
 		fh = os.Stdout
 	}
@@ -106,7 +135,10 @@ func (theBoss *theBoss) setupBAM() error {
 
 // mapReads is a method to start off the minions to map and align reads, the minions to augment graphs, and collate the alignments
 func (theBoss *theBoss) mapReads() error {
-	theBoss.alignments = make(chan *sam.Record, BUFFERSIZE)
+	theBoss.alignments = make(chan *readAlignment, BUFFERSIZE)
+	theBoss.pairedAlignments = make(chan *pairedAlignment, BUFFERSIZE)
+	theBoss.longReadAlignments = make(chan *longReadAlignment, BUFFERSIZE)
+	theBoss.classifications = make(chan *classificationUpdate, BUFFERSIZE)
 
 	// set up the BAM if exact alignment is requested
 	if !theBoss.info.Sketch.NoExactAlign {
@@ -115,12 +147,37 @@ func (theBoss *theBoss) mapReads() error {
 		}
 	}
 
+	// set up the GAF output if requested
+	if theBoss.info.Sketch.GAFout != "" {
+		var err error
+		if theBoss.gafFile, err = os.Create(theBoss.info.Sketch.GAFout); err != nil {
+			return fmt.Errorf("could not open file for GAF writing: %v", err)
+		}
+		theBoss.gafWriter = bufio.NewWriter(theBoss.gafFile)
+	}
+
+	// set up the per-read report if requested
+	if theBoss.info.Sketch.ReadReport != "" {
+		var err error
+		if theBoss.readReport, err = newReadReporter(theBoss.info.Sketch.ReadReport, theBoss.info.Sketch.ReadReportFormat); err != nil {
+			return err
+		}
+	}
+
+	// if requested, exclude the k-mers seen only once in the sample from the read sketches (these are counted by a KmerCounter before the reads are mapped)
+	if theBoss.info.Sketch.BloomFilter {
+		if theBoss.info.Sketch.kmerCounter == nil {
+			return fmt.Errorf("the k-mers in the sample must be counted (using a KmerCounter) before they can be filtered")
+		}
+		theBoss.kmerCounter = theBoss.info.Sketch.kmerCounter
+	}
+
 	// setup the waitgroups for the sketching and graphing minions
 	var wg1 sync.WaitGroup
 	var wg2 sync.WaitGroup
 
 	// launch the graph minions (one minion per graph in the index)
-	theBoss.graphMinionRegister = make([]*graphMinion, len(theBoss.info.Store))
+	theBoss.graphMinionRegister = make(map[uint32]*graphMinion, len(theBoss.info.Store))
 	for _, graph := range theBoss.info.Store {
 
 		// create, start and register the graph minion
@@ -159,34 +216,75 @@ func (theBoss *theBoss) mapReads() error {
 					return
 				}
 
-				// get sketch for read
-				readSketch, err := read.RunMinHash(theBoss.info.KmerSize, theBoss.info.SketchSize, false, nil)
-				if err != nil {
-					panic(err)
-				}
+				// long reads are tiled into window sized segments, which are queried individually
+				if theBoss.info.Sketch.LongReads && len(read.Seq) > theBoss.info.WindowSize {
+					hits, err := theBoss.queryLongRead(read)
+					if err != nil {
+						panic(err)
+					}
+					theBoss.sendLongRead(read, hits, theBoss.classifyLongRead(read, hits))
 
-				// get the number of k-mers in the sequence
-				kmerCount := (len(read.Seq) - theBoss.info.KmerSize) + 1
+					// update counts
+					receivedReads++
+					if len(hits) > 0 {
+						mappedCount++
+					}
+					if len(hits) > 1 {
+						multimappedCount++
+					}
+					continue
+				}
 
 				// query the LSH ensemble
-				results, err := theBoss.info.db.Query(readSketch, kmerCount, theBoss.info.ContainmentThreshold)
+				results, err := theBoss.queryRead(read)
 				if err != nil {
 					panic(err)
 				}
 
+				// paired reads are mapped together so that the graph hits can be adjusted using pair concordance
+				if read.Mate != nil {
+					mateResults, err := theBoss.queryRead(read.Mate)
+					if err != nil {
+						panic(err)
+					}
+					theBoss.sendPair(read, results, mateResults, [2]*ReadClassification{theBoss.classifyRead(read, results), theBoss.classifyRead(read.Mate, mateResults)})
+
+					// update counts
+					for _, res := range []map[uint32]lshe.Keys{results, mateResults} {
+						receivedReads++
+						if len(res) > 0 {
+							mappedCount++
+						}
+						if len(res) > 1 {
+							multimappedCount++
+						}
+					}
+					continue
+				}
+
 				// if multiple graphs are returned, we need to deep copy the read
 				deepCopy := false
 				if len(results) > 1 {
 					deepCopy = true
 				}
 
+				// if exact alignment is requested, the tracker lets the boss know when all the graphs have reported alignments for this read
+				// the classification for the per-read report (if requested) is written once they have
+				var tracker *readTracker
+				classification := theBoss.classifyRead(read, results)
+				if len(results) == 0 || theBoss.info.Sketch.NoExactAlign {
+					theBoss.sendClassification(classification, nil)
+				} else {
+					tracker = &readTracker{pending: len(results), classification: classification}
+				}
+
 				// augment graphs and optionally perform exact alignment
 				for graphID, hits := range results {
 					if deepCopy {
 						readCopy := *read.DeepCopy()
-						theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{hits, readCopy}
+						theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{mappings: hits, read: readCopy, readTracker: tracker}
 					} else {
-						theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{hits, *read}
+						theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{mappings: hits, read: *read, readTracker: tracker}
 					}
 				}
 
@@ -218,18 +316,116 @@ func (theBoss *theBoss) mapReads() error {
 
 		// end the alignment writer
 		close(theBoss.alignments)
+		close(theBoss.pairedAlignments)
+		close(theBoss.longReadAlignments)
+		close(theBoss.classifications)
 
 	}()
 
-	// collect the alignments and write them
-	for record := range theBoss.alignments {
-		// check the record is valid
-		//if sam.IsValidRecord(record) == false {
-		//	os.Exit(1)
-		//}
-		theBoss.alignmentCount++
-		if err := theBoss.bamwriter.Write(record); err != nil {
-			return err
+	// collect the alignments and read classifications and write them
+	alignments, pairedAlignments, longReadAlignments, classifications := theBoss.alignments, theBoss.pairedAlignments, theBoss.longReadAlignments, theBoss.classifications
+	for alignments != nil || pairedAlignments != nil || longReadAlignments != nil || classifications != nil {
+		select {
+		case ra, ok := <-alignments:
+			if !ok {
+				alignments = nil
+				continue
+			}
+
+			// wait until every graph that the read was sent to has reported before picking the primary alignment
+			ra.tracker.records = append(ra.tracker.records, ra.records...)
+			ra.tracker.gafRecords = append(ra.tracker.gafRecords, ra.gafRecords...)
+			ra.tracker.pending--
+			if ra.tracker.pending != 0 {
+				continue
+			}
+			if err := graph.RankAlignments(ra.tracker.records); err != nil {
+				return err
+			}
+			if err := theBoss.writeGAF(ra.tracker.gafRecords); err != nil {
+				return err
+			}
+			for _, record := range ra.tracker.records {
+				// check the record is valid
+				//if sam.IsValidRecord(record) == false {
+				//	os.Exit(1)
+				//}
+				theBoss.alignmentCount++
+				if err := theBoss.bamwriter.Write(record); err != nil {
+					return err
+				}
+			}
+			if err := theBoss.reportRead(ra.tracker.classification, ra.tracker.records); err != nil {
+				return err
+			}
+		case pa, ok := <-pairedAlignments:
+			if !ok {
+				pairedAlignments = nil
+				continue
+			}
+
+			// wait until every graph that the pair was sent to has reported before picking the primary alignments and adding the mate info
+			for i := range pa.records {
+				pa.tracker.records[i] = append(pa.tracker.records[i], pa.records[i]...)
+				pa.tracker.gafRecords[i] = append(pa.tracker.gafRecords[i], pa.gafRecords[i]...)
+			}
+			pa.tracker.pending--
+			if pa.tracker.pending != 0 {
+				continue
+			}
+			for i, records := range pa.tracker.records {
+				if err := graph.RankAlignments(records); err != nil {
+					return err
+				}
+				if err := theBoss.writeGAF(pa.tracker.gafRecords[i]); err != nil {
+					return err
+				}
+			}
+			setMateInfo(pa.tracker.records[0], pa.tracker.records[1])
+			setMateInfo(pa.tracker.records[1], pa.tracker.records[0])
+			for i, records := range pa.tracker.records {
+				for _, record := range records {
+					theBoss.alignmentCount++
+					if err := theBoss.bamwriter.Write(record); err != nil {
+						return err
+					}
+				}
+				if err := theBoss.reportRead(pa.tracker.classifications[i], records); err != nil {
+					return err
+				}
+			}
+		case la, ok := <-longReadAlignments:
+			if !ok {
+				longReadAlignments = nil
+				continue
+			}
+
+			// wait until every graph that the read was sent to has reported before picking the primary alignment
+			la.tracker.records = append(la.tracker.records, la.records...)
+			la.tracker.pending--
+			if la.tracker.pending != 0 {
+				continue
+			}
+			if err := setSupplementaryInfo(la.tracker.records); err != nil {
+				return err
+			}
+			for _, record := range la.tracker.records {
+				theBoss.alignmentCount++
+				if err := theBoss.bamwriter.Write(record); err != nil {
+					return err
+				}
+			}
+			if err := theBoss.reportRead(la.tracker.classification, la.tracker.records); err != nil {
+				return err
+			}
+		case update, ok := <-classifications:
+			if !ok {
+				classifications = nil
+				continue
+			}
+			if err := theBoss.reportRead(update.classification, update.records); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -237,6 +433,188 @@ func (theBoss *theBoss) mapReads() error {
 	var err error
 	if !theBoss.info.Sketch.NoExactAlign {
 		err = theBoss.bamwriter.Close()
+		if theBoss.bamFile != nil {
+			if closeErr := theBoss.bamFile.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if theBoss.readReport != nil {
+		if closeErr := theBoss.readReport.close(); err == nil {
+			err = closeErr
+		}
+	}
+	if theBoss.gafWriter != nil {
+		if flushErr := theBoss.gafWriter.Flush(); err == nil {
+			err = flushErr
+		}
+		if closeErr := theBoss.gafFile.Close(); err == nil {
+			err = closeErr
+		}
 	}
 	return err
 }
+
+// writeGAF is a method to rank the GAF records for a read and write them, it does nothing if GAF output wasn't requested
+// the BAM records for the read must be ranked first, so that the primary GAF record matches the primary alignment
+func (theBoss *theBoss) writeGAF(gafRecords []*graph.GAFRecord) error {
+	if theBoss.gafWriter == nil {
+		return nil
+	}
+	graph.RankGAFRecords(gafRecords)
+	for _, gafRecord := range gafRecords {
+		if _, err := fmt.Fprintln(theBoss.gafWriter, gafRecord); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryRead is a method to sketch a read and query the LSH Ensemble, returning the graph windows that contain the read
+func (theBoss *theBoss) queryRead(read *seqio.FASTQread) (map[uint32]lshe.Keys, error) {
+
+	// get the number of k-mers in the sequence, excluding any k-mers seen only once in the sample if they are being filtered
+	kmerCount := (len(read.Seq) - theBoss.info.KmerSize) + 1
+	var filter *minhash.BloomFilter
+	if theBoss.kmerCounter != nil {
+		var err error
+		if kmerCount, err = theBoss.kmerCounter.CountSolid(read.Seq); err != nil {
+			return nil, err
+		}
+		if kmerCount == 0 {
+			return nil, nil
+		}
+		filter = theBoss.kmerCounter.GetFilter()
+	}
+
+	// get sketch for read
+	readSketch, readStrands, err := read.RunMinHash(theBoss.info.KmerSize, theBoss.info.SketchSize, theBoss.info.SketchAlgorithm, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// query the LSH ensemble, the k-mer orientations are used to find the strand of the read relative to each graph window
+	return theBoss.info.db.Query(readSketch, readStrands, kmerCount, theBoss.info.ContainmentThreshold)
+}
+
+// sendPair is a method to send a read pair to the graph minions for every graph that either read hit
+// if concordance filtering is requested, only graphs hit by both reads are used
+// the classifications for the per-read report (nil if not requested) are written by the boss once the pair has been aligned
+func (theBoss *theBoss) sendPair(read *seqio.FASTQread, results, mateResults map[uint32]lshe.Keys, classifications [2]*ReadClassification) {
+	graphIDs := make(map[uint32]struct{})
+	for graphID := range results {
+		if _, ok := mateResults[graphID]; ok || theBoss.info.Sketch.Concordance != "filter" {
+			graphIDs[graphID] = struct{}{}
+		}
+	}
+	for graphID := range mateResults {
+		if _, ok := results[graphID]; ok || theBoss.info.Sketch.Concordance != "filter" {
+			graphIDs[graphID] = struct{}{}
+		}
+	}
+	if len(graphIDs) == 0 {
+		for _, classification := range classifications {
+			theBoss.sendClassification(classification, nil)
+		}
+		return
+	}
+
+	// the tracker lets the boss know when all the graphs have reported alignments for this pair
+	tracker := &pairTracker{pending: len(graphIDs), classifications: classifications}
+	for graphID := range graphIDs {
+		pair := read
+		if len(graphIDs) > 1 {
+			pair = read.DeepCopy()
+		}
+		theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{
+			mappings:     results[graphID],
+			read:         *pair,
+			mateMappings: mateResults[graphID],
+			tracker:      tracker,
+		}
+	}
+}
+
+// readTracker collects the alignments for a single-end read from each graph minion that the read was sent to
+type readTracker struct {
+	pending        int                 // the number of graph minions yet to report for this read
+	records        []*sam.Record       // the alignments for the read
+	gafRecords     []*graph.GAFRecord  // the alignments for the read, as graph traversals
+	classification *ReadClassification // the classification for the read (per-read report only)
+}
+
+// readAlignment is used by a graph minion to report the alignments it found for a single-end read
+type readAlignment struct {
+	tracker    *readTracker
+	records    []*sam.Record
+	gafRecords []*graph.GAFRecord
+}
+
+// pairTracker collects the alignments for a read pair from each graph minion that the pair was sent to
+type pairTracker struct {
+	pending         int                    // the number of graph minions yet to report for this pair
+	records         [2][]*sam.Record       // the alignments for the first and second read of the pair
+	gafRecords      [2][]*graph.GAFRecord  // the alignments for the first and second read of the pair, as graph traversals
+	classifications [2]*ReadClassification // the classifications for the first and second read of the pair (per-read report only)
+}
+
+// pairedAlignment is used by a graph minion to report the alignments it found for a read pair
+type pairedAlignment struct {
+	tracker    *pairTracker
+	records    [2][]*sam.Record
+	gafRecords [2][]*graph.GAFRecord
+}
+
+// setMateInfo is a function to add the mate information to the alignments for one read of a pair
+// each alignment is paired with the mate's alignment to the same reference sequence if there is one, otherwise the mate's primary alignment is used
+func setMateInfo(records, mateRecords []*sam.Record) {
+	var primaryMate *sam.Record
+	mateLookup := make(map[*sam.Reference]*sam.Record)
+	for _, mateRecord := range mateRecords {
+		if primaryMate == nil && mateRecord.Flags&sam.Secondary == 0 {
+			primaryMate = mateRecord
+		}
+		if _, ok := mateLookup[mateRecord.Ref]; !ok {
+			mateLookup[mateRecord.Ref] = mateRecord
+		}
+	}
+	if primaryMate == nil && len(mateRecords) != 0 {
+		primaryMate = mateRecords[0]
+	}
+	for _, record := range records {
+
+		// if the mate didn't align, place it with this read
+		if primaryMate == nil {
+			record.Flags |= sam.MateUnmapped
+			record.MateRef, record.MatePos = record.Ref, record.Pos
+			continue
+		}
+		mate, ok := mateLookup[record.Ref]
+		if !ok {
+			mate = primaryMate
+		}
+		record.MateRef, record.MatePos = mate.Ref, mate.Pos
+		if mate.Flags&sam.Reverse != 0 {
+			record.Flags |= sam.MateReverse
+		}
+		if record.Ref != mate.Ref {
+			continue
+		}
+
+		// mates on the same reference in opposite orientations are a proper pair, the template length is signed by leftmost read
+		if record.Flags&sam.Reverse != mate.Flags&sam.Reverse {
+			record.Flags |= sam.ProperPair
+		}
+		start, end := record.Pos, record.End()
+		if mate.Pos < start {
+			start = mate.Pos
+		}
+		if mate.End() > end {
+			end = mate.End()
+		}
+		record.TempLen = end - start
+		if record.Pos > mate.Pos || (record.Pos == mate.Pos && record.Flags&sam.Read2 != 0) {
+			record.TempLen = -record.TempLen
+		}
+	}
+}
@@ -11,11 +11,20 @@ import (
 	"github.com/will-rowe/groot/src/seqio"
 )
 
+// graphMinionPair holds a read and the graph windows it mapped to
 type graphMinionPair struct {
-	mappings lshe.Keys
-	read     seqio.FASTQread
+	mappings     lshe.Keys
+	read         seqio.FASTQread
+	mateMappings lshe.Keys        // the graph windows that the mate mapped to (paired reads only)
+	tracker      *pairTracker     // used by the boss to collect the alignments from all graphs for a pair (paired reads only)
+	segments     []segmentHit     // the segments of the read that mapped to this graph (long reads only)
+	longRead     *longReadTracker // used by the boss to collect the alignments from all graphs for a long read (long reads only)
+	readTracker  *readTracker     // used by the boss to collect the alignments from all graphs for a single-end read (only if exact alignment is requested)
 }
 
+// concordanceBoost is the weighting given to k-mers from read pairs where both reads map to the same graph (if boosting is requested)
+const concordanceBoost = 2.0
+
 // graphMinion holds a graph and is responsible for augmenting the paths when new mapping data arrives
 type graphMinion struct {
 	boss         *theBoss // pointer to the boss so the minion can access the runtime info (e.g. k-mer size) and channels etc
@@ -53,51 +62,84 @@ func (graphMinion *graphMinion) start(wg *sync.WaitGroup) {
 				return
 			}
 
-			// sort the mappings for this read
-			sort.Sort(mappingData.mappings)
-
-			// claculate the number of k-mers for the read
-			kmerCount := float64(len(mappingData.read.Seq)-graphMinion.boss.info.KmerSize) + 1
-
-			// process each mapping until an exact alignment found
-			alignmentFound := false
-			for _, mapping := range mappingData.mappings {
-
-				// increment the graph node weightings for nodes contained in the mapping window
-				misc.ErrorCheck(graphMinion.graph.IncrementSubPath(mapping.ContainedNodes, kmerCount))
-
-				// perform the alignment if requested
-				if graphMinion.boss.info.Sketch.NoExactAlign {
-					continue
+			// long reads are aligned segment by segment and sent to the boss, which picks the primary alignment
+			if mappingData.longRead != nil {
+				graphMinion.boss.longReadAlignments <- &longReadAlignment{
+					tracker: mappingData.longRead,
+					records: graphMinion.processSegments(&mappingData.read, mappingData.segments),
 				}
+				continue
+			}
 
-				// perform graph alignment on forward and reverse complement
-				// TODO: as we used canonical k-mer hashing, not sure which orientation the read seeded in, think about this some more
-				for i := 0; i < 2; i++ {
-
-					// run the alignment
-					alignments, err := graphMinion.graph.AlignRead(&mappingData.read, &mapping, graphMinion.references)
-					if err != nil {
-						panic(err)
-					}
-
-					// if an alignment was found, send them and call it a day
-					if len(alignments) != 0 {
-						for _, alignment := range alignments {
-							graphMinion.boss.alignments <- alignment
-						}
-						alignmentFound = true
-						break
-					}
-
-					// reverse complement read and run again if no alignment found
-					mappingData.read.RevComplement()
-				}
-				if alignmentFound {
-					break
+			// single-end reads are aligned and sent to the boss, which picks the primary alignment once every graph has reported
+			if mappingData.read.Mate == nil {
+				alignments, gafRecords := graphMinion.processMappings(&mappingData.read, mappingData.mappings, 1.0)
+				if mappingData.readTracker != nil {
+					graphMinion.boss.alignments <- &readAlignment{tracker: mappingData.readTracker, records: alignments, gafRecords: gafRecords}
 				}
+				continue
 			}
+
+			// paired reads are aligned together and sent to the boss as a pair, boosting the weighting if both reads mapped to this graph
+			weighting := 1.0
+			if graphMinion.boss.info.Sketch.Concordance == "boost" && len(mappingData.mappings) != 0 && len(mappingData.mateMappings) != 0 {
+				weighting = concordanceBoost
+			}
+			pa := &pairedAlignment{tracker: mappingData.tracker}
+			pa.records[0], pa.gafRecords[0] = graphMinion.processMappings(&mappingData.read, mappingData.mappings, weighting)
+			pa.records[1], pa.gafRecords[1] = graphMinion.processMappings(mappingData.read.Mate, mappingData.mateMappings, weighting)
+			graphMinion.boss.pairedAlignments <- pa
 			//log.Printf("graph %d could not find alignment for %v after trying %d mapping locations", graphMinion.id, string(mappingData.read.ID), len(mappingData.mappings))
 		}
 	}()
 }
+
+// processMappings is a method to weight the graph using the mappings for a read and then return the alignments for the read (if exact alignment is requested), as BAM and GAF records
+// the k-mer count for the read is multiplied by the weighting before it is added to the graph
+func (graphMinion *graphMinion) processMappings(read *seqio.FASTQread, mappings lshe.Keys, weighting float64) ([]*sam.Record, []*graph.GAFRecord) {
+	if len(mappings) == 0 {
+		return nil, nil
+	}
+
+	// sort the mappings for this read
+	sort.Sort(mappings)
+
+	// claculate the number of k-mers for the read
+	kmerCount := (float64(len(read.Seq)-graphMinion.boss.info.KmerSize) + 1) * weighting
+
+	// process each mapping until an exact alignment found
+	for _, mapping := range mappings {
+
+		// increment the graph node weightings for nodes contained in the mapping window
+		misc.ErrorCheck(graphMinion.graph.IncrementSubPath(mapping.ContainedNodes, kmerCount))
+
+		// perform the alignment if requested
+		if graphMinion.boss.info.Sketch.NoExactAlign {
+			continue
+		}
+
+		// start with the read in the orientation found when it was seeded against this window, then try the reverse complement
+		// the orientation can be wrong if the read shared few sketch values with the window (or the index doesn't record them)
+		if read.RC != mapping.RC {
+			read.RevComplement()
+		}
+		for i := 0; i < 2; i++ {
+
+			// run the alignment
+			alignments, gafRecords, err := graphMinion.graph.AlignRead(read, &mapping, graphMinion.references, graphMinion.boss.info.Sketch.Alignment)
+			if err != nil {
+				panic(err)
+			}
+
+			// if an alignment was found, return them and call it a day
+			if len(alignments) != 0 {
+				return alignments, gafRecords
+			}
+
+			// reverse complement read and run again if no alignment found
+			read.RevComplement()
+		}
+	}
+	//log.Printf("graph %d could not find alignment for %v after trying %d mapping locations", graphMinion.id, string(read.ID), len(mappings))
+	return nil, nil
+}
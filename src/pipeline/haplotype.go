@@ -6,6 +6,7 @@ package pipeline
 
 import (
 	"log"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"sync"
@@ -16,6 +17,12 @@ import (
 	"github.com/will-rowe/groot/src/version"
 )
 
+// gfaIDregex is used to recover the graph ID from the filename of a GFA written by the align command
+var gfaIDregex = regexp.MustCompile(`^groot-graph-(\d+)\.gfa$`)
+
+// gfaDatabaseRegex is used to recover the source database of a graph from the comments of a GFA written by the align command
+var gfaDatabaseRegex = regexp.MustCompile(`(?m)source database: (.+)$`)
+
 // GFAreader is a pipeline process that reads in the weighted GFAs
 type GFAreader struct {
 	info   *Info
@@ -50,6 +57,13 @@ func (proc *GFAreader) Run() {
 			proc.info.Haplotype.TotalKmers = kmerCount
 		}
 
+		// use the graph ID from the filename if it follows the groot naming convention, otherwise use the file order
+		gfaID := i
+		if matches := gfaIDregex.FindStringSubmatch(filepath.Base(gfaFile)); matches != nil {
+			gfaID, err = strconv.Atoi(matches[1])
+			misc.ErrorCheck(err)
+		}
+
 		// convert GFAs to GrootGraph and send them on to the path finder
 		wg.Add(1)
 		go func(gfaID int, g *gfa.GFA) {
@@ -58,8 +72,11 @@ func (proc *GFAreader) Run() {
 			if err != nil {
 				log.Fatal(err)
 			}
+			if matches := gfaDatabaseRegex.FindStringSubmatch(g.PrintComments()); matches != nil {
+				grootGraph.Database = matches[1]
+			}
 			proc.output <- grootGraph
-		}(i, gfaObj)
+		}(gfaID, gfaObj)
 	}
 	wg.Wait()
 	close(proc.output)
@@ -67,9 +84,10 @@ func (proc *GFAreader) Run() {
 
 // EMpathFinder is a pipeline process to identify graph paths using Expectation Maximization
 type EMpathFinder struct {
-	info   *Info
-	input  chan *graph.GrootGraph
-	output chan *graph.GrootGraph
+	info       *Info
+	input      chan *graph.GrootGraph
+	output     chan *graph.GrootGraph
+	fromPruner bool // the graphs come straight from the GraphPruner (single-pass haplotyping), so their k-mer totals aren't the ones written to GFA
 }
 
 // NewEMpathFinder is the constructor
@@ -85,19 +103,17 @@ func (proc *EMpathFinder) Connect(previous *GFAreader) {
 // ConnectPruner is the method to connect the MCMCpathFinder to the output of a GraphPruner
 func (proc *EMpathFinder) ConnectPruner(previous *GraphPruner) {
 	proc.input = previous.output
+	proc.fromPruner = true
 }
 
 // Run is the method to run this process, which satisfies the pipeline interface
 func (proc *EMpathFinder) Run() {
 	var wg sync.WaitGroup
 
-	// collect the weighted graphs
+	// collect the weighted graphs (the HaplotypeParser will update the graph store once EM is complete)
 	for inputGraph := range proc.input {
 		wg.Add(1)
 
-		// add each graph to the graphStore
-		proc.info.Store[inputGraph.GraphID] = inputGraph
-
 		// concurrently process the graphs
 		go func(g *graph.GrootGraph) {
 			defer wg.Done()
@@ -105,6 +121,11 @@ func (proc *EMpathFinder) Run() {
 			// remove dead ends
 			misc.ErrorCheck(g.RemoveDeadPaths())
 
+			// graphs from the GraphPruner don't have the k-mer total that is written to GFA, so use the node weights to match graphs loaded from GFA
+			if proc.fromPruner {
+				g.KmerTotal = uint64(g.GetNodeWeights())
+			}
+
 			// run the EM
 			err := g.RunEM(proc.info.Haplotype.MinIterations, proc.info.Haplotype.MaxIterations)
 			misc.ErrorCheck(err)
@@ -120,11 +141,20 @@ func (proc *EMpathFinder) Run() {
 	close(proc.output)
 }
 
+// Haplotype is an allele called from a graph after EM path finding
+type Haplotype struct {
+	GraphID   uint32  // the graph that the allele was called from
+	Database  string  // the database that the graph came from (empty if not known)
+	Allele    string  // the name of the path for the allele
+	Abundance float64 // the abundance of the allele, relative to the total k-mers processed during alignment
+}
+
 // HaplotypeParser is a pipeline process to parse the paths produced by the MCMCpathFinder process
 type HaplotypeParser struct {
-	info   *Info
-	input  chan *graph.GrootGraph
-	output []string
+	info       *Info
+	input      chan *graph.GrootGraph
+	output     []string
+	haplotypes []Haplotype
 }
 
 // NewHaplotypeParser is the constructor
@@ -142,11 +172,17 @@ func (proc *HaplotypeParser) CollectOutput() []string {
 	return proc.output
 }
 
+// CollectHaplotypes is a method to return the called alleles, along with their graph and abundance
+func (proc *HaplotypeParser) CollectHaplotypes() []Haplotype {
+	return proc.haplotypes
+}
+
 // Run is the method to run this process, which satisfies the pipeline interface
 func (proc *HaplotypeParser) Run() {
 	meanEMiterations := 0
 	keptGraphs := make(graph.Store)
 	keptPaths := []string{}
+	haplotypes := []Haplotype{}
 	for g := range proc.input {
 		meanEMiterations += g.EMiterations
 
@@ -164,12 +200,14 @@ func (proc *HaplotypeParser) Run() {
 		for i, path := range paths {
 			log.Printf("\t- [%v (abundance: %.3f)]", path, abundances[i])
 			keptPaths = append(keptPaths, path)
+			haplotypes = append(haplotypes, Haplotype{GraphID: g.GraphID, Database: g.Database, Allele: path, Abundance: abundances[i]})
 		}
 		g.GrootVersion = version.GetVersion()
 		keptGraphs[g.GraphID] = g
 	}
 	proc.info.Store = keptGraphs
 	proc.output = keptPaths
+	proc.haplotypes = haplotypes
 	if len(keptGraphs) == 0 {
 		return
 	}
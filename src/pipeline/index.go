@@ -6,7 +6,12 @@ package pipeline
 
 import (
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"log"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/biogo/biogo/seq/multi"
@@ -14,6 +19,7 @@ import (
 	"github.com/will-rowe/groot/src/graph"
 	"github.com/will-rowe/groot/src/lshe"
 	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/version"
 )
 
 // MSAconverter is a pipeline process that converts a list of MSAs to GFAs
@@ -38,8 +44,21 @@ func (proc *MSAconverter) Run() {
 	var wg sync.WaitGroup
 	wg.Add(len(proc.input))
 
+	// give any MSA files that haven't been through AssignGraphIDs a graph ID
+	var unassigned []string
+	for _, msaFile := range proc.input {
+		if _, ok := proc.info.Clusters[filepath.Base(msaFile)]; !ok {
+			unassigned = append(unassigned, msaFile)
+		}
+	}
+	if len(unassigned) != 0 {
+		_, err := proc.info.AssignGraphIDs(unassigned)
+		misc.ErrorCheck(err)
+	}
+
 	// load each MSA outside of the go-routines to prevent 'too many open files' error on OSX
-	for i, msaFile := range proc.input {
+	for _, msaFile := range proc.input {
+		cluster := proc.info.Clusters[filepath.Base(msaFile)]
 		msa, err := gfa.ReadMSA(msaFile)
 		misc.ErrorCheck(err)
 		go func(msaID int, msa *multi.Multi) {
@@ -64,12 +83,138 @@ func (proc *MSAconverter) Run() {
 				}
 			}
 			proc.output <- grootGraph
-		}(i, msa)
+		}(int(cluster.GraphID), msa)
 	}
 	wg.Wait()
 	close(proc.output)
 }
 
+// AssignGraphIDs is a method to give each MSA file a graph ID, returning the MSA files that need converting to graphs
+/* if the index already has graphs (i.e. it is being updated):
+-1. MSA files that are already in the index keep their graph ID and are skipped if they haven't changed
+-2. graphs from older indexes don't have a record of their MSA file, so MSA files are matched to them using the sequence IDs
+-3. the old graph and its windows are removed for any MSA file that has changed, ready for it to be replaced
+-4. new MSA files get the next free graph ID
+*/
+func (Info *Info) AssignGraphIDs(msaFiles []string) ([]string, error) {
+	if Info.Store == nil {
+		Info.Store = make(graph.Store)
+	}
+	if Info.Clusters == nil {
+		Info.Clusters = make(map[string]Cluster)
+	}
+
+	// find the next free graph ID and any graphs without a record of their MSA file
+	recorded := make(map[uint32]struct{}, len(Info.Clusters))
+	for _, cluster := range Info.Clusters {
+		recorded[cluster.GraphID] = struct{}{}
+	}
+	nextID := uint32(0)
+	unrecorded := make(map[uint32]*graph.GrootGraph)
+	for graphID, grootGraph := range Info.Store {
+		if graphID >= nextID {
+			nextID = graphID + 1
+		}
+		if _, ok := recorded[graphID]; !ok {
+			unrecorded[graphID] = grootGraph
+		}
+	}
+
+	// check each MSA file against the index
+	var msaToBuild []string
+	seen := make(map[string]struct{}, len(msaFiles))
+	for _, msaFile := range msaFiles {
+		name := filepath.Base(msaFile)
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("more than one MSA file is named %v", name)
+		}
+		seen[name] = struct{}{}
+		data, err := ioutil.ReadFile(msaFile)
+		if err != nil {
+			return nil, err
+		}
+		checksum := crc32.ChecksumIEEE(data)
+		cluster, ok := Info.Clusters[name]
+		if !ok && len(unrecorded) != 0 {
+			graphID, found, err := matchGraph(msaFile, unrecorded)
+			if err != nil {
+				return nil, err
+			}
+			if found {
+				cluster, ok = Cluster{GraphID: graphID}, true
+				delete(unrecorded, graphID)
+			}
+		}
+		switch {
+		case !ok:
+			cluster = Cluster{GraphID: nextID}
+			nextID++
+		case cluster.Checksum == checksum:
+			continue
+		default:
+			delete(Info.Store, cluster.GraphID)
+			if Info.db != nil {
+				Info.db.RemoveGraph(cluster.GraphID)
+			}
+		}
+		cluster.Checksum = checksum
+		Info.Clusters[name] = cluster
+		msaToBuild = append(msaToBuild, msaFile)
+	}
+	return msaToBuild, nil
+}
+
+// RemoveMissingClusters is a method to remove the graphs (and their windows) for clusters whose MSA files are no longer in the list of MSA files, returning the names of the removed clusters
+// graphs without a record of their MSA file (from older or merged indexes) are left alone, as they can't be told apart from graphs of other databases
+func (Info *Info) RemoveMissingClusters(msaFiles []string) []string {
+	present := make(map[string]struct{}, len(msaFiles))
+	for _, msaFile := range msaFiles {
+		present[filepath.Base(msaFile)] = struct{}{}
+	}
+	var removed []string
+	for name, cluster := range Info.Clusters {
+		if _, ok := present[name]; ok {
+			continue
+		}
+		delete(Info.Store, cluster.GraphID)
+		if Info.db != nil {
+			Info.db.RemoveGraph(cluster.GraphID)
+		}
+		delete(Info.Clusters, name)
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// matchGraph is a function to find the graph that was built from an MSA file, using the sequence IDs in the MSA
+func matchGraph(msaFile string, graphs map[uint32]*graph.GrootGraph) (uint32, bool, error) {
+	msa, err := gfa.ReadMSA(msaFile)
+	if err != nil {
+		return 0, false, err
+	}
+	seqIDs := make(map[string]struct{}, msa.Rows())
+	for i := 0; i < msa.Rows(); i++ {
+		seqIDs[msa.Row(i).Name()] = struct{}{}
+	}
+	var matches []uint32
+	for graphID, grootGraph := range graphs {
+		for _, path := range grootGraph.Paths {
+			if _, ok := seqIDs[string(path)]; ok {
+				matches = append(matches, graphID)
+				break
+			}
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return 0, false, nil
+	case 1:
+		return matches[0], true, nil
+	}
+	return 0, false, fmt.Errorf("MSA file %v shares sequences with more than one graph in the index (graph IDs: %v)", msaFile, matches)
+}
+
 // GraphSketcher is a pipeline process that windows graph traversals and sketches them
 type GraphSketcher struct {
 	info   *Info
@@ -92,8 +237,12 @@ func (proc *GraphSketcher) Run() {
 	defer close(proc.output)
 
 	// after sketching all the received graphs, add the graphs to a store and save it
+	// if the index is being updated, the new graphs are added to the existing store
 	graphChan := make(chan *graph.GrootGraph)
-	graphStore := make(graph.Store)
+	graphStore := proc.info.Store
+	if graphStore == nil {
+		graphStore = make(graph.Store)
+	}
 
 	// receive the graphs to be sketched
 	var wg sync.WaitGroup
@@ -104,7 +253,7 @@ func (proc *GraphSketcher) Run() {
 			if !grootGraph.Masked {
 
 				// create sketch for each window in the graph (merging consecutive windows with identical sketches)
-				windows, err := grootGraph.WindowGraph(proc.info.WindowSize, proc.info.KmerSize, proc.info.SketchSize)
+				windows, err := grootGraph.WindowGraph(proc.info.WindowSize, proc.info.KmerSize, proc.info.SketchSize, proc.info.SketchAlgorithm)
 				misc.ErrorCheck(err)
 
 				// send the windows on the indexing
@@ -122,6 +271,7 @@ func (proc *GraphSketcher) Run() {
 	}()
 
 	// collect the graphs
+	numBuilt := 0
 	numMasked := 0
 	numWindows := 0
 	propDistinctSketches := 0.0
@@ -148,17 +298,23 @@ func (proc *GraphSketcher) Run() {
 
 		// store the graph
 		graphStore[sketchedGraph.GraphID] = sketchedGraph
+		numBuilt++
 	}
 
-	// check some graphs have been sketched
-	numGraphs := len(graphStore) - numMasked
-	if numGraphs == 0 {
+	// check some graphs have been sketched (an updated index can get by with the graphs it already has)
+	numGraphs := numBuilt - numMasked
+	if numGraphs == 0 && len(graphStore) == numBuilt {
 		misc.ErrorCheck(fmt.Errorf("could not create and sketch any graphs"))
 	}
-	log.Printf("\tnumber of groot graphs built: %d", len(graphStore))
+	log.Printf("\tnumber of groot graphs built: %d", numBuilt)
 	log.Printf("\t\tgraphs sketched: %d", numGraphs)
 	log.Printf("\t\tgraph windows processed: %d", numWindows)
-	log.Printf("\t\tmean approximate distinct sketches per graph: %.2f%%", (propDistinctSketches/float64(numGraphs))*100)
+	if numGraphs != 0 {
+		log.Printf("\t\tmean approximate distinct sketches per graph: %.2f%%", (propDistinctSketches/float64(numGraphs))*100)
+	}
+	if len(graphStore) != numBuilt {
+		log.Printf("\tnumber of groot graphs in the updated index: %d", len(graphStore))
+	}
 
 	// add the graphs to the pipeline info
 	proc.info.Store = graphStore
@@ -183,9 +339,12 @@ func (proc *SketchIndexer) Connect(previous *GraphSketcher) {
 // Run is the method to run this process, which satisfies the pipeline interface
 func (proc *SketchIndexer) Run() {
 
-	// create the containment index struct
-	numKmers := ((proc.info.WindowSize - proc.info.KmerSize) + 1)
-	index := lshe.InitIndex(proc.info.NumPart, proc.info.MaxK, numKmers, proc.info.SketchSize)
+	// create the containment index struct, or add to the existing one if the index is being updated
+	index := proc.info.db
+	if index == nil {
+		numKmers := ((proc.info.WindowSize - proc.info.KmerSize) + 1)
+		index = lshe.InitIndex(proc.info.NumPart, proc.info.MaxK, numKmers, proc.info.SketchSize, proc.info.SketchAlgorithm)
+	}
 
 	// collect the window sketches from each graph
 	sketchCount := 0
@@ -206,6 +365,89 @@ func (proc *SketchIndexer) Run() {
 	}
 
 	// the index has all the windows, now add it to the runtime info for serialisation
-	proc.info.AttachDB(index)
+	misc.ErrorCheck(proc.info.AttachDB(index))
 	log.Printf("\tnumber of sketches added to the LSH Ensemble index: %d\n", sketchCount)
 }
+
+// MergeIndexes is a function to merge several indexes into one, so that reads can be aligned against several databases at once
+/* the indexes must have been built with the same k-mer size, sketch size, window size and sketch algorithm:
+-1. the graphs are renumbered so that their IDs don't collide, and tagged with the name of their database (unless they were already tagged in a merged index)
+-2. the windows are given the new graph IDs and added to a new containment index (the LSH Ensemble is built when the merged index is saved)
+-3. the LSH Ensemble parameters are taken from the first index
+-4. the MSA files aren't recorded for the merged index (their names can clash between databases), so clusters are matched to graphs by their sequence IDs if the merged index is updated
+the graphs and windows of the input indexes are moved to the merged index, so the input indexes shouldn't be used afterwards
+*/
+func MergeIndexes(indexes []*Info, databases []string) (*Info, error) {
+	if len(indexes) < 2 {
+		return nil, fmt.Errorf("need at least two indexes to merge")
+	}
+	if len(databases) != len(indexes) {
+		return nil, fmt.Errorf("number of database names (%d) does not match the number of indexes (%d)", len(databases), len(indexes))
+	}
+	for i, index := range indexes {
+		if index.db == nil {
+			return nil, fmt.Errorf("no LSH Ensemble attached to index for %v", databases[i])
+		}
+	}
+
+	// the merged index takes its parameters from the first index
+	first := indexes[0]
+	merged := &Info{
+		Version:         version.GetVersion(),
+		KmerSize:        first.KmerSize,
+		SketchSize:      first.SketchSize,
+		WindowSize:      first.WindowSize,
+		NumPart:         first.NumPart,
+		MaxK:            first.MaxK,
+		MaxSketchSpan:   first.MaxSketchSpan,
+		SketchAlgorithm: first.SketchAlgorithm,
+		Store:           make(graph.Store),
+	}
+	merged.db = lshe.InitIndex(first.db.NumPart, first.db.MaxK, first.db.NumWindowKmers, first.db.SketchSize, first.db.Algorithm)
+
+	// add the graphs and windows from each index in turn
+	nextID := uint32(0)
+	for i, index := range indexes {
+		if index.KmerSize != merged.KmerSize || index.SketchSize != merged.SketchSize || index.WindowSize != merged.WindowSize || index.SketchAlgorithm != merged.SketchAlgorithm {
+			return nil, fmt.Errorf("index for %v was built with different parameters to the index for %v (k-mer size %d vs. %d, sketch size %d vs. %d, window size %d vs. %d, sketch algorithm %v vs. %v)", databases[i], databases[0], index.KmerSize, merged.KmerSize, index.SketchSize, merged.SketchSize, index.WindowSize, merged.WindowSize, index.SketchAlgorithm, merged.SketchAlgorithm)
+		}
+		if index.MaxSketchSpan > merged.MaxSketchSpan {
+			merged.MaxSketchSpan = index.MaxSketchSpan
+		}
+
+		// renumber the graphs in order of their old IDs, so that merging is repeatable
+		graphIDs := make([]uint32, 0, len(index.Store))
+		for graphID := range index.Store {
+			graphIDs = append(graphIDs, graphID)
+		}
+		sort.Slice(graphIDs, func(a, b int) bool { return graphIDs[a] < graphIDs[b] })
+		newIDs := make(map[uint32]uint32, len(graphIDs))
+		for _, graphID := range graphIDs {
+			grootGraph := index.Store[graphID]
+			grootGraph.GraphID = nextID
+			if grootGraph.Database == "" {
+				grootGraph.Database = databases[i]
+			}
+			merged.Store[nextID] = grootGraph
+			newIDs[graphID] = nextID
+			nextID++
+		}
+
+		// the window lookups start with the graph ID, so they are rewritten with the new ID
+		for windowLookup, window := range index.db.WindowLookup {
+			newID, ok := newIDs[window.GraphID]
+			if !ok {
+				return nil, fmt.Errorf("index for %v has a window for a graph that isn't in the graph store (graph ID: %d)", databases[i], window.GraphID)
+			}
+			prefix := fmt.Sprintf("g%dn", window.GraphID)
+			if !strings.HasPrefix(windowLookup, prefix) {
+				return nil, fmt.Errorf("index for %v has a window lookup that doesn't match its graph ID: %v", databases[i], windowLookup)
+			}
+			window.GraphID = newID
+			if err := merged.db.AddWindow(fmt.Sprintf("g%dn%v", newID, windowLookup[len(prefix):]), window); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return merged, nil
+}
@@ -0,0 +1,182 @@
+package pipeline
+
+/*
+ this part of the pipeline is used to describe the contents of an index, so that the graphs and windows can be checked without writing any code
+*/
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+)
+
+// IndexReport describes the contents of an index
+type IndexReport struct {
+	Version       string           `json:"version"`       // the version of GROOT that created the index
+	FormatVersion uint32           `json:"formatVersion"` // the format version of the graph store file
+	Params        misc.IndexParams `json:"params"`
+	NumGraphs     int              `json:"numGraphs"`  // the number of graphs in the index (before filtering)
+	NumWindows    int              `json:"numWindows"` // the number of windows in the LSH Ensemble (before filtering)
+	Graphs        []GraphReport    `json:"graphs"`
+	Windows       []WindowReport   `json:"windows,omitempty"`
+}
+
+// GraphReport describes a graph in an index
+type GraphReport struct {
+	GraphID          uint32       `json:"graphID"`
+	Database         string       `json:"database,omitempty"`
+	NumNodes         int          `json:"numNodes"`
+	Masked           bool         `json:"masked"`
+	NumWindows       int          `json:"numWindows"`       // the number of windows sketched
+	DistinctSketches int          `json:"distinctSketches"` // the number of windows left after merging identical neighbouring sketches
+	MaxSpan          int          `json:"maxSpan"`          // the most windows merged into one
+	Paths            []PathReport `json:"paths"`
+}
+
+// PathReport describes a reference sequence held in a graph
+type PathReport struct {
+	PathID uint32 `json:"pathID"`
+	Name   string `json:"name"`
+	Length int    `json:"length"`
+}
+
+// WindowReport describes a window in the LSH Ensemble
+type WindowReport struct {
+	Lookup         string             `json:"lookup"`
+	GraphID        uint32             `json:"graphID"`
+	Node           uint64             `json:"node"`
+	OffSet         uint32             `json:"offset"`
+	MergeSpan      uint32             `json:"mergeSpan"`
+	Refs           []string           `json:"refs"`
+	ContainedNodes map[uint64]float64 `json:"containedNodes"`
+}
+
+// Inspect is a method to describe the contents of the index, the LSH Ensemble must be attached
+/* the report can be filtered:
+-1. graphIDs limits the report to the listed graphs
+-2. refs limits the report to graphs with a reference sequence whose name contains one of the listed names, and the windows to those from a matching reference sequence
+-3. the windows are only described if windows is true, as there are a lot of them
+*/
+func (Info *Info) Inspect(graphIDs []uint32, refs []string, windows bool) (*IndexReport, error) {
+	if Info.db == nil {
+		return nil, fmt.Errorf("no LSH Ensemble attached to the index")
+	}
+	report := &IndexReport{
+		Version:       Info.Version,
+		FormatVersion: Info.FormatVersion(),
+		Params:        Info.IndexParams(),
+		NumGraphs:     len(Info.Store),
+		NumWindows:    len(Info.db.WindowLookup),
+	}
+
+	// group the windows by graph
+	graphWindows := make(map[uint32][]string)
+	for lookup, window := range Info.db.WindowLookup {
+		graphWindows[window.GraphID] = append(graphWindows[window.GraphID], lookup)
+	}
+
+	// work out which graphs to report
+	keepGraph := make(map[uint32]bool, len(graphIDs))
+	for _, graphID := range graphIDs {
+		if _, ok := Info.Store[graphID]; !ok {
+			return nil, fmt.Errorf("graph %d is not in the index", graphID)
+		}
+		keepGraph[graphID] = true
+	}
+	matchRef := func(name []byte) bool {
+		if len(refs) == 0 {
+			return true
+		}
+		for _, ref := range refs {
+			if strings.Contains(string(name), ref) {
+				return true
+			}
+		}
+		return false
+	}
+	sortedIDs := make([]uint32, 0, len(Info.Store))
+	for graphID := range Info.Store {
+		sortedIDs = append(sortedIDs, graphID)
+	}
+	sort.Slice(sortedIDs, func(a, b int) bool { return sortedIDs[a] < sortedIDs[b] })
+	for _, graphID := range sortedIDs {
+		if len(keepGraph) != 0 && !keepGraph[graphID] {
+			continue
+		}
+		grootGraph := Info.Store[graphID]
+		graphReport := GraphReport{
+			GraphID:  graphID,
+			Database: grootGraph.Database,
+			NumNodes: len(grootGraph.SortedNodes),
+			Masked:   grootGraph.Masked,
+		}
+
+		// get the paths, checking if any match the requested references
+		matchedPaths := make(map[uint32]bool)
+		for pathID, name := range grootGraph.Paths {
+			graphReport.Paths = append(graphReport.Paths, PathReport{PathID: pathID, Name: string(name), Length: grootGraph.Lengths[pathID]})
+			if matchRef(name) {
+				matchedPaths[pathID] = true
+			}
+		}
+		if len(matchedPaths) == 0 {
+			continue
+		}
+		sort.Slice(graphReport.Paths, func(a, b int) bool { return graphReport.Paths[a].PathID < graphReport.Paths[b].PathID })
+
+		// the sketch stats aren't saved with the graph, so they are restored from the windows
+		lookups := graphWindows[graphID]
+		if !grootGraph.Masked {
+			keys := make(lshe.Keys, len(lookups))
+			for i, lookup := range lookups {
+				keys[i] = Info.db.WindowLookup[lookup]
+			}
+			grootGraph.SetSketchStats(Info.WindowSize, keys)
+			graphReport.NumWindows, graphReport.DistinctSketches, graphReport.MaxSpan, _ = grootGraph.GetSketchStats()
+		}
+		report.Graphs = append(report.Graphs, graphReport)
+
+		// describe the windows from the matched paths
+		if !windows {
+			continue
+		}
+		for _, lookup := range lookups {
+			window := Info.db.WindowLookup[lookup]
+			windowReport := WindowReport{
+				Lookup:         lookup,
+				GraphID:        window.GraphID,
+				Node:           window.Node,
+				OffSet:         window.OffSet,
+				MergeSpan:      window.MergeSpan,
+				ContainedNodes: window.ContainedNodes,
+			}
+			keep := false
+			for _, pathID := range window.Ref {
+				windowReport.Refs = append(windowReport.Refs, string(grootGraph.Paths[pathID]))
+				keep = keep || matchedPaths[pathID]
+			}
+			if keep {
+				report.Windows = append(report.Windows, windowReport)
+			}
+		}
+	}
+
+	// order the windows by their position in the graphs
+	sort.Slice(report.Windows, func(a, b int) bool {
+		x, y := report.Windows[a], report.Windows[b]
+		if x.GraphID != y.GraphID {
+			return x.GraphID < y.GraphID
+		}
+		if x.Node != y.Node {
+			return x.Node < y.Node
+		}
+		if x.OffSet != y.OffSet {
+			return x.OffSet < y.OffSet
+		}
+		return x.Lookup < y.Lookup
+	})
+	return report, nil
+}
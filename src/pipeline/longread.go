@@ -0,0 +1,536 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/graph"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/misc"
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// segmentHit holds the graph windows that a segment of a long read mapped to
+type segmentHit struct {
+	start    int // the position of the segment in the read
+	end      int
+	mappings lshe.Keys
+}
+
+// longReadTracker collects the alignments for a long read from each graph minion that the read was sent to
+type longReadTracker struct {
+	pending        int                 // the number of graph minions yet to report for this read
+	records        []*sam.Record       // the alignments for the read
+	classification *ReadClassification // the classification for the read (per-read report only)
+}
+
+// longReadAlignment is used by a graph minion to report the alignments it found for a long read
+type longReadAlignment struct {
+	tracker *longReadTracker
+	records []*sam.Record
+}
+
+// segmentRun is the alignment of a run of contiguous read segments, which can be to several references that share the same alignment
+type segmentRun struct {
+	refs    map[*sam.Reference]int // the start of the alignment on each reference
+	start   int                    // the start of the alignment on the read (in the orientation of the alignment)
+	end     int                    // the end of the alignment on the read (in the orientation of the alignment)
+	columns []segmentColumn        // the alignment, in reference order
+	reverse bool                   // the alignment is to the reverse strand
+}
+
+// segmentColumn is a column of the alignment for a segment run
+type segmentColumn struct {
+	op  sam.CigarOpType // CigarMatch, CigarEqual or CigarMismatch for aligned bases, otherwise CigarInsertion or CigarDeletion
+	ref byte            // the reference base for mismatches and deletions (0 otherwise)
+}
+
+// tileRead is a function to get the start positions of the window sized segments to use for a long read
+// segments overlap by k-1 bases so that every k-mer is in a segment, and the final segment is anchored to the end of the read
+func tileRead(readLength, windowSize, kmerSize int) []int {
+	if readLength <= windowSize {
+		return []int{0}
+	}
+	step := windowSize - kmerSize + 1
+	if step < 1 {
+		step = 1
+	}
+	starts := []int{}
+	for start := 0; start+windowSize < readLength; start += step {
+		starts = append(starts, start)
+	}
+	return append(starts, readLength-windowSize)
+}
+
+// queryLongRead is a method to tile a long read into window sized segments and query the LSH Ensemble with each one, returning the segment hits for each graph
+func (theBoss *theBoss) queryLongRead(read *seqio.FASTQread) (map[uint32][]segmentHit, error) {
+	hits := make(map[uint32][]segmentHit)
+	for _, start := range tileRead(len(read.Seq), theBoss.info.WindowSize, theBoss.info.KmerSize) {
+		end := start + theBoss.info.WindowSize
+		segment := &seqio.FASTQread{Sequence: seqio.Sequence{ID: read.ID, Seq: read.Seq[start:end]}}
+		results, err := theBoss.queryRead(segment)
+		if err != nil {
+			return nil, err
+		}
+		for graphID, mappings := range results {
+			hits[graphID] = append(hits[graphID], segmentHit{start: start, end: end, mappings: mappings})
+		}
+	}
+	return hits, nil
+}
+
+// sendLongRead is a method to send a long read and its segment hits to the graph minions
+// the classification for the per-read report (nil if not requested) is written by the boss once the read has been aligned
+func (theBoss *theBoss) sendLongRead(read *seqio.FASTQread, hits map[uint32][]segmentHit, classification *ReadClassification) {
+	if len(hits) == 0 {
+		theBoss.sendClassification(classification, nil)
+		return
+	}
+
+	// the tracker lets the boss know when all the graphs have reported alignments for this read, so that one can be made the primary alignment
+	tracker := &longReadTracker{pending: len(hits), classification: classification}
+	for graphID, segments := range hits {
+		theBoss.graphMinionRegister[graphID].inputChannel <- &graphMinionPair{
+			read:     *read,
+			segments: segments,
+			longRead: tracker,
+		}
+	}
+}
+
+// processSegments is a method to weight the graph using the segment hits for a long read and then return the alignments for each run of contiguous segments (if exact alignment is requested)
+// each run gets a record for every reference that shares its alignment, the boss picks the primary alignment once every graph has reported
+func (graphMinion *graphMinion) processSegments(read *seqio.FASTQread, segments []segmentHit) []*sam.Record {
+	kmerSize := graphMinion.boss.info.KmerSize
+	runs := []*segmentRun{}
+	lastKmer := -1
+	for _, segment := range segments {
+
+		// segments overlap, so only weight the graph using the k-mers that haven't been counted for a previous segment
+		firstKmer := segment.start
+		if firstKmer <= lastKmer {
+			firstKmer = lastKmer + 1
+		}
+		segmentKmers := segment.end - kmerSize + 1 - segment.start
+		weighting := float64(segment.end-kmerSize+1-firstKmer) / float64(segmentKmers)
+		lastKmer = segment.end - kmerSize
+
+		// align the segment and add it to the runs of contiguous segments
+		segmentRead := &seqio.FASTQread{
+			Sequence: seqio.Sequence{ID: read.ID, Seq: append([]byte(nil), read.Seq[segment.start:segment.end]...)},
+			RG:       read.RG,
+		}
+		if records, _ := graphMinion.processMappings(segmentRead, segment.mappings, weighting); len(records) != 0 {
+			run, err := newSegmentRun(records, segment, len(read.Seq))
+			misc.ErrorCheck(err)
+			runs = addSegment(runs, run)
+		}
+	}
+	records := []*sam.Record{}
+	for _, run := range runs {
+		records = append(records, run.toRecords(read)...)
+	}
+	return records
+}
+
+// newSegmentRun is a function to get the run for a single segment from its alignment records (one record per reference)
+// the records are ranked by AlignRead, so the first record is the best alignment and the run keeps the references that share it
+func newSegmentRun(records []*sam.Record, segment segmentHit, readLength int) (*segmentRun, error) {
+	best := records[0]
+	md := ""
+	if aux, ok := best.Tag([]byte("MD")); ok {
+		md, _ = aux.Value().(string)
+	}
+	columns, clipped, err := expandAlignment(best.Cigar, md)
+	if err != nil {
+		return nil, fmt.Errorf("could not get the alignment for %v: %v", best.Name, err)
+	}
+	run := &segmentRun{refs: make(map[*sam.Reference]int), columns: columns, reverse: best.Flags&sam.Reverse != 0}
+	for _, record := range records {
+		if aux, ok := record.Tag([]byte("MD")); ok && aux.Value() == md && record.Cigar.String() == best.Cigar.String() {
+			run.refs[record.Ref] = record.Pos
+		}
+	}
+
+	// reverse strand alignments were made using the reverse complement of the segment, which starts at readLength-segment.end in the reverse complement of the read
+	run.start = segment.start + clipped
+	if run.reverse {
+		run.start = readLength - segment.end + clipped
+	}
+	run.end = run.start
+	for _, column := range columns {
+		if column.op != sam.CigarDeletion {
+			run.end++
+		}
+	}
+	return run, nil
+}
+
+// expandAlignment is a function to get the alignment columns from the CIGAR and MD tag of a record, along with the number of bases clipped from the start of the read
+func expandAlignment(cigar sam.Cigar, md string) ([]segmentColumn, int, error) {
+
+	// get the reference base for each reference position in the alignment from the MD tag (0 for matches)
+	refBases := []byte{}
+	for i := 0; i < len(md); {
+		switch c := md[i]; {
+		case c >= '0' && c <= '9':
+			n := 0
+			for ; i < len(md) && md[i] >= '0' && md[i] <= '9'; i++ {
+				n = n*10 + int(md[i]-'0')
+			}
+			refBases = append(refBases, make([]byte, n)...)
+		case c == '^':
+			i++
+		default:
+			refBases = append(refBases, c)
+			i++
+		}
+	}
+
+	// walk the CIGAR to get the columns
+	columns := []segmentColumn{}
+	clipped, refPos := 0, 0
+	for i, op := range cigar {
+		switch op.Type() {
+		case sam.CigarSoftClipped, sam.CigarHardClipped:
+			if i == 0 {
+				clipped = op.Len()
+			}
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch, sam.CigarDeletion:
+			if refPos+op.Len() > len(refBases) {
+				return nil, 0, fmt.Errorf("MD tag (%v) does not match CIGAR (%v)", md, cigar)
+			}
+			for j := 0; j < op.Len(); j++ {
+				columns = append(columns, segmentColumn{op: op.Type(), ref: refBases[refPos]})
+				refPos++
+			}
+		case sam.CigarInsertion:
+			for j := 0; j < op.Len(); j++ {
+				columns = append(columns, segmentColumn{op: sam.CigarInsertion})
+			}
+		}
+	}
+	if refPos != len(refBases) {
+		return nil, 0, fmt.Errorf("MD tag (%v) does not match CIGAR (%v)", md, cigar)
+	}
+	return columns, clipped, nil
+}
+
+// addSegment is a function to add a segment to the runs of contiguous segments
+// the segment extends the previous run if they overlap on the read and can be merged (see mergeRuns)
+func addSegment(runs []*segmentRun, segment *segmentRun) []*segmentRun {
+	if len(runs) != 0 {
+		if merged := mergeRuns(runs[len(runs)-1], segment); merged != nil {
+			runs[len(runs)-1] = merged
+			return runs
+		}
+	}
+	return append(runs, segment)
+}
+
+// mergeRuns is a function to merge two runs that are in the same orientation and overlap (or abut) on the read, returning nil if they can't be merged
+// the runs are joined at a read base that both align to the same position on a reference, choosing the base that keeps the most references
+func mergeRuns(a, b *segmentRun) *segmentRun {
+	if b.start < a.start {
+		a, b = b, a
+	}
+	if a.reverse != b.reverse || b.start > a.end {
+		return nil
+	}
+	aColumns, aOffsets := a.readBases()
+	bColumns, bOffsets := b.readBases()
+	join, sharedRefs := 0, map[*sam.Reference]int{}
+	for pos := b.start; pos <= a.end && pos < b.end; pos++ {
+		aOffset, bOffset := aOffsets[pos-a.start], bOffsets[pos-b.start]
+		if aOffset < 0 || bOffset < 0 {
+			continue
+		}
+		refs := make(map[*sam.Reference]int)
+		for ref, aPos := range a.refs {
+			if bPos, ok := b.refs[ref]; ok && aPos+aOffset == bPos+bOffset {
+				refs[ref] = aPos
+			}
+		}
+		if len(refs) > len(sharedRefs) {
+			join, sharedRefs = pos, refs
+		}
+	}
+	if len(sharedRefs) == 0 {
+		return nil
+	}
+	merged := &segmentRun{refs: sharedRefs, start: a.start, end: a.end, columns: a.columns, reverse: a.reverse}
+	if b.end > a.end {
+		merged.end = b.end
+		merged.columns = append(append([]segmentColumn(nil), a.columns[:aColumns[join-a.start]]...), b.columns[bColumns[join-b.start]:]...)
+	}
+	return merged
+}
+
+// readBases is a method to get the column for each read base in a run, along with the offset of the base on the reference (-1 for inserted bases)
+// an extra entry is added for the end of the run, so that runs that abut on the read can be joined
+func (segmentRun *segmentRun) readBases() ([]int, []int) {
+	columns := make([]int, 0, segmentRun.end-segmentRun.start+1)
+	offsets := make([]int, 0, segmentRun.end-segmentRun.start+1)
+	refOffset := 0
+	for i, column := range segmentRun.columns {
+		switch column.op {
+		case sam.CigarDeletion:
+			refOffset++
+		case sam.CigarInsertion:
+			columns = append(columns, i)
+			offsets = append(offsets, -1)
+		default:
+			columns = append(columns, i)
+			offsets = append(offsets, refOffset)
+			refOffset++
+		}
+	}
+	return append(columns, len(segmentRun.columns)), append(offsets, refOffset)
+}
+
+// toRecords is a method to convert a segment run to SAM records for the whole read (one for each reference in the run), the unaligned parts of the read are soft clipped
+// the CIGAR, NM, MD and AS tags are worked out from the alignment columns, the primary alignment and the MAPQs are set by setSupplementaryInfo
+func (segmentRun *segmentRun) toRecords(read *seqio.FASTQread) []*sam.Record {
+	fullRead := &seqio.FASTQread{Sequence: seqio.Sequence{Seq: append([]byte(nil), read.Seq...)}, Qual: append([]byte(nil), read.Qual...)}
+	if segmentRun.reverse {
+		fullRead.RevComplement()
+	}
+	cigar := sam.Cigar{}
+	addOp := func(op sam.CigarOpType, n int) {
+		if last := len(cigar) - 1; last >= 0 && cigar[last].Type() == op {
+			cigar[last] = sam.NewCigarOp(op, cigar[last].Len()+n)
+			return
+		}
+		cigar = append(cigar, sam.NewCigarOp(op, n))
+	}
+	if segmentRun.start != 0 {
+		addOp(sam.CigarSoftClipped, segmentRun.start)
+	}
+	var md strings.Builder
+	matched, matches, mismatches, nm := 0, 0, 0, 0
+	gaps := []int{}
+	for i, column := range segmentRun.columns {
+		addOp(column.op, 1)
+		switch column.op {
+		case sam.CigarInsertion, sam.CigarDeletion:
+			nm++
+			newGap := i == 0 || segmentRun.columns[i-1].op != column.op
+			if newGap {
+				gaps = append(gaps, 0)
+			}
+			gaps[len(gaps)-1]++
+			if column.op == sam.CigarDeletion {
+				if newGap {
+					fmt.Fprintf(&md, "%d^", matched)
+					matched = 0
+				}
+				md.WriteByte(column.ref)
+			}
+		default:
+			if column.ref == 0 {
+				matched++
+				matches++
+				continue
+			}
+			fmt.Fprintf(&md, "%d%c", matched, column.ref)
+			matched = 0
+			mismatches++
+			nm++
+		}
+	}
+	fmt.Fprintf(&md, "%d", matched)
+	if endClip := len(read.Seq) - segmentRun.end; endClip != 0 {
+		addOp(sam.CigarSoftClipped, endClip)
+	}
+	score := graph.ScoreAlignment(matches, mismatches, gaps)
+
+	// SAM records hold the raw quality scores, not the ASCII encoded FASTQ ones
+	var qual []byte
+	if len(fullRead.Qual) == len(fullRead.Seq) {
+		qual = make([]byte, len(fullRead.Qual))
+		for i, q := range fullRead.Qual {
+			qual[i] = q - 33
+		}
+	}
+
+	// make a record for each reference, these are sorted so that the output doesn't depend on map order
+	refs := make([]*sam.Reference, 0, len(segmentRun.refs))
+	for ref := range segmentRun.refs {
+		refs = append(refs, ref)
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].ID() < refs[j].ID()
+	})
+	records := make([]*sam.Record, 0, len(refs))
+	for _, ref := range refs {
+		record := &sam.Record{
+			Name:  read.Name(),
+			Ref:   ref,
+			Pos:   segmentRun.refs[ref],
+			Cigar: append(sam.Cigar(nil), cigar...),
+			Seq:   sam.NewSeq(fullRead.Seq),
+			Qual:  qual,
+		}
+		if segmentRun.reverse {
+			record.Flags |= sam.Reverse
+		}
+		for _, tag := range []struct {
+			name  string
+			value interface{}
+		}{{"NM", nm}, {"MD", md.String()}, {"AS", score}} {
+			if aux, err := sam.NewAux(sam.NewTag(tag.name), tag.value); err == nil {
+				record.AuxFields = append(record.AuxFields, aux)
+			}
+		}
+		if read.RG != "" {
+			if aux, err := sam.NewAux(sam.NewTag("RG"), read.RG); err == nil {
+				record.AuxFields = append(record.AuxFields, aux)
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// setSupplementaryInfo is a function to pick the primary alignment for a long read and mark the rest as secondary or supplementary
+// the alignments are grouped by the part of the read they cover and RankAlignments picks the best alignment in each group (setting the MAPQs, the others are secondary as for short reads)
+// the longest of the best alignments is the primary alignment, the others are supplementary, these are hard clipped and get an SA tag listing the others
+func setSupplementaryInfo(records []*sam.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	// group the alignments that cover the same part of the read (overlapping by more than half of the shorter alignment)
+	sort.SliceStable(records, func(a, b int) bool {
+		aStart, aEnd := readSpan(records[a])
+		bStart, bEnd := readSpan(records[b])
+		if aStart != bStart {
+			return aStart < bStart
+		}
+		return aEnd < bEnd
+	})
+	groups := [][]*sam.Record{}
+	for _, record := range records {
+		start, end := readSpan(record)
+		grouped := false
+		for i, group := range groups {
+			groupStart, groupEnd := readSpan(group[0])
+			overlap, shortest := end, end-start
+			if groupEnd < overlap {
+				overlap = groupEnd
+			}
+			if groupStart > start {
+				overlap -= groupStart
+			} else {
+				overlap -= start
+			}
+			if groupEnd-groupStart < shortest {
+				shortest = groupEnd - groupStart
+			}
+			if overlap*2 > shortest {
+				groups[i] = append(group, record)
+				grouped = true
+				break
+			}
+		}
+		if !grouped {
+			groups = append(groups, []*sam.Record{record})
+		}
+	}
+	best := make([]*sam.Record, len(groups))
+	for i, group := range groups {
+		if err := graph.RankAlignments(group); err != nil {
+			return err
+		}
+		best[i] = group[0]
+	}
+
+	// pick the primary alignment from the best alignment in each group
+	primary := 0
+	for i, record := range best {
+		if alignedLength(record) > alignedLength(best[primary]) {
+			primary = i
+		}
+	}
+	for i, record := range best {
+		if i != primary {
+			record.Flags |= sam.Supplementary
+			hardClip(record)
+		}
+	}
+	if len(best) == 1 {
+		return nil
+	}
+	for i, record := range best {
+		others := []string{}
+		for j, other := range best {
+			if i == j {
+				continue
+			}
+			strand := "+"
+			if other.Flags&sam.Reverse != 0 {
+				strand = "-"
+			}
+			var nm interface{} = 0
+			if aux, ok := other.Tag([]byte("NM")); ok {
+				nm = aux.Value()
+			}
+			others = append(others, fmt.Sprintf("%v,%d,%v,%v,%d,%v;", other.Ref.Name(), other.Pos+1, strand, other.Cigar, other.MapQ, nm))
+		}
+		aux, err := sam.NewAux(sam.NewTag("SA"), strings.Join(others, ""))
+		if err != nil {
+			return err
+		}
+		record.AuxFields = append(record.AuxFields, aux)
+	}
+	return nil
+}
+
+// readSpan is a function to get the part of the read covered by an alignment, in the orientation the read was given in
+func readSpan(record *sam.Record) (int, int) {
+	startClip, endClip, length := 0, 0, 0
+	for i, op := range record.Cigar {
+		switch op.Type() {
+		case sam.CigarSoftClipped, sam.CigarHardClipped:
+			if i == 0 {
+				startClip = op.Len()
+			} else {
+				endClip = op.Len()
+			}
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch, sam.CigarInsertion:
+			length += op.Len()
+		}
+	}
+	if record.Flags&sam.Reverse != 0 {
+		return endClip, endClip + length
+	}
+	return startClip, startClip + length
+}
+
+// alignedLength is a function to get the number of aligned read bases in a record
+func alignedLength(record *sam.Record) int {
+	start, end := readSpan(record)
+	return end - start
+}
+
+// hardClip is a function to convert the soft clipping of a record to hard clipping, removing the clipped bases from the record
+func hardClip(record *sam.Record) {
+	start, end := 0, record.Seq.Length
+	for i, op := range record.Cigar {
+		if op.Type() != sam.CigarSoftClipped {
+			continue
+		}
+		if i == 0 {
+			start = op.Len()
+		} else {
+			end -= op.Len()
+		}
+		record.Cigar[i] = sam.NewCigarOp(sam.CigarHardClipped, op.Len())
+	}
+	record.Seq = sam.NewSeq(record.Seq.Expand()[start:end])
+	if len(record.Qual) != 0 {
+		record.Qual = record.Qual[start:end]
+	}
+}
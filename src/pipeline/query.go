@@ -0,0 +1,156 @@
+package pipeline
+
+/*
+ this part of the pipeline is used to look up a single sequence in the index, reporting every graph window it hits and how well it is contained in them
+*/
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// QueryHit is a graph window that a query sequence (or a window sized segment of it) was found in
+type QueryHit struct {
+	Query       string        // the ID of the query sequence
+	QueryStart  int           // the start of the query segment that hit the window (sequences longer than the window size are split into window sized segments)
+	QueryEnd    int           // the end of the query segment that hit the window
+	GraphID     uint32        // the graph that the window is from
+	Database    string        // the database that the graph came from (empty if not known)
+	Node        uint64        // the first node in the window
+	OffSet      uint32        // the offset of the window within the first node
+	Refs        []string      // the reference sequences that contain the window
+	Containment float64       // the estimated containment of the query segment in the window
+	RC          bool          // the query segment is on the reverse strand relative to the window
+	Alignments  []*sam.Record // the alignments of the query segment to the graph, starting from the window (only if alignment was requested)
+}
+
+// QuerySequence is a method to query the LSH Ensemble with a sequence, returning the hits sorted by containment (highest first)
+// the sequence is sketched using the index parameters and the runtime containment threshold, and each hit is aligned to its graph if requested (using the runtime alignment options)
+func (Info *Info) QuerySequence(query *seqio.FASTQread, align bool) ([]QueryHit, error) {
+	if Info.db == nil {
+		return nil, fmt.Errorf("no LSH Ensemble attached to the index")
+	}
+	if len(query.Seq) < Info.KmerSize {
+		return nil, fmt.Errorf("query sequence is shorter than the k-mer size (%d vs. %d)", len(query.Seq), Info.KmerSize)
+	}
+	var references map[int][]*sam.Reference
+	if align {
+		var err error
+		if references, err = Info.Store.GetSAMrefs(); err != nil {
+			return nil, err
+		}
+	}
+
+	// query each window sized segment of the sequence
+	hits := []QueryHit{}
+	for _, start := range tileRead(len(query.Seq), Info.WindowSize, Info.KmerSize) {
+		end := start + Info.WindowSize
+		if end > len(query.Seq) {
+			end = len(query.Seq)
+		}
+		segment := &seqio.FASTQread{Sequence: seqio.Sequence{ID: query.ID, Seq: query.Seq[start:end]}}
+		sketch, strands, err := segment.RunMinHash(Info.KmerSize, Info.SketchSize, Info.SketchAlgorithm, nil)
+		if err != nil {
+			return nil, err
+		}
+		results, err := Info.db.Query(sketch, strands, end-start-Info.KmerSize+1, Info.ContainmentThreshold)
+		if err != nil {
+			return nil, err
+		}
+		for graphID, windows := range results {
+			grootGraph, ok := Info.Store[graphID]
+			if !ok {
+				return nil, fmt.Errorf("query hit a graph that isn't in the graph store (graph ID: %d)", graphID)
+			}
+			for _, window := range windows {
+				hit := QueryHit{
+					Query:       segment.Name(),
+					QueryStart:  start,
+					QueryEnd:    end,
+					GraphID:     graphID,
+					Database:    grootGraph.Database,
+					Node:        window.Node,
+					OffSet:      window.OffSet,
+					Containment: window.Containment,
+					RC:          window.RC,
+				}
+				for _, pathID := range window.Ref {
+					hit.Refs = append(hit.Refs, string(grootGraph.Paths[pathID]))
+				}
+
+				// align the segment in the orientation found by the query, then try the other one (as the graph minions do)
+				// the alignment shuffles the window offset, so each attempt gets its own copy of the window
+				if align {
+					read := &seqio.FASTQread{Sequence: seqio.Sequence{ID: query.ID, Seq: append([]byte(nil), segment.Seq...)}}
+					if window.RC {
+						read.RevComplement()
+					}
+					for i := 0; i < 2 && len(hit.Alignments) == 0; i++ {
+						seed := window
+						if hit.Alignments, _, err = grootGraph.AlignRead(read, &seed, references[int(graphID)], Info.Sketch.Alignment); err != nil {
+							return nil, err
+						}
+						read.RevComplement()
+					}
+				}
+				hits = append(hits, hit)
+			}
+		}
+	}
+
+	// rank the hits
+	sort.Slice(hits, func(a, b int) bool {
+		x, y := hits[a], hits[b]
+		if x.Containment != y.Containment {
+			return x.Containment > y.Containment
+		}
+		if x.QueryStart != y.QueryStart {
+			return x.QueryStart < y.QueryStart
+		}
+		if x.GraphID != y.GraphID {
+			return x.GraphID < y.GraphID
+		}
+		if x.Node != y.Node {
+			return x.Node < y.Node
+		}
+		return x.OffSet < y.OffSet
+	})
+	return hits, nil
+}
+
+// LoadQueries is a function to read the query sequences from a FASTA file (which can be compressed)
+func LoadQueries(fileName string) ([]*seqio.FASTQread, error) {
+	scanner, closeInput, err := openInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+	parser := seqio.NewParser(fileName, true)
+	queries := []*seqio.FASTQread{}
+	for scanner.Scan() {
+		query, err := parser.Parse(scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if query != nil {
+			queries = append(queries, query)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	query, err := parser.Flush()
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		queries = append(queries, query)
+	}
+	if len(queries) == 0 {
+		return nil, fmt.Errorf("no query sequences found in %v", fileName)
+	}
+	return queries, nil
+}
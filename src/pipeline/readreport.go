@@ -0,0 +1,176 @@
+package pipeline
+
+/*
+ this part of the pipeline is used to report how each read was classified by the read mapper
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/biogo/hts/sam"
+	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/seqio"
+)
+
+// ReadClassification describes how a read was classified by the read mapper, one is written to the per-read report for every read
+type ReadClassification struct {
+	Read            string   `json:"read"`
+	NumHits         int      `json:"numHits"`         // the number of graph windows the read hit
+	Graphs          []uint32 `json:"graphs"`          // the graphs the read hit
+	BestContainment float64  `json:"bestContainment"` // the highest containment estimate of the read in any of the windows it hit
+	Aligned         bool     `json:"aligned"`         // an exact alignment was found for the read
+	References      []string `json:"references"`      // the references the read aligned to, or the references containing the best window if there was no exact alignment
+}
+
+// classificationUpdate is used to send a read classification to the boss when the read wasn't sent to any graph minions for alignment
+type classificationUpdate struct {
+	classification *ReadClassification
+	records        []*sam.Record
+}
+
+// readReporter writes the per-read report, it is only used by the boss's collector so that lines from different minions can't interleave
+type readReporter struct {
+	fh      *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder // only set for JSONL output
+}
+
+// newReadReporter will create the per-read report file and write the header (TSV only)
+func newReadReporter(fileName, format string) (*readReporter, error) {
+	if format != "tsv" && format != "jsonl" {
+		return nil, fmt.Errorf("unknown format for the per-read report: %v (must be tsv or jsonl)", format)
+	}
+	fh, err := os.Create(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for the per-read report: %v", err)
+	}
+	readReporter := &readReporter{fh: fh, writer: bufio.NewWriter(fh)}
+	if format == "jsonl" {
+		readReporter.encoder = json.NewEncoder(readReporter.writer)
+		return readReporter, nil
+	}
+	if _, err := fmt.Fprintf(readReporter.writer, "read\tnumHits\tgraphs\tbestContainment\taligned\treferences\n"); err != nil {
+		fh.Close()
+		return nil, err
+	}
+	return readReporter, nil
+}
+
+// write is a method to add a read classification to the report
+func (readReporter *readReporter) write(classification *ReadClassification) error {
+	if readReporter.encoder != nil {
+		return readReporter.encoder.Encode(classification)
+	}
+	graphs := make([]string, len(classification.Graphs))
+	for i, graphID := range classification.Graphs {
+		graphs[i] = strconv.FormatUint(uint64(graphID), 10)
+	}
+	_, err := fmt.Fprintf(readReporter.writer, "%v\t%d\t%v\t%.4f\t%v\t%v\n", classification.Read, classification.NumHits, joinOrDash(graphs), classification.BestContainment, classification.Aligned, joinOrDash(classification.References))
+	return err
+}
+
+// close is a method to flush and close the report
+func (readReporter *readReporter) close() error {
+	err := readReporter.writer.Flush()
+	if closeErr := readReporter.fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// joinOrDash is a function to join a list for a TSV field, using a dash for an empty list
+func joinOrDash(fields []string) string {
+	if len(fields) == 0 {
+		return "-"
+	}
+	return strings.Join(fields, ",")
+}
+
+// classifyRead is a method to describe the LSH Ensemble hits for a read, it returns nil if the per-read report wasn't requested
+// the references are set to those containing the best window, these are replaced by the aligned references if an exact alignment is found
+func (theBoss *theBoss) classifyRead(read *seqio.FASTQread, results map[uint32]lshe.Keys) *ReadClassification {
+	if theBoss.readReport == nil {
+		return nil
+	}
+	classification := &ReadClassification{Read: read.Name(), Graphs: []uint32{}, References: []string{}}
+	if read.Pair != 0 {
+		classification.Read = fmt.Sprintf("%v/%d", classification.Read, read.Pair)
+	}
+	bestRefs := make(map[string]struct{})
+	for graphID, hits := range results {
+		classification.NumHits += len(hits)
+		classification.Graphs = append(classification.Graphs, graphID)
+		for _, hit := range hits {
+			if hit.Containment < classification.BestContainment {
+				continue
+			}
+			if hit.Containment > classification.BestContainment {
+				classification.BestContainment = hit.Containment
+				bestRefs = make(map[string]struct{})
+			}
+			for _, pathID := range hit.Ref {
+				bestRefs[string(theBoss.info.Store[graphID].Paths[pathID])] = struct{}{}
+			}
+		}
+	}
+	sort.Slice(classification.Graphs, func(a, b int) bool { return classification.Graphs[a] < classification.Graphs[b] })
+	for ref := range bestRefs {
+		classification.References = append(classification.References, ref)
+	}
+	sort.Strings(classification.References)
+	return classification
+}
+
+// classifyLongRead is a method to describe the LSH Ensemble hits for all the segments of a long read, it returns nil if the per-read report wasn't requested
+func (theBoss *theBoss) classifyLongRead(read *seqio.FASTQread, hits map[uint32][]segmentHit) *ReadClassification {
+	results := make(map[uint32]lshe.Keys, len(hits))
+	for graphID, segments := range hits {
+		for _, segment := range segments {
+			results[graphID] = append(results[graphID], segment.mappings...)
+		}
+	}
+	return theBoss.classifyRead(read, results)
+}
+
+// sendClassification is a method for a minion to send a read classification to the boss's collector, it does nothing if the per-read report wasn't requested
+func (theBoss *theBoss) sendClassification(classification *ReadClassification, records []*sam.Record) {
+	if classification == nil {
+		return
+	}
+	theBoss.classifications <- &classificationUpdate{classification: classification, records: records}
+}
+
+// reportRead is a method used by the boss's collector to add the alignments for a read to its classification and write it, once every graph minion the read was sent to has reported
+func (theBoss *theBoss) reportRead(classification *ReadClassification, records []*sam.Record) error {
+	if classification == nil {
+		return nil
+	}
+	if len(records) != 0 {
+		if !classification.Aligned {
+			classification.Aligned = true
+			classification.References = classification.References[:0]
+		}
+		for _, record := range records {
+			if record.Flags&sam.Unmapped == 0 {
+				classification.References = append(classification.References, record.Ref.Name())
+			}
+		}
+	}
+
+	// remove any duplicate references before writing
+	sort.Strings(classification.References)
+	refs := classification.References[:0]
+	for _, ref := range classification.References {
+		if len(refs) == 0 || ref != refs[len(refs)-1] {
+			refs = append(refs, ref)
+		}
+	}
+	classification.References = refs
+	return theBoss.readReport.write(classification)
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io/ioutil"
-	"os"
 
+	"github.com/biogo/hts/sam"
 	"github.com/will-rowe/groot/src/graph"
 	"github.com/will-rowe/groot/src/lshe"
+	"github.com/will-rowe/groot/src/minhash"
+	"github.com/will-rowe/groot/src/misc"
 )
 
 // Info stores the runtime information
@@ -23,22 +25,51 @@ type Info struct {
 	MaxK                 int
 	MaxSketchSpan        int
 	ContainmentThreshold float64
+	SketchAlgorithm      minhash.Algorithm
 	IndexDir             string
 	Store                graph.Store
+	Clusters             map[string]Cluster // the MSA file each graph was built from, keyed by file name (indexes from older versions of GROOT don't have this)
 
 	// the following fields are not written to disk
-	Sketch    AlignCmd
-	Haplotype HaploCmd
-	db        *lshe.ContainmentIndex
+	Sketch        AlignCmd
+	Haplotype     HaploCmd
+	db            *lshe.ContainmentIndex
+	formatVersion uint32 // the format version of the index file the info was loaded from
 }
 
+// Cluster records the MSA file that a graph was built from, so that the index can be updated when the MSA changes
+type Cluster struct {
+	GraphID  uint32
+	Checksum uint32 // CRC32 checksum of the MSA file
+}
+
+// graphStoreContent identifies graph store index files in the index file header
+const graphStoreContent = "graphs"
+
 // AlignCmd stores the runtime info for the sketch command
 type AlignCmd struct {
-	Fasta           bool
-	BloomFilter     bool
-	MinKmerCoverage float64
-	BAMout          string
-	NoExactAlign    bool // turn off the exact alignment and BAM output - only used by WASP currently
+	Fasta            bool
+	BloomFilter      bool
+	MinKmerCoverage  float64
+	BAMout           string
+	SampleID         string                // the sample ID to use in the BAM read group
+	GraphDir         string                // if set, the weighted graphs are written here by the GraphPruner
+	NoExactAlign     bool                  // turn off the exact alignment and BAM output - only used by WASP currently
+	Paired           bool                  // the input is paired-end reads
+	Interleaved      bool                  // the paired-end reads are interleaved in each input file (otherwise the input files are R1/R2 pairs)
+	Concordance      string                // how pair concordance is used to adjust graph hits (none, boost or filter)
+	BAM              bool                  // the input is unaligned BAM/SAM
+	QualTrim         int                   // the minimum base quality used for quality trimming (0 turns off trimming)
+	MinLength        float64               // the minimum read length after trimming, as a proportion of the window size (reads shorter than the k-mer size are always removed)
+	MaxNfrac         float64               // the maximum proportion of N bases allowed in a read (0 turns off the check)
+	Adapters         [][]byte              // the adapter sequences to trim from the 3' end of reads
+	LongReads        bool                  // reads longer than the window size are tiled into window sized segments before querying the LSH Ensemble
+	ReadReport       string                // if set, the classification of each read is written here
+	ReadReportFormat string                // the format of the per-read report (tsv or jsonl)
+	GAFout           string                // if set, the alignments are also written here in GAF format
+	Alignment        graph.AlignmentParams // the options for aligning reads to the graphs
+	readGroups       []*sam.ReadGroup      // the read groups from BAM/SAM input, which are added to the output BAM (not exported as these can't be gob encoded)
+	kmerCounter      *minhash.KmerCounter  // the k-mer counts for the sample, set by the KmerCounter and used if BloomFilter is set
 }
 
 // HaploCmd stores the runtime info for the haplotype command
@@ -50,9 +81,26 @@ type HaploCmd struct {
 	HaploDir      string
 }
 
-// AttachDB is a method to attach a LSH Ensemble index to the runtime
-func (Info *Info) AttachDB(db *lshe.ContainmentIndex) {
+// AttachDB is a method to attach a LSH Ensemble index to the runtime, the index must use the same sketching parameters as the runtime
+func (Info *Info) AttachDB(db *lshe.ContainmentIndex) error {
+	if db.Algorithm != Info.SketchAlgorithm {
+		return fmt.Errorf("the LSH Ensemble index was built with %v sketches but the graph store uses %v sketches", db.Algorithm, Info.SketchAlgorithm)
+	}
+	if db.SketchSize != Info.SketchSize {
+		return fmt.Errorf("the LSH Ensemble index was built with a sketch size of %d but the graph store uses %d", db.SketchSize, Info.SketchSize)
+	}
 	Info.db = db
+	return nil
+}
+
+// Copy is a method to copy the runtime info for a new sample - the LSH Ensemble index is shared but the graph store is deep copied and the weights reset, so that samples are isolated
+func (Info *Info) Copy() *Info {
+	newInfo := *Info
+	newInfo.Store = Info.Store.Copy()
+	for _, g := range newInfo.Store {
+		g.ResetWeights()
+	}
+	return &newInfo
 }
 
 // SaveDB is a method to write an LSH Ensemble index to disk
@@ -62,13 +110,16 @@ func (Info *Info) SaveDB(filePath string) error {
 
 // Dump is a method to dump the pipeline info to file
 func (Info *Info) Dump(path string) error {
-	fh, err := os.Create(path)
-	defer fh.Close()
-	if err != nil {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(Info); err != nil {
 		return err
 	}
-	encoder := gob.NewEncoder(fh)
-	return encoder.Encode(Info)
+	header := misc.IndexHeader{
+		Content:  graphStoreContent,
+		Software: Info.Version,
+		Params:   Info.IndexParams(),
+	}
+	return misc.WriteIndexFile(path, header, payload.Bytes())
 }
 
 // Load is a method to load Info from file
@@ -80,12 +131,46 @@ func (Info *Info) Load(path string) error {
 	return Info.LoadFromBytes(data)
 }
 
-// LoadFromBytes is a method to load Info from bytes
+// LoadFromBytes is a method to load Info from bytes, older index files without a header are also accepted
 func (Info *Info) LoadFromBytes(data []byte) error {
 	if len(data) == 0 {
 		return fmt.Errorf("groot graph store appears empty")
 	}
-	buf := bytes.NewBuffer(data)
-	decoder := gob.NewDecoder(buf)
-	return decoder.Decode(Info)
+	header, payload, err := misc.ReadIndexFile(data, graphStoreContent)
+	switch {
+	case err == nil:
+		Info.formatVersion = header.FormatVersion
+	case err == misc.ErrLegacyIndex:
+		Info.formatVersion = 0
+		payload = data
+	default:
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(Info); err != nil {
+		return fmt.Errorf("could not decode %v index file: %v", graphStoreContent, err)
+	}
+
+	// indexes from before the sketch algorithm was recorded used KHF
+	if Info.SketchAlgorithm == "" {
+		Info.SketchAlgorithm = minhash.KHF
+	}
+	return nil
+}
+
+// FormatVersion is a method to get the format version of the index file that the info was loaded from
+func (Info *Info) FormatVersion() uint32 {
+	return Info.formatVersion
+}
+
+// IndexParams is a method to get the parameters used to build the index
+func (Info *Info) IndexParams() misc.IndexParams {
+	return misc.IndexParams{
+		KmerSize:        Info.KmerSize,
+		SketchSize:      Info.SketchSize,
+		WindowSize:      Info.WindowSize,
+		NumPart:         Info.NumPart,
+		MaxK:            Info.MaxK,
+		MaxSketchSpan:   Info.MaxSketchSpan,
+		SketchAlgorithm: string(Info.SketchAlgorithm),
+	}
 }
@@ -7,15 +7,20 @@ package pipeline
 import (
 	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
-	"strings"
 	"sync"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"github.com/will-rowe/groot/src/graph"
+	"github.com/will-rowe/groot/src/minhash"
 	"github.com/will-rowe/groot/src/misc"
 	"github.com/will-rowe/groot/src/seqio"
 )
@@ -24,12 +29,19 @@ import (
 type DataStreamer struct {
 	info   *Info
 	input  []string
-	output chan []byte
+	output chan *dataLine
+}
+
+// dataLine is a line of input data, along with where it came from so that it can be parsed and any errors reported properly
+type dataLine struct {
+	source string // the file the line came from (or STDIN)
+	mate   uint8  // 1 or 2 if the line came from an R1 or R2 file, otherwise 0
+	data   []byte
 }
 
 // NewDataStreamer is the constructor
 func NewDataStreamer(info *Info) *DataStreamer {
-	return &DataStreamer{info: info, output: make(chan []byte, BUFFERSIZE)}
+	return &DataStreamer{info: info, output: make(chan *dataLine, BUFFERSIZE)}
 }
 
 // Connect is the method to connect the DataStreamer to some data source
@@ -43,48 +55,145 @@ func (proc *DataStreamer) Run() {
 	var scanner *bufio.Scanner
 	// if an input file path has not been provided, scan the contents of STDIN
 	if len(proc.input) == 0 {
-		scanner = bufio.NewScanner(os.Stdin)
+		reader, closeReader, err := decompress(os.Stdin)
+		misc.ErrorCheck(err)
+		defer closeReader()
+		scanner = newLineScanner(reader)
 		for scanner.Scan() {
 			// important: copy content of scan to a new slice before sending, this avoids race conditions (as we are using multiple go routines) from concurrent slice access
-			proc.output <- append([]byte(nil), scanner.Bytes()...)
+			proc.output <- &dataLine{source: "STDIN", data: append([]byte(nil), scanner.Bytes()...)}
 		}
 		if scanner.Err() != nil {
 			log.Fatal(scanner.Err())
 		}
+	} else if proc.info.Sketch.Paired && !proc.info.Sketch.Interleaved {
+
+		// R1/R2 files are streamed in alternating chunks so that the reads of a pair reach the FastqHandler close together
+		for i := 0; i+1 < len(proc.input); i += 2 {
+			r1, closeR1, err := openInput(proc.input[i])
+			misc.ErrorCheck(err)
+			r2, closeR2, err := openInput(proc.input[i+1])
+			misc.ErrorCheck(err)
+			for {
+				r1lines, r2lines := scanLines(r1, 4), scanLines(r2, 4)
+				if len(r1lines) == 0 && len(r2lines) == 0 {
+					break
+				}
+				for _, line := range r1lines {
+					proc.output <- &dataLine{source: proc.input[i], mate: 1, data: line}
+				}
+				for _, line := range r2lines {
+					proc.output <- &dataLine{source: proc.input[i+1], mate: 2, data: line}
+				}
+			}
+			if r1.Err() != nil {
+				log.Fatal(r1.Err())
+			}
+			if r2.Err() != nil {
+				log.Fatal(r2.Err())
+			}
+			closeR1()
+			closeR2()
+		}
 	} else {
 		for i := 0; i < len(proc.input); i++ {
-			fh, err := os.Open(proc.input[i])
+			scanner, closeInput, err := openInput(proc.input[i])
 			misc.ErrorCheck(err)
-			defer fh.Close()
-			// handle gzipped input
-			splitFilename := strings.Split(proc.input[i], ".")
-			if splitFilename[len(splitFilename)-1] == "gz" {
-				gz, err := gzip.NewReader(fh)
-				misc.ErrorCheck(err)
-				defer gz.Close()
-				scanner = bufio.NewScanner(gz)
-			} else {
-				scanner = bufio.NewScanner(fh)
-			}
 			for scanner.Scan() {
-				proc.output <- append([]byte(nil), scanner.Bytes()...)
+				proc.output <- &dataLine{source: proc.input[i], data: append([]byte(nil), scanner.Bytes()...)}
 			}
 			if scanner.Err() != nil {
 				log.Fatal(scanner.Err())
 			}
+			closeInput()
+		}
+	}
+}
+
+// openInput is a function to open an input file and return a line scanner for it, along with a function to close the file
+func openInput(fileName string) (*bufio.Scanner, func(), error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, closeReader, err := decompress(fh)
+	if err != nil {
+		fh.Close()
+		return nil, nil, fmt.Errorf("could not read %v: %v", fileName, err)
+	}
+	return newLineScanner(reader), func() { closeReader(); fh.Close() }, nil
+}
+
+// maxLineLength is the longest line that the input scanners will accept (long reads can easily exceed the default 64KB)
+const maxLineLength = 64 * 1024 * 1024
+
+// newLineScanner is a function to get a line scanner that can handle long reads
+func newLineScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, bufio.MaxScanTokenSize), maxLineLength)
+	return scanner
+}
+
+// magic numbers for the supported compression formats
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// decompress is a function to wrap an input with a decompressor, using the magic number at the start of the input to identify the compression format
+// gzip (including bgzip and other multi-member gzip), bzip2, zstd and xz are supported, anything else is returned uncompressed
+func decompress(input io.Reader) (io.Reader, func(), error) {
+	bufferedInput := bufio.NewReader(input)
+	magic, err := bufferedInput.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(bufferedInput)
+		if err != nil {
+			return nil, nil, err
 		}
+		gz.Multistream(true)
+		return gz, func() { gz.Close() }, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(bufferedInput), func() {}, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(bufferedInput)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, zr.Close, nil
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(bufferedInput)
+		if err != nil {
+			return nil, nil, err
+		}
+		return xr, func() {}, nil
+	}
+	return bufferedInput, func() {}, nil
+}
+
+// scanLines is a function to collect up to n lines from a scanner (fewer are returned if the scanner runs out)
+func scanLines(scanner *bufio.Scanner, n int) [][]byte {
+	lines := make([][]byte, 0, n)
+	for len(lines) < n && scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
 	}
+	return lines
 }
 
 // WASMstreamer is a pipeline process that streams data from the WASM JS function
 type WASMstreamer struct {
 	input  chan []byte
-	output chan []byte
+	output chan *dataLine
 }
 
 // NewWASMstreamer is the constructor
 func NewWASMstreamer() *WASMstreamer {
-	return &WASMstreamer{output: make(chan []byte, BUFFERSIZE)}
+	return &WASMstreamer{output: make(chan *dataLine, BUFFERSIZE)}
 }
 
 // ConnectChan is a to connect the pipeline to the WASM JS function
@@ -139,7 +248,7 @@ func (proc *WASMstreamer) Run() {
 			line := bytes.TrimSpace(scanner.Bytes())
 
 			if len(line) > 0 {
-				proc.output <- append([]byte(nil), line...)
+				proc.output <- &dataLine{source: "WASM", data: append([]byte(nil), line...)}
 			}
 		}
 		if scanner.Err() != nil {
@@ -152,7 +261,7 @@ func (proc *WASMstreamer) Run() {
 // FastqHandler is a pipeline process to convert a pipeline to the FASTQ type
 type FastqHandler struct {
 	info   *Info
-	input  chan []byte
+	input  chan *dataLine
 	output chan *seqio.FASTQread
 }
 
@@ -174,79 +283,99 @@ func (proc *FastqHandler) Connect(previous *DataStreamer) {
 // Run is the method to run this process, which satisfies the pipeline interface
 func (proc *FastqHandler) Run() {
 	defer close(proc.output)
-	var l1, l2, l3, l4 []byte
-	if proc.info.Sketch.Fasta {
-		for line := range proc.input {
-			if len(line) == 0 {
-				break
-			}
-
-			// check for chevron
-			if line[0] == 62 {
-				if l1 != nil {
 
-					// store current fasta entry (as FASTQ read)
-					l1[0] = 64
-					newRead, err := seqio.NewFASTQread(l1, l2, nil, nil)
-					if err != nil {
-						log.Fatal(err)
-					}
-
-					// send on the new read and reset the line stores
-					proc.output <- newRead
-				}
-				l1, l2 = line, nil
-			} else {
-				l2 = append(l2, line...)
-			}
+	// each input source gets its own parser, so that line numbers are tracked per file and R1/R2 files can be streamed together
+	parsers := make(map[string]*seqio.Parser)
+	sources := []*dataLine{}
+	pairer := &readPairer{}
+	for line := range proc.input {
+		parser, ok := parsers[line.source]
+		if !ok {
+			parser = seqio.NewParser(line.source, proc.info.Sketch.Fasta)
+			parsers[line.source] = parser
+			sources = append(sources, line)
+		}
+		newRead, err := parser.Parse(line.data)
+		misc.ErrorCheck(err)
+		if newRead != nil {
+			proc.send(pairer, newRead, line.mate)
 		}
+	}
 
-		// flush final fasta
-		l1[0] = 64
-		newRead, err := seqio.NewFASTQread(l1, l2, nil, nil)
-		if err != nil {
-			log.Fatal(err)
+	// flush the final record from each input
+	for _, source := range sources {
+		newRead, err := parsers[source.source].Flush()
+		misc.ErrorCheck(err)
+		if newRead != nil {
+			proc.send(pairer, newRead, source.mate)
 		}
+	}
+	misc.ErrorCheck(pairer.check())
+}
 
-		// send on the new read and reset the line stores
+// send is a method to send a read on, if the input is paired the read is held until its mate arrives and then the pair is sent on together (as the first read)
+func (proc *FastqHandler) send(pairer *readPairer, newRead *seqio.FASTQread, mate uint8) {
+	if !proc.info.Sketch.Paired {
 		proc.output <- newRead
-	} else {
+		return
+	}
+	pair, err := pairer.add(newRead, mate)
+	misc.ErrorCheck(err)
+	if pair != nil {
+		proc.output <- pair
+	}
+}
 
-		// grab four lines and create a new FASTQread struct from them - perform some format checks and trim low quality bases
-		for line := range proc.input {
-			if l1 == nil {
-				l1 = line
-			} else if l2 == nil {
-				l2 = line
-			} else if l3 == nil {
-				l3 = line
-			} else if l4 == nil {
-				l4 = line
-
-				// create fastq read
-				newRead, err := seqio.NewFASTQread(l1, l2, l3, l4)
-				if err != nil {
-					log.Fatal(err)
-				}
+// readPairer pairs up reads, either from interleaved input (mate 0) or from R1/R2 files (mate 1 or 2)
+type readPairer struct {
+	queues [3][]*seqio.FASTQread
+}
 
-				// send on the new read and reset the line stores
-				proc.output <- newRead
-				l1, l2, l3, l4 = nil, nil, nil, nil
-			}
+// add is a method to add a read to the pairer, it returns the first read of a pair once both reads have been added
+func (readPairer *readPairer) add(read *seqio.FASTQread, mate uint8) (*seqio.FASTQread, error) {
+	readPairer.queues[mate] = append(readPairer.queues[mate], read)
+	var r1, r2 *seqio.FASTQread
+	switch {
+	case mate == 0 && len(readPairer.queues[0]) == 2:
+		r1, r2 = readPairer.queues[0][0], readPairer.queues[0][1]
+		readPairer.queues[0] = readPairer.queues[0][:0]
+	case mate != 0 && len(readPairer.queues[1]) != 0 && len(readPairer.queues[2]) != 0:
+		r1, r2 = readPairer.queues[1][0], readPairer.queues[2][0]
+		readPairer.queues[1], readPairer.queues[2] = readPairer.queues[1][1:], readPairer.queues[2][1:]
+	default:
+		return nil, nil
+	}
+	if err := seqio.PairReads(r1, r2); err != nil {
+		return nil, err
+	}
+	return r1, nil
+}
+
+// check is a method to make sure that no reads were left without a mate
+func (readPairer *readPairer) check() error {
+	for _, queue := range readPairer.queues {
+		if len(queue) != 0 {
+			return fmt.Errorf("paired input has a read without a mate: %v (check the R1/R2 files have the same number of reads)", string(queue[0].ID))
 		}
 	}
+	return nil
 }
 
+// minAdapterOverlap is the minimum number of bases that must match when trimming a partial adapter from the end of a read
+const minAdapterOverlap = 5
+
 // FastqChecker is a process to quality check FASTQ reads and send the sequence on for mapping
 type FastqChecker struct {
-	info   *Info
-	input  chan *seqio.FASTQread
-	output chan *seqio.FASTQread
+	info    *Info
+	input   chan *seqio.FASTQread
+	output  chan *seqio.FASTQread
+	qcStats [5]int // corresponds to num. reads received, num. adapter trimmed, num. quality trimmed, num. removed for N content, num. removed for length
+	quiet   bool   // don't log the QC stats (set by the KmerCounter, as the same reads are checked and logged again by the alignment pipeline)
 }
 
 // NewFastqChecker is the constructor
 func NewFastqChecker(info *Info) *FastqChecker {
-	return &FastqChecker{info: info, output: make(chan *seqio.FASTQread, BUFFERSIZE)}
+	return &FastqChecker{info: info, output: make(chan *seqio.FASTQread, BUFFERSIZE), qcStats: [5]int{0, 0, 0, 0, 0}}
 }
 
 // Connect is the method to join the input of this process with the output of FastqHandler
@@ -254,31 +383,233 @@ func (proc *FastqChecker) Connect(previous *FastqHandler) {
 	proc.input = previous.output
 }
 
+// ConnectBAM is the method to join the input of this process with the output of BAMreader
+func (proc *FastqChecker) ConnectBAM(previous *BAMreader) {
+	proc.input = previous.output
+}
+
+// CollectQCStats is a method to return the number of reads received and the number trimmed or removed by each QC filter
+func (proc *FastqChecker) CollectQCStats() [5]int {
+	return proc.qcStats
+}
+
 // Run is the method to run this process, which satisfies the pipeline interface
-// TODO: I've removed the QC bits for now
 func (proc *FastqChecker) Run() {
-	log.Printf("now streaming reads...")
+	if !proc.quiet {
+		log.Printf("now streaming reads...")
+	}
+
+	// reads must be long enough to contain at least one k-mer, regardless of the user-specified minimum length
+	minLength := int(proc.info.Sketch.MinLength * float64(proc.info.WindowSize))
+	if minLength < proc.info.KmerSize {
+		minLength = proc.info.KmerSize
+	}
 
 	// count the number of reads and their lengths as we go
-	rawCount, lengthTotal := 0, 0
+	lengthTotal, keptCount := 0, 0
 	for read := range proc.input {
-		rawCount++
-
-		// tally the length so we can report the mean
+		mate := read.Mate
 		lengthTotal += len(read.Seq)
+		readPass := proc.checkRead(read, minLength)
+
+		// paired reads are sent on together, so check the mate here too
+		if mate != nil {
+			lengthTotal += len(mate.Seq)
+			matePass := proc.checkRead(mate, minLength)
+
+			// if only one read of the pair passes QC, send it on as a single-end read
+			switch {
+			case readPass && !matePass:
+				read.Mate, read.Pair = nil, 0
+			case !readPass && matePass:
+				mate.Mate, mate.Pair = nil, 0
+				read, readPass = mate, true
+			case readPass && matePass:
+				keptCount++
+			}
+		}
+		if !readPass {
+			continue
+		}
+		keptCount++
 
 		// send the read onwards for mapping
 		proc.output <- read
 	}
 
 	// check we have received reads & print stats
-	if rawCount == 0 {
+	if proc.qcStats[0] == 0 {
 		misc.ErrorCheck(errors.New("no fastq reads received"))
 	}
-	log.Printf("\tnumber of reads received from input: %d\n", rawCount)
-	meanRL := float64(lengthTotal) / float64(rawCount)
-	log.Printf("\tmean read length: %.0f\n", meanRL)
 	close(proc.output)
+	if proc.quiet {
+		return
+	}
+	log.Printf("\tnumber of reads received from input: %d\n", proc.qcStats[0])
+	meanRL := float64(lengthTotal) / float64(proc.qcStats[0])
+	log.Printf("\tmean read length: %.0f\n", meanRL)
+	if len(proc.info.Sketch.Adapters) != 0 {
+		log.Printf("\tnumber of reads adapter trimmed: %d\n", proc.qcStats[1])
+	}
+	if proc.info.Sketch.QualTrim != 0 {
+		log.Printf("\tnumber of reads quality trimmed: %d\n", proc.qcStats[2])
+	}
+	if proc.info.Sketch.MaxNfrac != 0 {
+		log.Printf("\tnumber of reads removed for N content: %d\n", proc.qcStats[3])
+	}
+	log.Printf("\tnumber of reads removed for length (< %d bases): %d\n", minLength, proc.qcStats[4])
+	log.Printf("\tnumber of reads passing QC: %d\n", keptCount)
+}
+
+// checkRead is a method to run the QC filters on a single read, trimming it in place and returning false if it should be removed
+func (proc *FastqChecker) checkRead(read *seqio.FASTQread, minLength int) bool {
+	proc.qcStats[0]++
+	read.BaseCheck()
+	if len(proc.info.Sketch.Adapters) != 0 && read.AdapterTrim(proc.info.Sketch.Adapters, minAdapterOverlap) {
+		proc.qcStats[1]++
+	}
+
+	// FASTA input (and BAM input without quality scores) can't be quality trimmed
+	if proc.info.Sketch.QualTrim != 0 && read.Qual != nil {
+		untrimmedLength := len(read.Seq)
+		read.QualTrim(proc.info.Sketch.QualTrim)
+		if len(read.Seq) != untrimmedLength {
+			proc.qcStats[2]++
+		}
+	}
+	if proc.info.Sketch.MaxNfrac != 0 && read.NFraction() > proc.info.Sketch.MaxNfrac {
+		proc.qcStats[3]++
+		return false
+	}
+	if len(read.Seq) < minLength {
+		proc.qcStats[4]++
+		return false
+	}
+	return true
+}
+
+// LoadAdapters is a function to read the adapter sequences from a FASTA file, ready for trimming
+func LoadAdapters(fileName string) ([][]byte, error) {
+	scanner, closeInput, err := openInput(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer closeInput()
+	parser := seqio.NewParser(fileName, true)
+	adapters := [][]byte{}
+	addAdapter := func(adapter *seqio.FASTQread) {
+		adapter.BaseCheck()
+		adapters = append(adapters, adapter.Seq)
+	}
+	for scanner.Scan() {
+		adapter, err := parser.Parse(scanner.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if adapter != nil {
+			addAdapter(adapter)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	adapter, err := parser.Flush()
+	if err != nil {
+		return nil, err
+	}
+	if adapter != nil {
+		addAdapter(adapter)
+	}
+	if len(adapters) == 0 {
+		return nil, fmt.Errorf("no adapter sequences found in %v", fileName)
+	}
+	return adapters, nil
+}
+
+// KmerCounter is a pipeline process to count the k-mers in all the reads of a sample, so that the ReadMapper can exclude k-mers seen only once from the read sketches (if BloomFilter is set)
+// it is run in its own pipeline before the alignment pipeline, so that the reads are streamed twice rather than held in memory
+type KmerCounter struct {
+	info          *Info
+	input         chan *seqio.FASTQread
+	expectedKmers int // used to size the Bloom filters
+}
+
+// NewKmerCounter is the constructor, the Bloom filters are sized using the decompressed size of the input files (which can't be less than the number of k-mers in them)
+func NewKmerCounter(info *Info, inputFiles []string) (*KmerCounter, error) {
+	expectedKmers := 0
+	for _, inputFile := range inputFiles {
+		size, err := estimateDecompressedSize(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		expectedKmers += size
+	}
+	if expectedKmers == 0 {
+		return nil, fmt.Errorf("the k-mers can only be counted for input files, as the reads are streamed twice")
+	}
+	return &KmerCounter{info: info, expectedKmers: expectedKmers}, nil
+}
+
+// sizeSample is the number of decompressed bytes used to estimate the compression ratio of an input file
+const sizeSample = 16 * 1024 * 1024
+
+// estimateDecompressedSize is a function to estimate the decompressed size of an input file, using the compression ratio of the start of the file
+// the size is exact for uncompressed files and for compressed files that decompress to less than the sample size
+func estimateDecompressedSize(fileName string) (int, error) {
+	fh, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+	fileInfo, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	compressed := &countingReader{reader: fh}
+	reader, closeReader, err := decompress(compressed)
+	if err != nil {
+		return 0, fmt.Errorf("could not read %v: %v", fileName, err)
+	}
+	defer closeReader()
+	decompressed, err := io.CopyN(ioutil.Discard, reader, sizeSample)
+	switch {
+	case err == io.EOF:
+		return int(decompressed), nil
+	case err != nil:
+		return 0, fmt.Errorf("could not read %v: %v", fileName, err)
+	}
+	return int(float64(fileInfo.Size()) * float64(decompressed) / float64(compressed.count)), nil
+}
+
+// countingReader is used to count the bytes read from a file
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+// Read satisfies the io.Reader interface
+func (countingReader *countingReader) Read(p []byte) (int, error) {
+	n, err := countingReader.reader.Read(p)
+	countingReader.count += int64(n)
+	return n, err
+}
+
+// Connect is the method to join the input of this process with the output of FastqChecker, the FastqChecker is silenced as the alignment pipeline logs the QC stats
+func (proc *KmerCounter) Connect(previous *FastqChecker) {
+	previous.quiet = true
+	proc.input = previous.output
+}
+
+// Run is the method to run this process, which satisfies the pipeline interface
+func (proc *KmerCounter) Run() {
+	counter := minhash.NewKmerCounter(uint(proc.info.KmerSize), proc.expectedKmers)
+	for read := range proc.input {
+		misc.ErrorCheck(counter.AddSequence(read.Seq))
+		if read.Mate != nil {
+			misc.ErrorCheck(counter.AddSequence(read.Mate.Seq))
+		}
+	}
+	proc.info.Sketch.kmerCounter = counter
 }
 
 // ReadMapper is a pipeline process to query the LSH database, map reads and project alignments onto graphs
@@ -338,16 +669,18 @@ func (proc *ReadMapper) Run() {
 	log.Printf("\t\tmapped to multiple graphs: %d\n", theBoss.multimappedCount)
 	log.Printf("\ttotal number of exact alignments: %d\n", theBoss.alignmentCount)
 
-	// send on the graphs for pruning now that the mapping is done
+	// record the total number of projected k-mers before any graphs are sent on, as this is needed for writing weighted graphs and for EM
 	for _, g := range proc.info.Store {
 		proc.readStats[3] += int(g.KmerTotal)
-		proc.output <- g
 	}
+	proc.info.Haplotype.TotalKmers = proc.readStats[3]
 	log.Print("processing graphs...")
 	log.Printf("\ttotal number of k-mers projected onto graphs: %d\n", proc.readStats[3])
 
-	// fix for Wasm: needs total number of processed kmers recording as we don't recalc this later
-	proc.info.Haplotype.TotalKmers = proc.readStats[3]
+	// send on the graphs for pruning now that the mapping is done
+	for _, g := range proc.info.Store {
+		proc.output <- g
+	}
 }
 
 // GraphPruner is a pipeline process to prune the graphs post mapping
@@ -411,6 +744,13 @@ func (proc *GraphPruner) Run() {
 			log.Printf("\t- [%v]", string(path))
 			keptPaths = append(keptPaths, string(path))
 		}
+
+		// write the weighted graph before it is sent on (the EMpathFinder will reduce it)
+		if proc.info.Sketch.GraphDir != "" {
+			fileName := fmt.Sprintf("%v/groot-graph-%d.gfa", proc.info.Sketch.GraphDir, g.GraphID)
+			_, err := g.SaveGraphAsGFA(fileName, proc.info.Haplotype.TotalKmers)
+			misc.ErrorCheck(err)
+		}
 		if proc.connectHaplotype {
 			proc.output <- g
 		}
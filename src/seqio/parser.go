@@ -0,0 +1,171 @@
+package seqio
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// the parser states
+const (
+	expectHeader = iota
+	inSequence
+	inQuality
+)
+
+// the range of valid (Phred+33) quality scores
+const (
+	minQual = '!'
+	maxQual = '~'
+)
+
+// Parser is a streaming FASTQ/FASTA parser - it is fed one line at a time and validates each record as it is completed
+// it handles blank lines, Windows line endings and multi-line records, and errors report the source and line number
+type Parser struct {
+	source     string // the name of the input being parsed (used in error messages)
+	fasta      bool   // the input is FASTA, not FASTQ
+	lineNum    int    // the number of lines parsed so far
+	state      int    // what the parser expects next
+	header     []byte // the header of the current record
+	headerLine int    // the line number of the header for the current record
+	seq        []byte // the sequence of the current record
+	qual       []byte // the quality scores of the current record
+}
+
+// NewParser is the constructor
+func NewParser(source string, fasta bool) *Parser {
+	return &Parser{source: source, fasta: fasta, state: expectHeader}
+}
+
+// Parse is a method to parse the next line of input, it returns a read if the line completes a record
+// for FASTA, records are completed by the next header or by calling Flush
+func (Parser *Parser) Parse(line []byte) (*FASTQread, error) {
+	Parser.lineNum++
+	line = bytes.TrimRight(line, "\r\n")
+
+	// blank lines are only allowed between records (or between FASTA lines)
+	if len(bytes.TrimSpace(line)) == 0 {
+		if Parser.state == inQuality {
+			return nil, Parser.errorf("blank line in quality scores")
+		}
+		return nil, nil
+	}
+	if Parser.fasta {
+		return Parser.parseFASTA(line)
+	}
+	return Parser.parseFASTQ(line)
+}
+
+// Flush is a method to complete the final record once all the input has been parsed
+func (Parser *Parser) Flush() (*FASTQread, error) {
+	switch {
+	case Parser.header == nil:
+		return nil, nil
+	case Parser.fasta:
+		return Parser.newRecord()
+	default:
+		return nil, fmt.Errorf("%v line %d: truncated FASTQ record at end of input", Parser.source, Parser.headerLine)
+	}
+}
+
+// parseFASTQ is a method to parse a line of FASTQ
+func (Parser *Parser) parseFASTQ(line []byte) (*FASTQread, error) {
+	switch Parser.state {
+	case expectHeader:
+		if line[0] != '@' {
+			return nil, Parser.errorf("expected FASTQ header beginning with @, got: %.20q", line)
+		}
+		Parser.startRecord(line)
+		Parser.state = inSequence
+	case inSequence:
+
+		// the separator ends the sequence, which can be spread over several lines
+		if line[0] == '+' {
+			if len(Parser.seq) == 0 {
+				return nil, Parser.errorf("FASTQ record has no sequence")
+			}
+			Parser.state = inQuality
+			return nil, nil
+		}
+		if err := Parser.addSequence(line); err != nil {
+			return nil, err
+		}
+	case inQuality:
+
+		// quality lines can begin with @ or +, so keep going until there are as many scores as bases
+		for _, qual := range line {
+			if qual < minQual || qual > maxQual {
+				return nil, Parser.errorf("quality score out of the Phred+33 range: %q", qual)
+			}
+		}
+		Parser.qual = append(Parser.qual, line...)
+		if len(Parser.qual) > len(Parser.seq) {
+			return nil, Parser.errorf("more quality scores (%d) than bases (%d) in FASTQ record", len(Parser.qual), len(Parser.seq))
+		}
+		if len(Parser.qual) == len(Parser.seq) {
+			Parser.state = expectHeader
+			return Parser.newRecord()
+		}
+	}
+	return nil, nil
+}
+
+// parseFASTA is a method to parse a line of FASTA
+func (Parser *Parser) parseFASTA(line []byte) (*FASTQread, error) {
+	if line[0] != '>' {
+		if Parser.header == nil {
+			return nil, Parser.errorf("expected FASTA header beginning with >, got: %.20q", line)
+		}
+		return nil, Parser.addSequence(line)
+	}
+
+	// a new header completes the previous record
+	var read *FASTQread
+	var err error
+	if Parser.header != nil {
+		if read, err = Parser.newRecord(); err != nil {
+			return nil, err
+		}
+	}
+	Parser.startRecord(line)
+	return read, nil
+}
+
+// startRecord is a method to reset the parser for a new record
+func (Parser *Parser) startRecord(header []byte) {
+	Parser.header = append([]byte("@"), header[1:]...)
+	Parser.headerLine = Parser.lineNum
+	Parser.seq, Parser.qual = nil, nil
+}
+
+// addSequence is a method to add a line of sequence to the current record
+func (Parser *Parser) addSequence(line []byte) error {
+	for _, base := range line {
+		if !(base >= 'A' && base <= 'Z') && !(base >= 'a' && base <= 'z') && base != '.' && base != '-' && base != '*' {
+			return Parser.errorf("invalid character in sequence: %q", base)
+		}
+	}
+	Parser.seq = append(Parser.seq, line...)
+	return nil
+}
+
+// newRecord is a method to create a read from the current record
+func (Parser *Parser) newRecord() (*FASTQread, error) {
+	if len(Parser.seq) == 0 {
+		return nil, fmt.Errorf("%v line %d: record has no sequence", Parser.source, Parser.headerLine)
+	}
+	var misc []byte
+	if !Parser.fasta {
+		misc = []byte("+")
+	}
+	read, err := NewFASTQread(Parser.header, Parser.seq, misc, Parser.qual)
+	if err != nil {
+		return nil, fmt.Errorf("%v line %d: %v", Parser.source, Parser.headerLine, err)
+	}
+	Parser.header, Parser.seq, Parser.qual = nil, nil, nil
+	return read, nil
+}
+
+// errorf is a method to return an error that includes the source and current line number
+func (Parser *Parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%v line %d: %v", Parser.source, Parser.lineNum, fmt.Sprintf(format, args...))
+}
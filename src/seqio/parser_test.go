@@ -0,0 +1,95 @@
+package seqio
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// parseAll is a helper to run the parser over some input
+func parseAll(input string, fasta bool) ([]*FASTQread, error) {
+	parser := NewParser("test", fasta)
+	reads := []*FASTQread{}
+	for _, line := range strings.Split(input, "\n") {
+		read, err := parser.Parse([]byte(line))
+		if err != nil {
+			return nil, err
+		}
+		if read != nil {
+			reads = append(reads, read)
+		}
+	}
+	read, err := parser.Flush()
+	if err != nil {
+		return nil, err
+	}
+	if read != nil {
+		reads = append(reads, read)
+	}
+	return reads, nil
+}
+
+func TestParserFASTQ(t *testing.T) {
+
+	// single and multi-line records, blank lines, Windows line endings and a quality line starting with @
+	input := "@read1\r\nACGT\r\n+\r\nIIII\r\n\n@read2\nACG\nTAC\n+read2\n@II\nIII\n"
+	reads, err := parseAll(input, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reads) != 2 {
+		t.Fatalf("expected 2 reads, got %d", len(reads))
+	}
+	if string(reads[0].ID) != "@read1" || !bytes.Equal(reads[0].Seq, []byte("ACGT")) {
+		t.Errorf("first read parsed incorrectly: %v %v", string(reads[0].ID), string(reads[0].Seq))
+	}
+	if !bytes.Equal(reads[1].Seq, []byte("ACGTAC")) || !bytes.Equal(reads[1].Qual, []byte("@IIIII")) {
+		t.Errorf("multi-line read parsed incorrectly: %v %v", string(reads[1].Seq), string(reads[1].Qual))
+	}
+
+	// an empty input isn't an error
+	if reads, err := parseAll("", false); err != nil || len(reads) != 0 {
+		t.Errorf("empty input should give no reads and no error")
+	}
+}
+
+func TestParserFASTQerrors(t *testing.T) {
+	tests := map[string]string{
+		"@read1\nACGT\n+\nIII":         "test line 1: truncated",
+		"read1\nACGT\n+\nIIII\n":       "test line 1: expected FASTQ header",
+		"@read1\nACGT\n+\nIIIII\n":     "test line 4: more quality scores",
+		"@read1\nACGT\n+\nII I\n":      "test line 4: quality score out of the Phred+33 range",
+		"@read1\nAC1T\n+\nIIII\n":      "test line 2: invalid character",
+		"@read1\nACGT\n@read2\nACGT\n": "test line 3: invalid character",
+		"@read1\n+\n\n":                "test line 2: FASTQ record has no sequence",
+	}
+	for input, expected := range tests {
+		_, err := parseAll(input, false)
+		if err == nil {
+			t.Errorf("expected an error for %q", input)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), expected) {
+			t.Errorf("expected error beginning %q, got %q", expected, err.Error())
+		}
+	}
+}
+
+func TestParserFASTA(t *testing.T) {
+	reads, err := parseAll(">seq1 description\r\nACGT\r\nACGT\n\n>seq2\nTTTT", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reads) != 2 {
+		t.Fatalf("expected 2 sequences, got %d", len(reads))
+	}
+	if string(reads[0].ID) != "@seq1 description" || !bytes.Equal(reads[0].Seq, []byte("ACGTACGT")) {
+		t.Errorf("multi-line FASTA parsed incorrectly: %v %v", string(reads[0].ID), string(reads[0].Seq))
+	}
+	if _, err := parseAll("ACGT\n>seq1\nACGT", true); err == nil || !strings.HasPrefix(err.Error(), "test line 1:") {
+		t.Errorf("expected a line-numbered error for FASTA without a header, got %v", err)
+	}
+	if _, err := parseAll(">seq1\n>seq2\nACGT", true); err == nil {
+		t.Errorf("expected an error for a FASTA record without a sequence")
+	}
+}
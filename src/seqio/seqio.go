@@ -4,6 +4,7 @@
 package seqio
 
 import (
+	"bytes"
 	"fmt"
 	"unicode"
 
@@ -34,37 +35,40 @@ type FASTQread struct {
 	Misc []byte
 	Qual []byte
 	RC   bool
+	Mate *FASTQread // the other read of the pair (nil for single-end reads)
+	Pair uint8      // identifies the read as the first (1) or second (2) read of a pair, or 0 for single-end reads
+	RG   string     // the read group ID (only set for reads from BAM/SAM input)
 }
 
 // RunMinHash is a method to create a minhash sketch for the sequence
-func (Sequence *Sequence) RunMinHash(kmerSize, sketchSize int, kmv bool, bf *minhash.BloomFilter) ([]uint64, error) {
+// it also returns the orientation of the k-mer that gave each value in the sketch, which is used to find the strand of a read relative to a graph window
+func (Sequence *Sequence) RunMinHash(kmerSize, sketchSize int, algorithm minhash.Algorithm, bf *minhash.BloomFilter) ([]uint64, []bool, error) {
 
 	// create the MinHash data structure, using the specified algorithm flavour
-	var mh minhash.MinHash
-	if kmv {
-		mh = minhash.NewKMVsketch(uint(kmerSize), uint(sketchSize))
-	} else {
-		mh = minhash.NewKHFsketch(uint(kmerSize), uint(sketchSize))
+	mh, err := minhash.NewSketch(algorithm, uint(kmerSize), uint(sketchSize), bf)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// use the AddSequence method to populate the MinHash
-	err := mh.AddSequence(Sequence.Seq)
+	err = mh.AddSequence(Sequence.Seq)
 
-	// get the sketch
+	// get the sketch and k-mer orientations
 	sketch := mh.GetSketch()
+	strands := mh.GetStrands()
 
-	// if the sketch isn't at capacity (in the case of BottomK sketches), fill up the remainder with 0s
-	if kmv && len(sketch) != sketchSize {
+	// if the sketch isn't at capacity (in the case of BottomK sketches), fill up the remainder with empty slots
+	if len(sketch) < sketchSize {
 		padding := make([]uint64, sketchSize-len(sketch))
 		for i := 0; i < len(padding); i++ {
-			padding[i] = 0
+			padding[i] = minhash.EMPTYSLOT
 		}
 		sketch = append(sketch, padding...)
-
+		strands = append(strands, make([]bool, len(padding))...)
 	}
 
-	// return the MinHash sketch and any error
-	return sketch, err
+	// return the MinHash sketch, the k-mer orientations and any error
+	return sketch, strands, err
 }
 
 // BaseCheck is a method to check for ACTGN bases and also to convert bases to upper case
@@ -113,9 +117,61 @@ func (r *FASTQread) DeepCopy() *FASTQread {
 	for i := 0; i < len(r.Qual); i++ {
 		newFASTQ.Qual[i] = r.Qual[i]
 	}
+	newFASTQ.RC = r.RC
+	newFASTQ.Pair = r.Pair
+	newFASTQ.RG = r.RG
+
+	// copy the mate too, making sure the copies point at each other
+	if r.Mate != nil {
+		mate := *r.Mate
+		newMate := FASTQread{
+			Sequence: Sequence{
+				ID:  append([]byte(nil), mate.ID...),
+				Seq: append([]byte(nil), mate.Seq...),
+			},
+			Misc: append([]byte(nil), mate.Misc...),
+			Qual: append([]byte(nil), mate.Qual...),
+			RC:   mate.RC,
+			Pair: mate.Pair,
+			RG:   mate.RG,
+			Mate: &newFASTQ,
+		}
+		newFASTQ.Mate = &newMate
+	}
 	return &newFASTQ
 }
 
+// Name is a method to return the read name to use in SAM records
+// for single-end reads this is the read ID without the leading @, for paired reads it is the name shared by both reads of the pair
+func (r *FASTQread) Name() string {
+	if r.Pair == 0 {
+		return string(r.ID[1:])
+	}
+	return string(templateName(r.ID))
+}
+
+// PairReads is a function to link two reads from a read pair, it returns an error if the read IDs don't match
+func PairReads(r1, r2 *FASTQread) error {
+	if !bytes.Equal(templateName(r1.ID), templateName(r2.ID)) {
+		return fmt.Errorf("read IDs in pair do not match: %v and %v", string(r1.ID), string(r2.ID))
+	}
+	r1.Mate, r1.Pair = r2, 1
+	r2.Mate, r2.Pair = r1, 2
+	return nil
+}
+
+// templateName returns the part of a read ID that is shared by both reads of a pair (no @, comment or /1 /2 suffix)
+func templateName(id []byte) []byte {
+	name := bytes.TrimPrefix(id, []byte("@"))
+	if i := bytes.IndexAny(name, " \t"); i != -1 {
+		name = name[:i]
+	}
+	if len(name) > 2 && name[len(name)-2] == '/' && (name[len(name)-1] == '1' || name[len(name)-1] == '2') {
+		name = name[:len(name)-2]
+	}
+	return name
+}
+
 // RevComplement is a method to reverse complement a sequence held by a FASTQread
 func (r *FASTQread) RevComplement() {
 	for i, j := 0, len(r.Seq); i < j; i++ {
@@ -123,6 +179,10 @@ func (r *FASTQread) RevComplement() {
 	}
 	for i, j := 0, len(r.Seq)-1; i <= j; i, j = i+1, j-1 {
 		r.Seq[i], r.Seq[j] = r.Seq[j], r.Seq[i]
+	}
+
+	// FASTA sequences don't have quality scores to reverse
+	for i, j := 0, len(r.Qual)-1; i <= j; i, j = i+1, j-1 {
 		r.Qual[i], r.Qual[j] = r.Qual[j], r.Qual[i]
 	}
 	if r.RC == true {
@@ -169,12 +229,63 @@ func (r *FASTQread) QualTrim(minQual int) {
 	r.Qual = r.Qual[start:end]
 }
 
+// AdapterTrim is a method to trim an adapter sequence (and anything after it) from the 3' end of the sequence held by a FASTQread
+/* the algorithm looks for each adapter in two ways:
+-1. a full length match anywhere in the read
+-2. a partial match, where the end of the read matches the start of the adapter by at least minOverlap bases (longest overlap first)
+-3. the read is trimmed at the earliest match, returning true if any bases were removed
+*/
+func (r *FASTQread) AdapterTrim(adapters [][]byte, minOverlap int) bool {
+	trimAt := len(r.Seq)
+	for _, adapter := range adapters {
+		if i := bytes.Index(r.Seq, adapter); i != -1 {
+			if i < trimAt {
+				trimAt = i
+			}
+			continue
+		}
+		overlap := len(adapter) - 1
+		if overlap > len(r.Seq) {
+			overlap = len(r.Seq)
+		}
+		for ; overlap >= minOverlap; overlap-- {
+			start := len(r.Seq) - overlap
+			if start >= trimAt {
+				break
+			}
+			if bytes.Equal(r.Seq[start:], adapter[:overlap]) {
+				trimAt = start
+				break
+			}
+		}
+	}
+	if trimAt == len(r.Seq) {
+		return false
+	}
+	r.Seq = r.Seq[:trimAt]
+	if len(r.Qual) > trimAt {
+		r.Qual = r.Qual[:trimAt]
+	}
+	return true
+}
+
+// NFraction is a method to return the proportion of N bases in the sequence held by a FASTQread
+func (r *FASTQread) NFraction() float64 {
+	if len(r.Seq) == 0 {
+		return 0
+	}
+	return float64(bytes.Count(r.Seq, []byte("N"))) / float64(len(r.Seq))
+}
+
 // NewFASTQread generates a new fastq read from 4 lines of data
 func NewFASTQread(l1 []byte, l2 []byte, l3 []byte, l4 []byte) (*FASTQread, error) {
-	// check that it looks like a fastq read TODO: need more fastq checks
-	//if len(l2) != len(l4) {
-	//	return nil, errors.New("sequence and quality score lines are unequal lengths in fastq file")
-	//}
+	// check that it looks like a fastq read (FASTA sequences are passed in without quality scores)
+	if len(l1) == 0 || len(l2) == 0 {
+		return nil, fmt.Errorf("read is missing an ID or sequence")
+	}
+	if l4 != nil && len(l2) != len(l4) {
+		return nil, fmt.Errorf("sequence and quality scores are unequal lengths (%d and %d) in fastq read: %v", len(l2), len(l4), string(l1))
+	}
 	if l1[0] != 64 {
 		return nil, fmt.Errorf("read ID in fastq file does not begin with @: %v", string(l1))
 	}
@@ -2,6 +2,8 @@ package seqio
 
 import (
 	"testing"
+
+	"github.com/will-rowe/groot/src/minhash"
 )
 
 // setup variables
@@ -71,16 +73,80 @@ func TestMinHash(t *testing.T) {
 	if err != nil {
 		t.Fatalf("could not generate FASTQ read using NewFASTQread")
 	}
-	// sketch using KHF MinHash
-	if sketch, err := read.RunMinHash(kmerSize, sketchSize, true, nil); err != nil {
+	// sketch using KMV MinHash
+	if sketch, _, err := read.RunMinHash(kmerSize, sketchSize, minhash.KMV, nil); err != nil {
 		t.Fatal(err)
 	} else {
 		t.Log(sketch)
 	}
-	// sketch using KMV MinHash
-	if sketch, err := read.RunMinHash(kmerSize, sketchSize, false, nil); err != nil {
+	// sketch using KHF MinHash
+	if sketch, _, err := read.RunMinHash(kmerSize, sketchSize, minhash.KHF, nil); err != nil {
 		t.Fatal(err)
 	} else {
 		t.Log(sketch)
 	}
 }
+
+func TestPairReads(t *testing.T) {
+	r1, err := NewFASTQread([]byte("@read1/1"), l2, l3, l4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewFASTQread([]byte("@read1/2"), l2, l3, l4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PairReads(r1, r2); err != nil {
+		t.Fatal(err)
+	}
+	if r1.Mate != r2 || r2.Mate != r1 || r1.Pair != 1 || r2.Pair != 2 {
+		t.Errorf("PairReads did not link the reads")
+	}
+	if r1.Name() != "read1" || r2.Name() != "read1" {
+		t.Errorf("paired reads should share a name: %v, %v", r1.Name(), r2.Name())
+	}
+	r1Copy := r1.DeepCopy()
+	if r1Copy.Mate == r2 || r1Copy.Mate.Mate != r1Copy || r1Copy.Mate.Name() != "read1" {
+		t.Errorf("DeepCopy did not copy the mate")
+	}
+
+	// Casava style IDs should also pair, but mismatched IDs should not
+	r3, _ := NewFASTQread([]byte("@read2 1:N:0:1"), l2, l3, l4)
+	r4, _ := NewFASTQread([]byte("@read2 2:N:0:1"), l2, l3, l4)
+	if err := PairReads(r3, r4); err != nil {
+		t.Fatal(err)
+	}
+	if err := PairReads(r1, r4); err == nil {
+		t.Errorf("PairReads should not pair reads with different IDs")
+	}
+}
+
+func TestAdapterTrim(t *testing.T) {
+	adapters := [][]byte{[]byte("AGATCGGAAGAGC")}
+	tests := map[string]string{
+		"ACGTACGTAGATCGGAAGAGCACGT": "ACGTACGT",             // full adapter within the read
+		"ACGTACGTACGTAGATCG":        "ACGTACGTACGT",         // partial adapter at the 3' end
+		"ACGTACGTACGTAGAT":          "ACGTACGTACGTAGAT",     // overlap is too short to trim
+		"ACGTACGTACGTACGTACGT":      "ACGTACGTACGTACGTACGT", // no adapter
+	}
+	for seq, expected := range tests {
+		read, err := NewFASTQread([]byte("@read"), []byte(seq), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trimmed := read.AdapterTrim(adapters, 5)
+		if string(read.Seq) != expected || trimmed != (seq != expected) {
+			t.Errorf("AdapterTrim gave %v for %v, expected %v", string(read.Seq), seq, expected)
+		}
+	}
+
+	// sequences without quality scores can still be reverse complemented
+	read, _ := NewFASTQread([]byte("@read"), []byte("AACG"), nil, nil)
+	read.RevComplement()
+	if string(read.Seq) != "CGTT" {
+		t.Errorf("RevComplement failed for a read without quality scores")
+	}
+	if read.NFraction() != 0 {
+		t.Errorf("NFraction failed")
+	}
+}